@@ -0,0 +1,172 @@
+package main
+
+import (
+	"ThermoServer/bme680"
+	"ThermoServer/scd4x"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// adminAuth only lets requests through that present the --admin-token as Authorization: Bearer header.
+func adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if args.AdminToken == "" {
+			http.Error(w, "admin endpoints are disabled, see --admin-token", http.StatusNotFound)
+			return
+		}
+
+		// The scheme is case-insensitive, the token isn't
+		scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(token), []byte(args.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bmeResetHandler soft resets the BME680.
+func bmeResetHandler(w http.ResponseWriter, r *http.Request) {
+	dev := bmeDevice()
+	if dev == nil {
+		http.Error(w, "no BME680 in use", http.StatusNotFound)
+		return
+	}
+
+	log.Println("Resetting the BME680")
+	if err := dev.Reset(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// bmeSelfTestHandler runs the BME680 self-test. It holds up readings from the BME680 while it runs.
+func bmeSelfTestHandler(w http.ResponseWriter, r *http.Request) {
+	dev := bmeDevice()
+	if dev == nil {
+		http.Error(w, "no BME680 in use", http.StatusNotFound)
+		return
+	}
+
+	log.Println("Running the BME680 self-test")
+	report, err := dev.SelfTest()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, NewSelfTestResult(report))
+}
+
+// openBMEForDiagnosis opens the BME680 for a CLI subcommand, which runs without the server.
+func openBMEForDiagnosis() (*bme680.Dev, func()) {
+	bus := setupI2CBus(args.I2CDevice)
+	dev, err := bme680.NewI2C(bus, BMEAddress, bme680.DefaultOpts)
+	if err != nil {
+		log.Fatalf("Couldn't open the BME680: %v\n", err)
+	}
+	return dev, func() {
+		dev.Halt()
+		bus.Close()
+	}
+}
+
+// SelfTestCommand runs the BME680 self-test and prints its report. It exits with status 1 if the sensor failed.
+type SelfTestCommand struct{}
+
+func (c *SelfTestCommand) Execute([]string) error {
+	dev, closeDev := openBMEForDiagnosis()
+	report, err := dev.SelfTest()
+	closeDev()
+	if err != nil {
+		log.Fatalf("Couldn't run the self-test: %v\n", err)
+	}
+
+	out, err := json.MarshalIndent(NewSelfTestResult(report), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+
+	if !report.Passed() {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// ResetCommand soft resets the BME680.
+type ResetCommand struct{}
+
+func (c *ResetCommand) Execute([]string) error {
+	dev, closeDev := openBMEForDiagnosis()
+	defer closeDev()
+
+	if err := dev.Reset(); err != nil {
+		log.Fatalf("Couldn't reset the BME680: %v\n", err)
+	}
+	log.Printf("Reset the %s\n", dev.Name())
+	return nil
+}
+
+// scdSettingsHandler returns the SCD4x settings, after changing the ones given in a POST request's body.
+// Changing them interrupts periodic measurement for a few seconds.
+func scdSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	dev := scdDevice()
+	if dev == nil {
+		http.Error(w, "no SCD4x in use", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var req SCDSettings
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid settings: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		log.Println("Configuring the SCD4x")
+		s := scd4x.Settings{TemperatureOffset: req.TemperatureOffset, Altitude: req.Altitude, AutomaticSelfCalibration: req.ASC}
+		if err := dev.Configure(s, req.Persist); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	s, err := dev.Settings()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, SCDSettings{TemperatureOffset: s.TemperatureOffset, Altitude: s.Altitude, ASC: s.AutomaticSelfCalibration})
+}
+
+// scdFRCHandler performs a forced recalibration of the SCD4x to the CO2 concentration given as {"ppm": 420}.
+func scdFRCHandler(w http.ResponseWriter, r *http.Request) {
+	dev := scdDevice()
+	if dev == nil {
+		http.Error(w, "no SCD4x in use", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		PPM uint16 `json:"ppm"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PPM == 0 {
+		http.Error(w, "ppm is required", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Performing SCD4x forced recalibration to %d ppm\n", req.PPM)
+	correction, err := dev.PerformForcedRecalibration(req.PPM)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]int{"correction": correction})
+}
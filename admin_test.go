@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	old := args.AdminToken
+	t.Cleanup(func() { args.AdminToken = old })
+
+	handler := adminAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, c := range []struct {
+		token         string
+		authorization string
+		want          int
+	}{
+		{"", "Bearer secret", http.StatusNotFound},
+		{"secret", "Bearer secret", http.StatusOK},
+		{"secret", "bearer secret", http.StatusOK},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "secret", http.StatusUnauthorized},
+		{"secret", "Basic secret", http.StatusUnauthorized},
+		{"secret", "Bearer", http.StatusUnauthorized},
+		{"secret", "Bearer  secret", http.StatusUnauthorized},
+		{"secret", "Bearer secret2", http.StatusUnauthorized},
+		{"secret", "Bearer Secret", http.StatusUnauthorized},
+	} {
+		args.AdminToken = c.token
+		r := httptest.NewRequest(http.MethodPost, "/admin/bme680/reset", nil)
+		if c.authorization != "" {
+			r.Header.Set("Authorization", c.authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != c.want {
+			t.Errorf("token %q, Authorization %q: status %d, want %d", c.token, c.authorization, w.Code, c.want)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("token %q, Authorization %q: no WWW-Authenticate challenge", c.token, c.authorization)
+		}
+	}
+}
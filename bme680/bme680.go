@@ -23,10 +23,13 @@ const (
 	AddrCal1End   byte = 0xEE
 	AddrCal2Start byte = 0x8A
 	AddrCal2End   byte = 0xA0
+	AddrCal3Start byte = 0x00
+	AddrCal3End   byte = 0x04
 
 	// control registers from this point on
 
-	AddrReset byte = 0xE0
+	AddrReset  byte = 0xE0
+	AddrStatus byte = 0x73 // SPI only, selects the memory page and is accessible from both
 
 	AddrConfig   byte = 0x75
 	AddrCtrlMeas byte = 0x74
@@ -34,6 +37,8 @@ const (
 	AddrCtrlGas1 byte = 0x71
 	AddrCtrlGas0 byte = 0x70
 
+	AddrShdHeatrDur byte = 0x6E // only defined on BME688
+
 	AddrGasWait9 byte = 0x6D
 	AddrGasWait8 byte = 0x6C
 	AddrGasWait7 byte = 0x6B
@@ -69,6 +74,8 @@ const (
 
 	// data registers from this point on unless marked otherwise
 
+	AddrGasR688LSB byte = 0x2D // mixed status/data, only used on BME688
+	AddrGasR688MSB byte = 0x2C // only used on BME688
 	AddrGasRLSB    byte = 0x2B // mixed status/data
 	AddrGasRMSB    byte = 0x2A
 	AddrHumLSB     byte = 0x26
@@ -82,6 +89,41 @@ const (
 	AddrEasStatus0 byte = 0x1D // status only
 )
 
+// fieldLen is the length of a field data block, starting at AddrEasStatus0.
+// The BME688 has three of them back to back, which are filled in turn in parallel mode.
+const (
+	fieldLen   = 17
+	fieldCount = 3
+)
+
+// resetCmd starts a soft reset when written to AddrReset.
+const resetCmd byte = 0xB6
+
+// spiMemPage is the spi_mem_page bit of the status register. Page 0 holds registers 0x80 to 0xFF,
+// page 1 holds 0x00 to 0x7F, both addressed by their lower 7 bits.
+const spiMemPage byte = 0b10000
+
+// bits of the meas_status_x registers
+const (
+	newData      byte = 0b10000000
+	gasIndexMask byte = 0b1111
+)
+
+// bits of the gas_r_lsb register
+const (
+	gasValid     byte = 0b100000
+	heatStable   byte = 0b10000
+	gasRangeMask byte = 0b1111
+)
+
+// bits of the ctrl_gas_0 and ctrl_gas_1 registers
+const (
+	heatOff   byte = 0b1000
+	runGas680 byte = 0b01 << 4
+	runGas688 byte = 0b10 << 4
+	noStandby byte = 0b10000000 // odr3, only relevant in parallel mode
+)
+
 // Oversampling affects how much time is taken to measure each of temperature,
 // pressure and humidity.
 //
@@ -154,10 +196,12 @@ const (
 
 // DefaultOpts is the recommended default options.
 var DefaultOpts = Opts{
-	Temperature: O4x,
-	Pressure:    O4x,
-	Humidity:    O4x,
-	Filter:      NoFilter,
+	Temperature:    O4x,
+	Pressure:       O4x,
+	Humidity:       O4x,
+	Filter:         NoFilter,
+	HeaterTemp:     320,
+	HeaterDuration: 150 * time.Millisecond,
 }
 
 // Opts defines the options for the device.
@@ -170,6 +214,44 @@ type Opts struct {
 	Humidity Oversampling
 	// Filter is only used while using SenseContinuous()
 	Filter Filter
+	// HeaterTemp is the target temperature of the gas sensor's hot plate in °C.
+	// Values above 400°C are capped. 0 turns the heater off and skips the gas
+	// measurement.
+	HeaterTemp uint16
+	// HeaterDuration is how long the hot plate is held at HeaterTemp before the
+	// gas resistance is sampled. It can be at most 4032ms.
+	HeaterDuration time.Duration
+	// HeaterProfile puts a BME688 into parallel mode while using
+	// SenseContinuous() or MeasureContinuous(), cycling through up to ten heater
+	// steps. HeaterTemp and HeaterDuration are ignored then.
+	HeaterProfile []HeaterStep
+	// ProfileCycle is the length of one parallel mode measurement cycle.
+	// Heater step durations are multiples of it. Defaults to 140ms.
+	ProfileCycle time.Duration
+	// IntegerCompensation uses Bosch's fixed-point compensation formulas instead
+	// of the floating point ones. Results are slightly coarser, but bit-exact
+	// with the reference implementation on every architecture.
+	IntegerCompensation bool
+}
+
+// Measurement is the result of a single TPHG measurement cycle.
+type Measurement struct {
+	physic.Env
+
+	// GasResistance is the resistance of the gas sensor's metal oxide layer.
+	// It is only meaningful if both GasValid and HeatStable are set.
+	GasResistance physic.ElectricResistance
+	// GasValid mirrors the gas_valid_r bit: a gas conversion took place.
+	GasValid bool
+	// HeatStable mirrors the heat_stab_r bit: the hot plate reached its target
+	// temperature before the gas conversion started.
+	HeatStable bool
+	// GasIndex is the heater profile step the gas resistance was measured at.
+	// It is always 0 in forced mode.
+	GasIndex uint8
+	// MeasIndex is the sub-measurement index. It counts up with every
+	// measurement in parallel mode and wraps around after 255.
+	MeasIndex uint8
 }
 
 // mode is the operating mode.
@@ -178,7 +260,7 @@ type mode byte
 const (
 	sleep    mode = 0 // no operation, all registers accessible, lowest power, selected after startup
 	forced   mode = 1 // perform one measurement, store results and return to sleep mode
-	parallel mode = 2 // only supported on BME688, not implemented here
+	parallel mode = 2 // only supported on BME688, continuously cycles through a heater profile
 )
 
 const (
@@ -235,6 +317,12 @@ type Dev struct {
 	opts        Opts
 	name        string
 	calibration calibrationData
+	ambientTemp float64 // °C, used to compute the heater resistance
+
+	lastMeasIndex int // last sub-measurement index read in parallel mode, -1 if none
+
+	page      byte // SPI memory page currently selected, only valid if pageKnown is set
+	pageKnown bool
 
 	mu   sync.Mutex
 	stop chan struct{}
@@ -270,6 +358,15 @@ func (d *Dev) makeDev(opts Opts) error {
 		return fmt.Errorf("bme680: unexpected variant id 0x%X", variantID[0])
 	}
 
+	if err := d.checkOpts(&d.opts); err != nil {
+		return err
+	}
+
+	return d.initChip()
+}
+
+// initChip reads the calibration data and puts the sensor to sleep with the oversampling settings in d.opts.
+func (d *Dev) initChip() error {
 	var cal1 [(AddrCal1End + 1) - AddrCal1Start]byte
 	if err := d.readRegister(AddrCal1Start, cal1[:]); err != nil {
 		return err
@@ -280,7 +377,13 @@ func (d *Dev) makeDev(opts Opts) error {
 		return err
 	}
 
-	d.calibration = newCalibration(cal1[:], cal2[:])
+	var cal3 [(AddrCal3End + 1) - AddrCal3Start]byte
+	if err := d.readRegister(AddrCal3Start, cal3[:]); err != nil {
+		return err
+	}
+
+	d.calibration = newCalibration(cal1[:], cal2[:], cal3[:])
+	d.ambientTemp = 25
 	b := []byte{
 		AddrConfig, byte(NoFilter) << 2,
 		AddrCtrlHum, byte(d.opts.Humidity),
@@ -290,17 +393,71 @@ func (d *Dev) makeDev(opts Opts) error {
 	return d.writeCommands(b)
 }
 
-func (d *Dev) String() string {
-	return fmt.Sprintf("%s{%s}", d.name, d.d)
+// Name returns the detected chip variant, BME680 or BME688.
+func (d *Dev) Name() string {
+	return d.name
 }
 
-// isMeasuring returns the "measuring" bit of the eas_status_0 register
-func (d *Dev) isMeasuring() (bool, error) {
-	v := [1]byte{}
-	if err := d.readRegister(AddrEasStatus0, v[:]); err != nil {
-		return false, err
+// checkOpts returns an error if the device doesn't support opts.
+func (d *Dev) checkOpts(opts *Opts) error {
+	for _, o := range []Oversampling{opts.Temperature, opts.Pressure, opts.Humidity} {
+		if o > O16x {
+			return fmt.Errorf("bme680: invalid oversampling %s", o)
+		}
+	}
+	if opts.Filter > F128 {
+		return fmt.Errorf("bme680: invalid filter %d", opts.Filter)
+	}
+
+	if len(opts.HeaterProfile) > 0 {
+		if !d.is688 {
+			return fmt.Errorf("bme680: heater profiles require parallel mode, which the %s doesn't support", d.name)
+		}
+		if len(opts.HeaterProfile) > maxHeaterSteps {
+			return fmt.Errorf("bme680: heater profile has %d steps, at most %d are supported", len(opts.HeaterProfile), maxHeaterSteps)
+		}
+		if opts.profileCycle()-opts.tphDuration(false) <= 0 {
+			return fmt.Errorf("bme680: profile cycle of %s is shorter than the TPH measurement", opts.profileCycle())
+		}
+	}
+	return nil
+}
+
+// Opts returns the options the device currently uses.
+func (d *Dev) Opts() Opts {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.opts
+}
+
+// SetOpts changes the device's options. In forced mode, they take effect with
+// the next measurement. In parallel mode, the new heater profile is written
+// right away.
+//
+// Switching between forced and parallel mode requires calling Halt() first.
+func (d *Dev) SetOpts(opts Opts) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.checkOpts(&opts); err != nil {
+		return err
 	}
-	return v[0]&0b100000 == 1, nil
+
+	wasParallel := d.isParallel()
+	if d.stop != nil && wasParallel != (len(opts.HeaterProfile) > 0) {
+		return errors.New("bme680: can't switch between forced and parallel mode while sensing continuously")
+	}
+
+	d.opts = opts
+	if d.stop != nil && wasParallel {
+		return d.startParallel()
+	}
+	return nil
+}
+
+func (d *Dev) String() string {
+	return fmt.Sprintf("%s{%s}", d.name, d.d)
 }
 
 // isNewDataAvailable returns the "new_data_0" bit of the eas_status_0 register
@@ -309,82 +466,205 @@ func (d *Dev) isNewDataAvailable() (bool, error) {
 	if err := d.readRegister(AddrEasStatus0, v[:]); err != nil {
 		return false, err
 	}
-	return v[0]&0b10000000 == 0, nil
+	return v[0]&newData != 0, nil
+}
+
+// heaterCommands returns the register writes that set up heater profile 0 for the next forced mode measurement.
+// The heater resistance depends on the ambient temperature, so this is recomputed for every measurement.
+func (d *Dev) heaterCommands() []byte {
+	if d.opts.HeaterTemp == 0 {
+		return []byte{
+			AddrCtrlGas0, heatOff,
+			AddrCtrlGas1, 0,
+		}
+	}
+
+	runGas := runGas680
+	if d.is688 {
+		runGas = runGas688
+	}
+
+	return []byte{
+		AddrResHeat0, d.heaterResistance(d.opts.HeaterTemp),
+		AddrGasWait0, gasWait(d.opts.HeaterDuration),
+		AddrCtrlGas0, 0,
+		AddrCtrlGas1, runGas, // nb_conv = 0 selects heater profile 0
+	}
+}
+
+// heaterResistance returns the res_heat_x register value for targetTemp °C at the last measured temperature.
+func (d *Dev) heaterResistance(targetTemp uint16) byte {
+	if d.opts.IntegerCompensation {
+		return d.calibration.heaterResistanceInt(targetTemp, int8(d.ambientTemp))
+	}
+	return d.calibration.heaterResistance(targetTemp, d.ambientTemp)
+}
+
+// how long and how often measure polls for new data once the measurement should be done
+const (
+	newDataTimeout      = 50 * time.Millisecond
+	newDataPollInterval = 2 * time.Millisecond
+)
+
+// TimeoutError is returned when a measurement didn't produce new data in time.
+type TimeoutError struct {
+	Device string        // BME680 or BME688
+	Waited time.Duration // how long the measurement was waited for
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s: no new data after waiting %s for the measurement", e.Device, e.Waited)
+}
+
+// Timeout reports that this is a timeout, like net.Error does.
+func (e *TimeoutError) Timeout() bool {
+	return true
 }
 
 // measure puts the BME680 into forced mode, takes one measurement, and waits for new data.
-// The passed physics.Env object is then populated with the measurement data.
-func (d *Dev) measure(e *physic.Env) error {
-	err := d.writeCommands([]byte{
+// The passed Measurement object is then populated with the measurement data.
+func (d *Dev) measure(m *Measurement) error {
+	if d.stop != nil && d.isParallel() {
+		return d.formatError(errors.New("can't take a single measurement while running in parallel mode"))
+	}
+
+	b := []byte{
 		AddrConfig, byte(d.opts.Filter) << 2,
 		AddrCtrlHum, byte(d.opts.Humidity),
-		AddrCtrlMeas, byte(d.opts.Temperature)<<5 | byte(d.opts.Pressure)<<2 | byte(forced),
-	})
+	}
+	b = append(b, d.heaterCommands()...)
+	b = append(b, AddrCtrlMeas, byte(d.opts.Temperature)<<5|byte(d.opts.Pressure)<<2|byte(forced))
+
+	err := d.writeCommands(b)
 	if err != nil {
 		return d.formatError(err)
 	}
 
-	isMeasuring := true
-	isNewDataAvailable := false
-
-	// wait for data to become available
-	for isMeasuring && !isNewDataAvailable {
-		if isMeasuring, err = d.isMeasuring(); err != nil {
-			return d.formatError(err)
+	// The duration is computed as per the datasheet, so the data should be there by then.
+	// Give the sensor some slack before giving up, in case its clock runs slow.
+	wait := d.opts.forcedDuration()
+	time.Sleep(wait)
+	deadline := time.Now().Add(newDataTimeout)
+	for {
+		ok, err := d.isNewDataAvailable()
+		if err != nil {
+			return err
 		}
-		if isNewDataAvailable, err = d.isNewDataAvailable(); err != nil {
-			return d.formatError(err)
+		if ok {
+			break
 		}
-
-		time.Sleep(10 * time.Millisecond)
+		if time.Now().After(deadline) {
+			return &TimeoutError{Device: d.name, Waited: wait + newDataTimeout}
+		}
+		time.Sleep(newDataPollInterval)
 	}
 
-	return d.readDataRegisters(e)
+	return d.readDataRegisters(m)
 }
 
-// readDataRegisters reads temperature, pressure, and humidity measurements from the BME680's registers.
+// readDataRegisters reads temperature, pressure, humidity, and gas measurements from the BME680's registers.
 // It must be called with d.mu lock held.
-func (d *Dev) readDataRegisters(e *physic.Env) error {
-	buf := [8]byte{}
-	b := buf[:]
-	if err := d.readRegister(AddrPressMSB, b); err != nil {
+func (d *Dev) readDataRegisters(m *Measurement) error {
+	buf := [fieldLen]byte{}
+	if err := d.readRegister(AddrEasStatus0, buf[:]); err != nil {
 		return err
 	}
 
-	// These values are 20 bits as per doc.
-	pRaw := uint32(buf[0])<<12 | uint32(buf[1])<<4 | uint32(buf[2])>>4
-	tRaw := uint32(buf[3])<<12 | uint32(buf[4])<<4 | uint32(buf[5])>>4
-	hRaw := uint16(buf[6])<<8 | uint16(buf[7])
+	d.parseField(buf[:], m)
+	return nil
+}
 
-	var tempComp, tempFine, pressureComp, humidityComp float64
+// parseField compensates the raw values of a single field data block and stores them in m.
+// buf must start at the field's meas_status_x register.
+func (d *Dev) parseField(buf []byte, m *Measurement) {
+	m.GasIndex = buf[0] & gasIndexMask
+	m.MeasIndex = buf[1] // sub_meas_index_x directly follows meas_status_x
 
-	tempComp, tempFine = d.calibration.compensateTemp(tRaw)
-	tempCompNanoKelvin := tempComp*float64(physic.Celsius) + float64(physic.ZeroCelsius)
-	e.Temperature = physic.Temperature(tempCompNanoKelvin)
+	// These values are 20 bits as per doc.
+	pRaw := uint32(buf[AddrPressMSB-AddrEasStatus0])<<12 | uint32(buf[AddrPressLSB-AddrEasStatus0])<<4 | uint32(buf[AddrPressXLSB-AddrEasStatus0])>>4
+	tRaw := uint32(buf[AddrTempMSB-AddrEasStatus0])<<12 | uint32(buf[AddrTempLSB-AddrEasStatus0])<<4 | uint32(buf[AddrTempXLSB-AddrEasStatus0])>>4
+	hRaw := uint16(buf[AddrHumMSB-AddrEasStatus0])<<8 | uint16(buf[AddrHumLSB-AddrEasStatus0])
+
+	e := &m.Env
+	if d.opts.IntegerCompensation {
+		tempComp, tempFine := d.calibration.compensateTempInt(tRaw)
+		e.Temperature = physic.Temperature(tempComp)*10*physic.MilliKelvin + physic.ZeroCelsius
+		d.ambientTemp = float64(tempComp) / 100
+
+		if d.opts.Pressure != Off {
+			e.Pressure = physic.Pressure(d.calibration.compensatePressureInt(pRaw, tempFine)) * physic.Pascal
+		}
+		if d.opts.Humidity != Off {
+			e.Humidity = physic.RelativeHumidity(d.calibration.compensateHumidityInt(hRaw, tempFine)) * (physic.PercentRH / 1000)
+		}
+	} else {
+		tempComp, tempFine := d.calibration.compensateTemp(tRaw)
+		tempCompNanoKelvin := tempComp*float64(physic.Celsius) + float64(physic.ZeroCelsius)
+		e.Temperature = physic.Temperature(tempCompNanoKelvin)
+		d.ambientTemp = tempComp
+
+		if d.opts.Pressure != Off {
+			pressureComp := d.calibration.compensatePressure(pRaw, tempFine)
+			pressureCompNanoPascal := pressureComp * float64(physic.Pascal)
+			e.Pressure = physic.Pressure(pressureCompNanoPascal)
+		}
 
-	if d.opts.Pressure != Off {
-		pressureComp = d.calibration.compensatePressure(pRaw, tempFine)
-		pressureCompNanoPascal := pressureComp * float64(physic.Pascal)
-		e.Pressure = physic.Pressure(pressureCompNanoPascal)
+		if d.opts.Humidity != Off {
+			humidityComp := d.calibration.compensateHumidity(hRaw, tempFine)
+			humidityCompRH := humidityComp * float64(physic.PercentRH)
+			e.Humidity = physic.RelativeHumidity(humidityCompRH)
+		}
 	}
 
-	if d.opts.Humidity != Off {
-		humidityComp = d.calibration.compensateHumidity(hRaw, tempFine)
-		humidityCompRH := humidityComp * float64(physic.PercentRH)
-		e.Humidity = physic.RelativeHumidity(humidityCompRH)
+	if d.opts.HeaterTemp != 0 || d.isParallel() {
+		// The BME688 reports its gas measurements in a different register pair.
+		msb, lsb := AddrGasRMSB, AddrGasRLSB
+		if d.is688 {
+			msb, lsb = AddrGasR688MSB, AddrGasR688LSB
+		}
+		gMSB, gLSB := buf[msb-AddrEasStatus0], buf[lsb-AddrEasStatus0]
+
+		// The gas ADC value is 10 bits, followed by the status bits and the range.
+		gRaw := uint16(gMSB)<<2 | uint16(gLSB)>>6
+		gRange := gLSB & gasRangeMask
+
+		switch {
+		case d.opts.IntegerCompensation && d.is688:
+			m.GasResistance = physic.ElectricResistance(compensateGasHighInt(gRaw, gRange)) * physic.Ohm
+		case d.opts.IntegerCompensation:
+			m.GasResistance = physic.ElectricResistance(d.calibration.compensateGasInt(gRaw, gRange)) * physic.Ohm
+		case d.is688:
+			m.GasResistance = physic.ElectricResistance(compensateGasHigh(gRaw, gRange) * float64(physic.Ohm))
+		default:
+			m.GasResistance = physic.ElectricResistance(d.calibration.compensateGas(gRaw, gRange) * float64(physic.Ohm))
+		}
+		m.GasValid = gLSB&gasValid != 0
+		m.HeatStable = gLSB&heatStable != 0
 	}
-
-	return nil
 }
 
 // Sense requests a one time measurement as °C, kPa and % of relative humidity.
 //
 // The very first measurements may be of poor quality.
 func (d *Dev) Sense(e *physic.Env) error {
+	m := Measurement{}
+	if err := d.Measure(&m); err != nil {
+		return err
+	}
+
+	*e = m.Env
+	return nil
+}
+
+// Measure requests a one time measurement including the gas resistance.
+//
+// The very first measurements may be of poor quality, and the gas sensor
+// needs several minutes of regular heating before its readings settle.
+func (d *Dev) Measure(m *Measurement) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	return d.measure(e)
+	return d.measure(m)
 }
 
 // SenseContinuous returns measurements as °C, kPa and % of relative humidity
@@ -396,53 +676,130 @@ func (d *Dev) Sense(e *physic.Env) error {
 // It's the responsibility of the caller to retrieve the values from the
 // channel as fast as possible, otherwise the interval may not be respected.
 func (d *Dev) SenseContinuous(interval time.Duration) (<-chan physic.Env, error) {
+	measurements, err := d.MeasureContinuous(interval)
+	if err != nil {
+		return nil, err
+	}
+
 	d.mu.Lock()
+	stop := d.stop
+	d.mu.Unlock()
+
+	sensing := make(chan physic.Env)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer close(sensing)
+		for m := range measurements {
+			select {
+			case sensing <- m.Env:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return sensing, nil
+}
+
+// MeasureContinuous is like SenseContinuous, but returns full measurements
+// including the gas resistance.
+//
+// If Opts.HeaterProfile is set, the BME688 is put into parallel mode instead.
+// interval is ignored then and every measurement is sent as soon as the
+// device produces it, once per heater step.
+//
+// The application must call Halt() to stop the sensing when done to stop the
+// sensor and close the channel.
+func (d *Dev) MeasureContinuous(interval time.Duration) (<-chan Measurement, error) {
+	// Don't send the stop command to the device.
+	for {
+		d.stopSensing()
+		d.mu.Lock()
+		if d.stop == nil {
+			break
+		}
+		// Someone else started sensing in the meantime
+		d.mu.Unlock()
+	}
 	defer d.mu.Unlock()
-	if d.stop != nil {
-		// Don't send the stop command to the device.
-		close(d.stop)
-		d.stop = nil
-		d.wg.Wait()
+
+	sensing := make(chan Measurement)
+
+	if d.isParallel() {
+		if err := d.startParallel(); err != nil {
+			return nil, d.formatError(err)
+		}
+
+		stop := make(chan struct{})
+		d.stop = stop
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			defer close(sensing)
+			d.sensingParallel(sensing, stop)
+		}()
+		return sensing, nil
 	}
 
 	// first time measurement
-	err := d.measure(&physic.Env{})
+	err := d.measure(&Measurement{})
 	if err != nil {
 		return nil, d.formatError(err)
 	}
 
-	sensing := make(chan physic.Env)
-	d.stop = make(chan struct{})
+	stop := make(chan struct{})
+	d.stop = stop
 	d.wg.Add(1)
 	go func() {
 		defer d.wg.Done()
 		defer close(sensing)
-		d.sensingContinuous(interval, sensing, d.stop)
+		d.sensingContinuous(interval, sensing, stop)
 	}()
 	return sensing, nil
 }
 
-func (d *Dev) sensingContinuous(interval time.Duration, sensing chan<- physic.Env, stop <-chan struct{}) {
+// stopSensing stops the sensing goroutines and waits for them, returning false if none were running.
+// The goroutines lock d.mu for every measurement, so it must not be held while waiting.
+func (d *Dev) stopSensing() bool {
+	d.mu.Lock()
+	stop := d.stop
+	d.stop = nil
+	d.mu.Unlock()
+
+	if stop == nil {
+		return false
+	}
+	close(stop)
+	d.wg.Wait()
+	return true
+}
+
+func (d *Dev) sensingContinuous(interval time.Duration, sensing chan<- Measurement, stop <-chan struct{}) {
 	t := time.NewTicker(interval)
 	defer t.Stop()
 
 	var err error
 	for {
-		e := physic.Env{}
+		m := Measurement{}
 
 		d.mu.Lock()
-		err = d.measure(&e)
+		err = d.measure(&m)
 		d.mu.Unlock()
 
-		if err != nil {
+		var timeout *TimeoutError
+		switch {
+		case errors.As(err, &timeout):
+			// A single late measurement isn't worth giving up over
+			log.Printf("%s: %v", d, err)
+		case err != nil:
 			log.Printf("%s: failed to sense: %v", d, err)
 			return
-		}
-
-		select {
-		case sensing <- e:
-		case <-stop:
-			return
+		default:
+			select {
+			case sensing <- m:
+			case <-stop:
+				return
+			}
 		}
 
 		select {
@@ -461,27 +818,28 @@ func (d *Dev) Precision(e *physic.Env) {}
 // It is recommended to call this function before terminating the process to
 // reduce idle power usage and a goroutine leak.
 func (d *Dev) Halt() error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	if d.stop == nil {
+	if !d.stopSensing() {
 		return nil
 	}
-	close(d.stop)
-	d.stop = nil
-	d.wg.Wait()
 
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	return d.writeCommands([]byte{
+		AddrCtrlGas0, heatOff,
 		AddrCtrlMeas, byte(d.opts.Temperature)<<5 | byte(d.opts.Pressure)<<2 | byte(sleep),
 	})
 }
 
 func (d *Dev) readRegister(reg uint8, b []byte) error {
 	if d.isSPI {
+		if err := d.selectPage(reg); err != nil {
+			return d.formatError(err)
+		}
 		// MSB is 0 for write and 1 for read.
 		read := make([]byte, len(b)+1)
 		write := make([]byte, len(read))
 		// Rest of the write buffer is ignored.
-		write[0] = reg
+		write[0] = reg | 0x80
 		if err := d.d.Tx(write, read); err != nil {
 			return d.formatError(err)
 		}
@@ -498,15 +856,72 @@ func (d *Dev) readRegister(reg uint8, b []byte) error {
 //
 // Warning: b may be modified!
 func (d *Dev) writeCommands(b []byte) error {
-	if d.isSPI {
-		// set RW bit 7 to 0.
-		for i := 0; i < len(b); i += 2 {
+	if !d.isSPI {
+		if err := d.d.Tx(b, nil); err != nil {
+			return d.formatError(err)
+		}
+		return nil
+	}
+
+	// Over SPI, consecutive register/value pairs on the same memory page are written together.
+	for start := 0; start < len(b); {
+		if err := d.selectPage(b[start]); err != nil {
+			return d.formatError(err)
+		}
+		end := start + 2
+		for end < len(b) && pageOf(b[end]) == pageOf(b[start]) {
+			end += 2
+		}
+
+		reset := false
+		for i := start; i < end; i += 2 {
+			reset = reset || (b[i] == AddrReset && b[i+1] == resetCmd)
+			// set RW bit 7 to 0.
 			b[i] &^= 0x80
 		}
+		if err := d.d.Tx(b[start:end], nil); err != nil {
+			return d.formatError(err)
+		}
+		if reset {
+			// A soft reset selects page 0 again
+			d.page, d.pageKnown = 0, true
+		}
+		start = end
 	}
-	if err := d.d.Tx(b, nil); err != nil {
-		return d.formatError(err)
+	return nil
+}
+
+// pageOf returns the SPI memory page reg is on.
+func pageOf(reg byte) byte {
+	if reg < 0x80 {
+		return spiMemPage
+	}
+	return 0
+}
+
+// selectPage switches to the SPI memory page reg is on, unless it's already selected.
+func (d *Dev) selectPage(reg byte) error {
+	if reg == AddrStatus {
+		return nil
+	}
+	page := pageOf(reg)
+	if d.pageKnown && d.page == page {
+		return nil
+	}
+
+	// The status register is readable from both pages, its other bits are left alone.
+	read, write := make([]byte, 2), []byte{AddrStatus | 0x80, 0}
+	if err := d.d.Tx(write, read); err != nil {
+		return err
+	}
+	if read[1]&spiMemPage == page {
+		d.page, d.pageKnown = page, true
+		return nil
+	}
+	if err := d.d.Tx([]byte{AddrStatus, read[1]&^spiMemPage | page}, nil); err != nil {
+		return err
 	}
+	d.page, d.pageKnown = page, true
 	return nil
 }
 
@@ -0,0 +1,646 @@
+package bme680_test
+
+import (
+	"ThermoServer/bme680"
+	"ThermoServer/bme680/bme680test"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"periph.io/x/conn/v3/physic"
+	"periph.io/x/conn/v3/spi"
+)
+
+// access is a register access as the emulated chip saw it, with the SPI memory page applied.
+type access struct {
+	write bool
+	reg   byte // the register addressed, as numbered over I²C
+	n     int  // number of registers read
+	value byte // value written
+}
+
+// spiRecorder sits between the driver and an emulator with SPI framing and records every access.
+type spiRecorder struct {
+	e *bme680test.Emulator
+
+	mu        sync.Mutex
+	accesses  []access
+	switches  int // status writes that changed the page
+	redundant int // status writes that didn't
+}
+
+func (r *spiRecorder) String() string                      { return "spiRecorder" }
+func (r *spiRecorder) Close() error                        { return nil }
+func (r *spiRecorder) LimitSpeed(f physic.Frequency) error { return nil }
+
+func (r *spiRecorder) Connect(f physic.Frequency, mode spi.Mode, bits int) (spi.Conn, error) {
+	c, err := r.e.Port().Connect(f, mode, bits)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingConn{Conn: c, r: r}, nil
+}
+
+type recordingConn struct {
+	spi.Conn
+	r *spiRecorder
+}
+
+func (c *recordingConn) Tx(w, r []byte) error {
+	c.r.record(w)
+	return c.Conn.Tx(w, r)
+}
+
+// record decodes a transfer the way the chip will, before it's sent.
+func (r *spiRecorder) record(w []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	page := r.e.Register(bme680.AddrStatus) & 0b10000
+	addressed := func(b byte) byte {
+		b &= 0x7F
+		if b == bme680.AddrStatus || page != 0 {
+			return b
+		}
+		return b | 0x80
+	}
+
+	if w[0]&0x80 != 0 {
+		r.accesses = append(r.accesses, access{reg: addressed(w[0]), n: len(w) - 1})
+		return
+	}
+	for i := 0; i+1 < len(w); i += 2 {
+		a := access{write: true, reg: addressed(w[i]), value: w[i+1]}
+		r.accesses = append(r.accesses, a)
+
+		switch {
+		case a.reg == bme680.AddrStatus && a.value&0b10000 == page:
+			r.redundant++
+		case a.reg == bme680.AddrStatus:
+			r.switches++
+			page = a.value & 0b10000
+		case a.reg == bme680.AddrReset && a.value == 0xB6:
+			page = 0
+		}
+	}
+}
+
+// take returns the accesses recorded since the last call and resets the counters.
+func (r *spiRecorder) take() (accesses []access, switches, redundant int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	accesses, switches, redundant = r.accesses, r.switches, r.redundant
+	r.accesses, r.switches, r.redundant = nil, 0, 0
+	return accesses, switches, redundant
+}
+
+// checkLanded fails the test if an access went to a register the driver never means to use,
+// which is where it ends up on the wrong memory page.
+func checkLanded(t *testing.T, accesses []access) {
+	t.Helper()
+
+	reads := map[byte]bool{
+		bme680.AddrVariant: true, bme680.AddrChipID: true, bme680.AddrStatus: true, bme680.AddrEasStatus0: true,
+		bme680.AddrCal1Start: true, bme680.AddrCal2Start: true, bme680.AddrCal3Start: true,
+	}
+	for _, a := range accesses {
+		switch {
+		case !a.write && !reads[a.reg]:
+			t.Errorf("read of %d registers at %#x", a.n, a.reg)
+		case a.write && a.reg == bme680.AddrReset && a.value != 0xB6:
+			t.Errorf("write of %#x to the reset register", a.value)
+		case a.write && a.reg != bme680.AddrReset && (a.reg < bme680.AddrResHeat0 || a.reg > bme680.AddrConfig):
+			t.Errorf("write of %#x to read-only register %#x", a.value, a.reg)
+		}
+	}
+}
+
+func newSPI(t *testing.T, variant byte, opts bme680.Opts) (*bme680test.Emulator, *spiRecorder, *bme680.Dev) {
+	t.Helper()
+
+	e := bme680test.NewSPI(variant)
+	r := &spiRecorder{e: e}
+	dev, err := bme680.NewSPI(r, opts)
+	if err != nil {
+		t.Fatalf("NewSPI: %v", err)
+	}
+	return e, r, dev
+}
+
+// checkEnv fails the test unless m is what the emulator was set to measure, within its ADC resolution.
+func checkEnv(t *testing.T, m bme680.Measurement, want bme680test.Env) {
+	t.Helper()
+
+	if got := m.Temperature.Celsius(); math.Abs(got-want.Temperature) > 0.01 {
+		t.Errorf("temperature = %.3f°C, want %.3f°C", got, want.Temperature)
+	}
+	if got := float64(m.Pressure) / float64(physic.Pascal); math.Abs(got-want.Pressure) > 1 {
+		t.Errorf("pressure = %.1f Pa, want %.1f Pa", got, want.Pressure)
+	}
+	if got := float64(m.Humidity) / float64(physic.PercentRH); math.Abs(got-want.Humidity) > 0.1 {
+		t.Errorf("humidity = %.2f%%, want %.2f%%", got, want.Humidity)
+	}
+}
+
+func TestSPIPages(t *testing.T) {
+	for _, variant := range []byte{bme680.Variant680, bme680.Variant688} {
+		e, r, dev := newSPI(t, variant, bme680.DefaultOpts)
+
+		// Calibration data is split across both pages
+		accesses, _, redundant := r.take()
+		for _, want := range []access{
+			{reg: bme680.AddrChipID, n: 1},
+			{reg: bme680.AddrVariant, n: 1},
+			{reg: bme680.AddrCal1Start, n: int(bme680.AddrCal1End-bme680.AddrCal1Start) + 1},
+			{reg: bme680.AddrCal2Start, n: int(bme680.AddrCal2End-bme680.AddrCal2Start) + 1},
+			{reg: bme680.AddrCal3Start, n: int(bme680.AddrCal3End-bme680.AddrCal3Start) + 1},
+		} {
+			found := false
+			for _, a := range accesses {
+				found = found || a == want
+			}
+			if !found {
+				t.Errorf("%s: no read of %d registers at %#x", dev, want.n, want.reg)
+			}
+		}
+		checkLanded(t, accesses)
+		if redundant != 0 {
+			t.Errorf("%s: %d page writes selected the page that was already selected", dev, redundant)
+		}
+
+		env := bme680test.Env{Temperature: 23.5, Pressure: 98000, Humidity: 55, GasResistance: 50000}
+		e.SetEnv(env)
+		var m bme680.Measurement
+		if err := dev.Measure(&m); err != nil {
+			t.Fatalf("%s: Measure: %v", dev, err)
+		}
+		checkEnv(t, m, env)
+
+		accesses, _, _ = r.take()
+		checkLanded(t, accesses)
+
+		// The control registers 0x70 to 0x75 are on page 1
+		opts := bme680.DefaultOpts
+		if got, want := e.Register(bme680.AddrCtrlHum), byte(opts.Humidity); got != want {
+			t.Errorf("%s: ctrl_hum = %#x, want %#x", dev, got, want)
+		}
+		if got, want := e.Register(bme680.AddrCtrlMeas)>>2, byte(opts.Temperature)<<3|byte(opts.Pressure); got != want {
+			t.Errorf("%s: ctrl_meas oversampling = %#x, want %#x", dev, got, want)
+		}
+		if got, want := e.Register(bme680.AddrConfig), byte(opts.Filter)<<2; got != want {
+			t.Errorf("%s: config = %#x, want %#x", dev, got, want)
+		}
+		if e.Register(bme680.AddrCtrlGas1)&0b110000 == 0 {
+			t.Errorf("%s: ctrl_gas_1 = %#x, want run_gas set", dev, e.Register(bme680.AddrCtrlGas1))
+		}
+		if !m.GasValid {
+			t.Errorf("%s: gas measurement isn't valid", dev)
+		}
+	}
+}
+
+func TestSPIPageCache(t *testing.T) {
+	_, r, dev := newSPI(t, bme680.Variant680, bme680.DefaultOpts)
+	r.take()
+
+	// Measurements only use page 1, which initialization ended on
+	for i := 0; i < 3; i++ {
+		if err := dev.Measure(&bme680.Measurement{}); err != nil {
+			t.Fatalf("Measure: %v", err)
+		}
+	}
+	accesses, switches, redundant := r.take()
+	checkLanded(t, accesses)
+	if switches != 0 || redundant != 0 {
+		t.Errorf("measurements wrote the page %d times, want 0", switches+redundant)
+	}
+	for _, a := range accesses {
+		if !a.write && a.reg == bme680.AddrStatus {
+			t.Errorf("measurements read the status register, but the page is known")
+		}
+	}
+}
+
+func TestSPIPageAfterReset(t *testing.T) {
+	e, r, dev := newSPI(t, bme680.Variant680, bme680.DefaultOpts)
+	if err := dev.Measure(&bme680.Measurement{}); err != nil {
+		t.Fatalf("Measure: %v", err)
+	}
+	r.take()
+
+	// The reset is written on page 0, the chip is on page 0 afterwards, then the calibration is read
+	// from both pages and initialization ends on page 1 again.
+	if err := dev.Reset(); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	accesses, switches, redundant := r.take()
+	checkLanded(t, accesses)
+	if redundant != 0 {
+		t.Errorf("reset: %d page writes selected the page that was already selected", redundant)
+	}
+	if switches != 2 {
+		t.Errorf("reset: page switched %d times, want 2 (to 0 for the reset, to 1 for cal3 and the configuration)", switches)
+	}
+	if page := e.Register(bme680.AddrStatus) & 0b10000; page == 0 {
+		t.Errorf("after reset: chip is on page 0, want page 1")
+	}
+
+	env := bme680test.Env{Temperature: 18, Pressure: 102000, Humidity: 35, GasResistance: 80000}
+	e.SetEnv(env)
+	var m bme680.Measurement
+	if err := dev.Measure(&m); err != nil {
+		t.Fatalf("Measure after reset: %v", err)
+	}
+	checkEnv(t, m, env)
+
+	accesses, switches, redundant = r.take()
+	checkLanded(t, accesses)
+	if switches != 0 || redundant != 0 {
+		t.Errorf("measurement after reset wrote the page %d times, want 0", switches+redundant)
+	}
+}
+
+func newI2C(t *testing.T, variant byte, opts bme680.Opts) (*bme680test.Emulator, *bme680.Dev) {
+	t.Helper()
+
+	e := bme680test.New(variant)
+	dev, err := bme680.NewI2C(e.Bus(), e.Addr, opts)
+	if err != nil {
+		t.Fatalf("NewI2C: %v", err)
+	}
+	return e, dev
+}
+
+// quickOpts make measurements take as little time as possible.
+var quickOpts = bme680.Opts{Temperature: bme680.O1x, Pressure: bme680.O1x, Humidity: bme680.O1x}
+
+// forcedDuration is how long a forced mode measurement takes as per the datasheet.
+func forcedDuration(opts bme680.Opts) time.Duration {
+	cycles := 0
+	for _, o := range []bme680.Oversampling{opts.Temperature, opts.Pressure, opts.Humidity} {
+		if o != bme680.Off {
+			cycles += 1 << (o - 1)
+		}
+	}
+
+	dur := time.Duration(cycles)*1963*time.Microsecond + 9*477*time.Microsecond + time.Millisecond
+	if opts.HeaterTemp != 0 {
+		dur += opts.HeaterDuration
+	}
+	return dur
+}
+
+func TestNewI2C(t *testing.T) {
+	for variant, name := range map[byte]string{bme680.Variant680: "BME680", bme680.Variant688: "BME688"} {
+		e, dev := newI2C(t, variant, bme680.DefaultOpts)
+		if dev.Name() != name {
+			t.Errorf("Name() = %q, want %q", dev.Name(), name)
+		}
+
+		env := bme680test.Env{Temperature: 25.5, Pressure: 100500, Humidity: 60, GasResistance: 120000}
+		e.SetEnv(env)
+		var m bme680.Measurement
+		if err := dev.Measure(&m); err != nil {
+			t.Fatalf("%s: Measure: %v", name, err)
+		}
+		checkEnv(t, m, env)
+		if !m.GasValid || !m.HeatStable {
+			t.Errorf("%s: gas valid %t, heat stable %t, want both", name, m.GasValid, m.HeatStable)
+		}
+		if got := float64(m.GasResistance) / float64(physic.Ohm); math.Abs(got-env.GasResistance)/env.GasResistance > 0.01 {
+			t.Errorf("%s: gas resistance = %.0f Ω, want %.0f Ω", name, got, env.GasResistance)
+		}
+	}
+
+	e := bme680test.New(bme680.Variant680)
+	if _, err := bme680.NewI2C(e.Bus(), 0x77, bme680.DefaultOpts); err == nil {
+		t.Errorf("NewI2C at an address without a sensor succeeded")
+	}
+}
+
+func TestMeasureTiming(t *testing.T) {
+	for _, opts := range []bme680.Opts{
+		bme680.DefaultOpts,
+		quickOpts,
+		{Temperature: bme680.O16x, Pressure: bme680.O16x, Humidity: bme680.O16x, HeaterTemp: 300, HeaterDuration: 20 * time.Millisecond},
+	} {
+		e, dev := newI2C(t, bme680.Variant680, opts)
+
+		want := forcedDuration(opts)
+		start := time.Now()
+		if err := dev.Measure(&bme680.Measurement{}); err != nil {
+			t.Fatalf("Measure: %v", err)
+		}
+		elapsed := time.Since(start)
+
+		// The emulator is done right away, so the driver shouldn't wait for more than the datasheet says
+		if elapsed < want || elapsed > want+25*time.Millisecond {
+			t.Errorf("%+v: Measure took %s, want %s", opts, elapsed, want)
+		}
+		if n := e.Measurements(); n != 1 {
+			t.Errorf("%+v: %d measurements taken, want 1", opts, n)
+		}
+	}
+}
+
+func TestMeasureTimeout(t *testing.T) {
+	e, dev := newI2C(t, bme680.Variant680, quickOpts)
+
+	e.SetStalled(true)
+	start := time.Now()
+	err := dev.Measure(&bme680.Measurement{})
+	elapsed := time.Since(start)
+
+	var timeout *bme680.TimeoutError
+	if !errors.As(err, &timeout) {
+		t.Fatalf("Measure on a stalled sensor returned %v, want a TimeoutError", err)
+	}
+	if !timeout.Timeout() || timeout.Device != "BME680" {
+		t.Errorf("TimeoutError = %+v", timeout)
+	}
+	if timeout.Waited <= forcedDuration(quickOpts) || elapsed < timeout.Waited {
+		t.Errorf("waited %s (%s reported) for a measurement that takes %s", elapsed, timeout.Waited, forcedDuration(quickOpts))
+	}
+
+	// The sensor works again once it's unstuck
+	e.SetStalled(false)
+	if err := dev.Measure(&bme680.Measurement{}); err != nil {
+		t.Errorf("Measure after the stall: %v", err)
+	}
+}
+
+// await fails the test if f fails or doesn't return in time, as it does when deadlocked.
+func await(t *testing.T, name string, f func() error) {
+	t.Helper()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s didn't return", name)
+	}
+}
+
+func TestSenseContinuousHalt(t *testing.T) {
+	e, dev := newI2C(t, bme680.Variant680, quickOpts)
+	env := bme680test.Env{Temperature: 19, Pressure: 99000, Humidity: 40, GasResistance: 100000}
+	e.SetEnv(env)
+
+	sensing, err := dev.SenseContinuous(5 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("SenseContinuous: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case got := <-sensing:
+			checkEnv(t, bme680.Measurement{Env: got}, env)
+		case <-time.After(time.Second):
+			t.Fatalf("no measurement %d", i+1)
+		}
+	}
+
+	await(t, "Halt", dev.Halt)
+
+	// The channel is closed, possibly after one last measurement
+	timeout := time.After(time.Second)
+	for open := true; open; {
+		select {
+		case _, open = <-sensing:
+		case <-timeout:
+			t.Fatalf("channel wasn't closed by Halt")
+		}
+	}
+
+	if mode := e.Register(bme680.AddrCtrlMeas) & 0b11; mode != 0 {
+		t.Errorf("mode = %d after Halt, want sleep", mode)
+	}
+	if heater := e.Register(bme680.AddrCtrlGas0); heater&0b1000 == 0 {
+		t.Errorf("ctrl_gas_0 = %#x after Halt, want the heater off", heater)
+	}
+	n := e.Measurements()
+	time.Sleep(50 * time.Millisecond)
+	if e.Measurements() != n {
+		t.Errorf("measurements continued after Halt")
+	}
+
+	// Halting again is fine
+	await(t, "Halt", dev.Halt)
+}
+
+// TestHaltWhileLocked halts while the sensing goroutine waits for the device lock, which another
+// measurement holds, so Halt may get the lock before the goroutine does.
+func TestHaltWhileLocked(t *testing.T) {
+	_, dev := newI2C(t, bme680.Variant680, quickOpts)
+
+	for i := 0; i < 20; i++ {
+		sensing, err := dev.MeasureContinuous(time.Millisecond)
+		if err != nil {
+			t.Fatalf("MeasureContinuous: %v", err)
+		}
+		go func() {
+			for range sensing {
+			}
+		}()
+
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := dev.Measure(&bme680.Measurement{}); err != nil {
+					t.Errorf("Measure: %v", err)
+					return
+				}
+			}
+		}()
+
+		time.Sleep(20 * time.Millisecond)
+		if i%2 == 1 {
+			// Restarting stops the running goroutine the same way
+			await(t, "MeasureContinuous while sensing", func() error {
+				sensing, err := dev.MeasureContinuous(time.Millisecond)
+				go func() {
+					for range sensing {
+					}
+				}()
+				return err
+			})
+			time.Sleep(10 * time.Millisecond)
+		}
+		await(t, "Halt", dev.Halt)
+
+		close(stop)
+		wg.Wait()
+	}
+}
+
+func TestParallelProfile(t *testing.T) {
+	opts := quickOpts
+	opts.HeaterProfile = []bme680.HeaterStep{{Temp: 200, Cycles: 2}, {Temp: 300, Cycles: 3}, {Temp: 350, Cycles: 1}}
+	opts.ProfileCycle = 50 * time.Millisecond
+
+	e := bme680test.New(bme680.Variant680)
+	if _, err := bme680.NewI2C(e.Bus(), e.Addr, opts); err == nil {
+		t.Errorf("NewI2C with a heater profile on a BME680 succeeded")
+	}
+
+	e, dev := newI2C(t, bme680.Variant688, opts)
+	if err := e.Step(); err == nil {
+		t.Errorf("Step succeeded outside of parallel mode")
+	}
+	env := bme680test.Env{Temperature: 22, Pressure: 100000, Humidity: 50, GasResistance: 75000}
+	e.SetEnv(env)
+
+	sensing, err := dev.MeasureContinuous(time.Second)
+	if err != nil {
+		t.Fatalf("MeasureContinuous: %v", err)
+	}
+	defer await(t, "Halt", dev.Halt)
+
+	// One heater step per profile step, hotter ones need more resistance
+	var lastResHeat byte
+	for i, step := range opts.HeaterProfile {
+		resHeat := e.Register(bme680.AddrResHeat0 + byte(i))
+		if resHeat <= lastResHeat {
+			t.Errorf("res_heat_%d = %d for %d°C, want more than %d", i, resHeat, step.Temp, lastResHeat)
+		}
+		lastResHeat = resHeat
+		if got := e.Register(bme680.AddrGasWait0 + byte(i)); got != step.Cycles {
+			t.Errorf("gas_wait_%d = %d, want %d", i, got, step.Cycles)
+		}
+	}
+	// 50ms less 10.2ms of TPH measurement is 83 steps of 0.477ms, or 20 times 4
+	if got := e.Register(bme680.AddrShdHeatrDur); got != 1<<6|20 {
+		t.Errorf("shd_heatr_dur = %#x, want %#x", got, 1<<6|20)
+	}
+	if got := e.Register(bme680.AddrCtrlGas1); got&0b111111 != 0b100000|3 {
+		t.Errorf("ctrl_gas_1 = %#x, want run_gas and 3 heater steps", got)
+	}
+	if heater := e.Register(bme680.AddrCtrlGas0); heater&0b1000 != 0 {
+		t.Errorf("ctrl_gas_0 = %#x, want the heater on", heater)
+	}
+	if mode := e.Register(bme680.AddrCtrlMeas) & 0b11; mode != 2 {
+		t.Errorf("mode = %d, want parallel", mode)
+	}
+
+	// The emulator fills the three fields in turn. Starting with two measurements makes the next batch wrap
+	// around, so field 0 holds a newer measurement than field 2.
+	var next uint8
+	for _, steps := range []int{2, 3, 3} {
+		for i := 0; i < steps; i++ {
+			if err := e.Step(); err != nil {
+				t.Fatalf("Step: %v", err)
+			}
+		}
+		for i := 0; i < steps; i++ {
+			select {
+			case m := <-sensing:
+				if m.MeasIndex != next {
+					t.Fatalf("measurement %d has index %d", next, m.MeasIndex)
+				}
+				if want := next % 3; m.GasIndex != want {
+					t.Errorf("measurement %d is of heater step %d, want %d", next, m.GasIndex, want)
+				}
+				if !m.GasValid || !m.HeatStable {
+					t.Errorf("measurement %d: gas valid %t, heat stable %t, want both", next, m.GasValid, m.HeatStable)
+				}
+				checkEnv(t, m, env)
+				next++
+			case <-time.After(time.Second):
+				t.Fatalf("no measurement %d", next)
+			}
+		}
+	}
+
+	// Fields that were already read are not read again
+	select {
+	case m := <-sensing:
+		t.Errorf("measurement %d was read again", m.MeasIndex)
+	case <-time.After(3 * opts.ProfileCycle):
+	}
+}
+
+func TestMeasureInt(t *testing.T) {
+	// Raw values and what Bosch's integer API makes of them with the emulator's default calibration,
+	// from the corpus in calibration_test.go
+	cases := []struct {
+		adc bme680test.ADC
+
+		temp     int16  // 1/100 °C
+		pressure uint32 // Pa
+		humidity uint32 // 1/1000 %RH
+		gas680   uint32 // Ω
+		gas688   uint32 // Ω
+	}{
+		{bme680test.ADC{Temperature: 380000, Pressure: 260000, Humidity: 17000, Gas: 0, GasRange: 0}, -1093, 107965, 18854, 12946860, 102400000},
+		{bme680test.ADC{Temperature: 460000, Pressure: 300000, Humidity: 21000, Gas: 512, GasRange: 4}, 1412, 105815, 41580, 499500, 4000000},
+		{bme680test.ADC{Temperature: 505000, Pressure: 330000, Humidity: 24000, Gas: 300, GasRange: 7}, 2822, 105138, 62037, 74959, 591900},
+		{bme680test.ADC{Temperature: 540000, Pressure: 360000, Humidity: 26000, Gas: 1023, GasRange: 15}, 3919, 101702, 77790, 177, 1400},
+		{bme680test.ADC{Temperature: 600000, Pressure: 420000, Humidity: 30000, Gas: 700, GasRange: 10}, 5799, 93852, 100000, 6850, 54900},
+		{bme680test.ADC{Temperature: 430000, Pressure: 380000, Humidity: 19500, Gas: 150, GasRange: 5}, 473, 92850, 32349, 341431, 2721500},
+	}
+
+	for _, variant := range []byte{bme680.Variant680, bme680.Variant688} {
+		opts := quickOpts
+		opts.IntegerCompensation = true
+		opts.HeaterTemp, opts.HeaterDuration = 200, 5*time.Millisecond
+		e, dev := newI2C(t, variant, opts)
+
+		for i, c := range cases {
+			e.SetADC(c.adc)
+			var m bme680.Measurement
+			if err := dev.Measure(&m); err != nil {
+				t.Fatalf("%s: Measure: %v", dev.Name(), err)
+			}
+
+			if want := physic.Temperature(c.temp)*10*physic.MilliKelvin + physic.ZeroCelsius; m.Temperature != want {
+				t.Errorf("%s: case %d: temperature = %s, want %s", dev.Name(), i, m.Temperature, want)
+			}
+			if want := physic.Pressure(c.pressure) * physic.Pascal; m.Pressure != want {
+				t.Errorf("%s: case %d: pressure = %s, want %s", dev.Name(), i, m.Pressure, want)
+			}
+			if want := physic.RelativeHumidity(c.humidity) * (physic.PercentRH / 1000); m.Humidity != want {
+				t.Errorf("%s: case %d: humidity = %s, want %s", dev.Name(), i, m.Humidity, want)
+			}
+			want := physic.ElectricResistance(c.gas680) * physic.Ohm
+			if variant == bme680.Variant688 {
+				want = physic.ElectricResistance(c.gas688) * physic.Ohm
+			}
+			if m.GasResistance != want {
+				t.Errorf("%s: case %d: gas resistance = %s, want %s", dev.Name(), i, m.GasResistance, want)
+			}
+
+			// The heater resistance is computed for the temperature the last measurement read, which
+			// starts out as 25°C
+			switch i {
+			case 0:
+				if got := e.Register(bme680.AddrResHeat0); got != 82 {
+					t.Errorf("%s: res_heat_0 = %d for 200°C at 25°C, want 82", dev.Name(), got)
+				}
+				opts.HeaterTemp = 400
+				if err := dev.SetOpts(opts); err != nil {
+					t.Fatalf("%s: SetOpts: %v", dev.Name(), err)
+				}
+			case 1:
+				if got := e.Register(bme680.AddrResHeat0); got != 132 {
+					t.Errorf("%s: res_heat_0 = %d for 400°C at -10°C, want 132", dev.Name(), got)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package bme680test
+
+// The compensation formulas of Bosch's BME68x API (floating point version),
+// which the emulator inverts to produce raw ADC values.
+
+// temperature returns the temperature in °C and t_fine.
+func (c Calibration) temperature(adc uint32) (temp, tFine float64) {
+	x := float64(adc)
+	var1 := (x/16384 - float64(c.T1)/1024) * float64(c.T2)
+	var2 := (x/131072 - float64(c.T1)/8192) * (x/131072 - float64(c.T1)/8192) * (float64(c.T3) * 16)
+	tFine = var1 + var2
+	return tFine / 5120, tFine
+}
+
+// pressure returns the pressure in Pa.
+func (c Calibration) pressure(adc uint32, tFine float64) float64 {
+	var1 := tFine/2 - 64000
+	var2 := var1 * var1 * (float64(c.P6) / 131072)
+	var2 = var2 + var1*float64(c.P5)*2
+	var2 = var2/4 + float64(c.P4)*65536
+	var1 = (float64(c.P3)*var1*var1/16384 + float64(c.P2)*var1) / 524288
+	var1 = (1 + var1/32768) * float64(c.P1)
+	if var1 == 0 {
+		return 0
+	}
+
+	p := 1048576 - float64(adc)
+	p = (p - var2/4096) * 6250 / var1
+	var1 = float64(c.P9) * p * p / 2147483648
+	var2 = p * (float64(c.P8) / 32768)
+	var3 := (p / 256) * (p / 256) * (p / 256) * (float64(c.P10) / 131072)
+	return p + (var1+var2+var3+float64(c.P7)*128)/16
+}
+
+// humidity returns the relative humidity in %, without clamping it to 0–100%
+// so it stays monotonic for inverting.
+func (c Calibration) humidity(adc uint32, tFine float64) float64 {
+	temp := tFine / 5120
+	var1 := float64(adc) - (float64(c.H1)*16 + float64(c.H3)/2*temp)
+	var2 := var1 * (float64(c.H2) / 262144 * (1 + float64(c.H4)/16384*temp + float64(c.H5)/1048576*temp*temp))
+	var3 := float64(c.H6) / 16384
+	var4 := float64(c.H7) / 2097152
+	return var2 + (var3+var4*temp)*var2*var2
+}
+
+var (
+	gasRangeK1 = [16]float64{0, 0, 0, 0, 0, -1, 0, -0.8, 0, 0, -0.2, -0.5, 0, -1, 0, 0}
+	gasRangeK2 = [16]float64{0, 0, 0, 0, 0.1, 0.7, 0, -0.8, -0.1, 0, 0, 0, 0, 0, 0, 0}
+)
+
+// gas returns the BME680's gas resistance in Ω.
+func (c Calibration) gas(adc uint32, gasRange byte) float64 {
+	var1 := 1340 + 5*float64(c.RangeSwErr)
+	var2 := var1 * (1 + gasRangeK1[gasRange]/100)
+	var3 := 1 + gasRangeK2[gasRange]/100
+	return 1 / (var3 * 0.000000125 * float64(uint32(1)<<gasRange) * ((float64(adc)-512)/var2 + 1))
+}
+
+// gasHigh returns the BME688's gas resistance in Ω.
+func gasHigh(adc uint32, gasRange byte) float64 {
+	var1 := float64(uint32(262144) >> gasRange)
+	var2 := 4096 + (float64(adc)-512)*3
+	return 1000000 * var1 / var2
+}
@@ -0,0 +1,553 @@
+// Package bme680test is meant to be used to test the bme680 driver without a sensor.
+//
+// Its Emulator holds the BME680's register map and answers register reads and
+// writes the way the chip does. Forced mode measurements produce raw ADC values
+// that compensate to the environment given with SetEnv, or those given with SetADC.
+package bme680test
+
+import (
+	"ThermoServer/bme680"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"periph.io/x/conn/v3"
+	"periph.io/x/conn/v3/i2c"
+	"periph.io/x/conn/v3/physic"
+	"periph.io/x/conn/v3/spi"
+)
+
+// registers the emulator handles that the bme680 package doesn't name
+const (
+	addrStatus byte = 0x73 // SPI memory page select, readable from both pages
+	spiMemPage byte = 0b10000
+	resetValue byte = 0xB6
+
+	// The BME688 has three field data blocks back to back
+	fieldCount  = 3
+	fieldStride = 0x11
+
+	newData byte = 0b10000000 // bit of the meas_status_x registers
+)
+
+// Calibration is the set of calibration parameters burned into a sensor, named as in Bosch's API.
+type Calibration struct {
+	T1 uint16
+	T2 int16
+	T3 int8
+
+	P1     uint16
+	P2     int16
+	P3     int8
+	P4, P5 int16
+	P6, P7 int8
+	P8, P9 int16
+	P10    uint8
+
+	H1, H2     uint16 // 12 bits each
+	H3, H4, H5 int8
+	H6         uint8
+	H7         int8
+
+	GH1 int8
+	GH2 int16
+	GH3 int8
+
+	ResHeatVal   int8
+	ResHeatRange uint8 // 2 bits
+	RangeSwErr   int8  // 4 bits, signed
+}
+
+// DefaultCalibration is the calibration of a real BME680.
+var DefaultCalibration = Calibration{
+	T1: 25932, T2: 26275, T3: 3,
+	P1: 36383, P2: -10461, P3: 88, P4: 6775, P5: -80, P6: 30, P7: 29, P8: -2376, P9: -3001, P10: 30,
+	H1: 784, H2: 1009, H3: 0, H4: 45, H5: 20, H6: 120, H7: -100,
+	GH1: -30, GH2: -12857, GH3: 18,
+	ResHeatVal: 49, ResHeatRange: 1, RangeSwErr: 0,
+}
+
+// Env is the environment the emulated sensor measures.
+type Env struct {
+	Temperature   float64 // °C
+	Pressure      float64 // Pa
+	Humidity      float64 // %RH
+	GasResistance float64 // Ω
+}
+
+// ADC is a set of raw values as the chip stores them in a field data block.
+type ADC struct {
+	Temperature uint32 // 20 bits
+	Pressure    uint32 // 20 bits
+	Humidity    uint16
+	Gas         uint16 // 10 bits
+	GasRange    uint8  // 4 bits
+}
+
+// Emulator is an in-memory BME680 or BME688.
+//
+// It implements conn.Conn with either I²C or SPI framing, depending on how it was created.
+// Measurements complete instantly, and in parallel mode, a new one is only taken when Step is called,
+// so tests behave the same on every run.
+type Emulator struct {
+	// Addr is the I²C address the emulator responds to on Bus. It defaults to 0x76.
+	Addr uint16
+
+	mu        sync.Mutex
+	spi       bool
+	variant   byte
+	regs      [256]byte
+	cal       Calibration
+	env       Env
+	adc       *ADC // raw values measurements produce instead of env's, if set
+	measIndex uint8
+	field     int // next field written in parallel mode
+	count     int
+	stalled   bool
+}
+
+// New returns an emulator with I²C framing. variant is bme680.Variant680 or bme680.Variant688.
+func New(variant byte) *Emulator {
+	e := &Emulator{Addr: 0x76, variant: variant}
+	e.reset()
+	e.SetCalibration(DefaultCalibration)
+	e.SetEnv(Env{Temperature: 21, Pressure: 101325, Humidity: 45, GasResistance: 100000})
+	return e
+}
+
+// NewSPI returns an emulator with SPI framing, including the memory pages of the register map.
+func NewSPI(variant byte) *Emulator {
+	e := New(variant)
+	e.spi = true
+	return e
+}
+
+// reset puts all registers except calibration and IDs back into their power-on state.
+func (e *Emulator) reset() {
+	for addr := 0x1D; addr <= 0x75; addr++ {
+		e.regs[addr] = 0
+	}
+	e.regs[bme680.AddrChipID] = bme680.ChipID680
+	e.regs[bme680.AddrVariant] = e.variant
+	e.regs[addrStatus] = 0 // page 0
+	for i := 0; i < fieldCount; i++ {
+		e.writeADC(i, 0x80000, 0x80000, 0x8000)
+	}
+	e.field = 0
+}
+
+// SetCalibration writes c into the calibration registers in the chip's layout.
+func (e *Emulator) SetCalibration(c Calibration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.cal = c
+	cd1 := e.regs[bme680.AddrCal1Start : bme680.AddrCal1End+1]
+	cd2 := e.regs[bme680.AddrCal2Start : bme680.AddrCal2End+1]
+	cd3 := e.regs[bme680.AddrCal3Start : bme680.AddrCal3End+1]
+
+	putUint16 := func(b []byte, v uint16) {
+		b[0], b[1] = byte(v), byte(v>>8)
+	}
+
+	cd1[0] = byte(c.H2 >> 4)
+	cd1[1] = byte(c.H2&0x0F)<<4 | byte(c.H1&0x0F)
+	cd1[2] = byte(c.H1 >> 4)
+	cd1[3] = byte(c.H3)
+	cd1[4] = byte(c.H4)
+	cd1[5] = byte(c.H5)
+	cd1[6] = c.H6
+	cd1[7] = byte(c.H7)
+	putUint16(cd1[8:], c.T1)
+	putUint16(cd1[10:], uint16(c.GH2))
+	cd1[12] = byte(c.GH1)
+	cd1[13] = byte(c.GH3)
+
+	putUint16(cd2[0:], uint16(c.T2))
+	cd2[2] = byte(c.T3)
+	putUint16(cd2[4:], c.P1)
+	putUint16(cd2[6:], uint16(c.P2))
+	cd2[8] = byte(c.P3)
+	putUint16(cd2[10:], uint16(c.P4))
+	putUint16(cd2[12:], uint16(c.P5))
+	cd2[14] = byte(c.P7)
+	cd2[15] = byte(c.P6)
+	putUint16(cd2[18:], uint16(c.P8))
+	putUint16(cd2[20:], uint16(c.P9))
+	cd2[22] = c.P10
+
+	cd3[0] = byte(c.ResHeatVal)
+	cd3[2] = (c.ResHeatRange & 0b11) << 4
+	cd3[4] = byte(c.RangeSwErr) << 4
+}
+
+// SetEnv sets the environment the next measurements compensate to.
+func (e *Emulator) SetEnv(env Env) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.env = env
+	e.adc = nil
+}
+
+// SetADC makes the next measurements produce adc, rather than the raw values of the environment,
+// until SetEnv is called. It's meant for checking the compensation against known raw values.
+func (e *Emulator) SetADC(adc ADC) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.adc = &adc
+}
+
+// SetStalled makes measurements started from now on never finish, like on a hung sensor:
+// new_data stays cleared and the data registers keep their values.
+func (e *Emulator) SetStalled(stalled bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stalled = stalled
+}
+
+// Register returns the value of a register, as addressed over I²C.
+func (e *Emulator) Register(addr byte) byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.regs[addr]
+}
+
+// Measurements returns the number of measurements taken so far.
+func (e *Emulator) Measurements() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.count
+}
+
+// Step takes the next measurement of a BME688 in parallel mode.
+// It returns an error if the sensor isn't in parallel mode.
+func (e *Emulator) Step() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.regs[bme680.AddrCtrlMeas]&0b11 != 2 {
+		return errors.New("bme680test: not in parallel mode")
+	}
+	if e.stalled {
+		return nil
+	}
+
+	steps := e.regs[bme680.AddrCtrlGas1] & 0x0F
+	if steps == 0 {
+		steps = 1
+	}
+	e.measure(e.field, e.measIndex%steps)
+	e.field = (e.field + 1) % fieldCount
+	return nil
+}
+
+func (e *Emulator) String() string {
+	if e.spi {
+		return "bme680test.Emulator(SPI)"
+	}
+	return fmt.Sprintf("bme680test.Emulator(I²C %#x)", e.Addr)
+}
+
+// Duplex implements conn.Conn.
+func (e *Emulator) Duplex() conn.Duplex {
+	if e.spi {
+		return conn.Full
+	}
+	return conn.Half
+}
+
+// Tx implements conn.Conn.
+//
+// With I²C framing, a single-byte w selects the register r is read from. Longer ones are register/value pairs
+// to write. With SPI framing, w and r have the same length, and bit 7 of the first byte selects between a
+// read (1) and writing register/value pairs (0).
+func (e *Emulator) Tx(w, r []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.spi {
+		return e.txSPI(w, r)
+	}
+	return e.txI2C(w, r)
+}
+
+func (e *Emulator) txI2C(w, r []byte) error {
+	if len(r) > 0 {
+		if len(w) != 1 {
+			return fmt.Errorf("bme680test: read needs exactly one register address, got %d bytes", len(w))
+		}
+		for i := range r {
+			r[i] = e.regs[(int(w[0])+i)&0xFF]
+		}
+		return nil
+	}
+
+	if len(w)%2 != 0 {
+		return errors.New("bme680test: writes must be register/value pairs")
+	}
+	for i := 0; i < len(w); i += 2 {
+		e.write(w[i], w[i+1])
+	}
+	return nil
+}
+
+func (e *Emulator) txSPI(w, r []byte) error {
+	if len(w) == 0 {
+		return nil
+	}
+	if len(r) != 0 && len(r) != len(w) {
+		return errors.New("bme680test: SPI transfers are full duplex, w and r must have the same length")
+	}
+
+	if w[0]&0x80 != 0 {
+		if len(r) == 0 {
+			return errors.New("bme680test: SPI read without a read buffer")
+		}
+		r[0] = 0xFF
+		for i := 1; i < len(r); i++ {
+			r[i] = e.regs[e.spiAddr(w[0]+byte(i-1))]
+		}
+		return nil
+	}
+
+	if len(w)%2 != 0 {
+		return errors.New("bme680test: writes must be register/value pairs")
+	}
+	for i := 0; i < len(w); i += 2 {
+		if w[i]&0x80 != 0 {
+			return fmt.Errorf("bme680test: SPI write to %#x has the read bit set", w[i])
+		}
+		e.write(e.spiAddr(w[i]), w[i+1])
+	}
+	return nil
+}
+
+// spiAddr maps a 7 bit SPI address to the register it addresses on the current memory page.
+// Page 0 holds 0x80 to 0xFF, page 1 holds 0x00 to 0x7F. The status register is on both.
+func (e *Emulator) spiAddr(addr byte) byte {
+	addr &= 0x7F
+	if addr == addrStatus || e.regs[addrStatus]&spiMemPage != 0 {
+		return addr
+	}
+	return addr | 0x80
+}
+
+// write handles a register write the way the chip does.
+func (e *Emulator) write(addr, value byte) {
+	switch {
+	case addr == bme680.AddrReset:
+		if value == resetValue {
+			e.reset()
+		}
+	case addr == addrStatus:
+		if e.spi {
+			e.regs[addrStatus] = value & spiMemPage
+		}
+	case addr >= bme680.AddrIdacHeat0 && addr <= bme680.AddrConfig:
+		e.regs[addr] = value
+		if addr == bme680.AddrCtrlMeas {
+			e.startMode()
+		}
+	default:
+		// everything else is read-only
+	}
+}
+
+// startMode reacts to the mode bits of ctrl_meas.
+func (e *Emulator) startMode() {
+	switch e.regs[bme680.AddrCtrlMeas] & 0b11 {
+	case 1: // forced
+		e.regs[bme680.AddrEasStatus0] &^= newData
+		if e.stalled {
+			return
+		}
+		e.measure(0, e.regs[bme680.AddrCtrlGas1]&0x0F)
+		e.regs[bme680.AddrCtrlMeas] &^= 0b11 // back to sleep
+	case 2: // parallel
+		if e.variant != bme680.Variant688 {
+			e.regs[bme680.AddrCtrlMeas] &^= 0b11
+			return
+		}
+		e.field = 0
+	}
+}
+
+// measure fills field with a measurement of the environment using heater step gasIndex.
+func (e *Emulator) measure(field int, gasIndex byte) {
+	e.count++
+
+	osrsT := e.regs[bme680.AddrCtrlMeas] >> 5
+	osrsP := e.regs[bme680.AddrCtrlMeas] >> 2 & 0b111
+	osrsH := e.regs[bme680.AddrCtrlHum] & 0b111
+
+	tAdc, pAdc, hAdc := uint32(0x80000), uint32(0x80000), uint32(0x8000)
+	if e.adc != nil {
+		tAdc, pAdc, hAdc = e.adc.Temperature, e.adc.Pressure, uint32(e.adc.Humidity)
+	} else if osrsT != 0 {
+		tAdc = invert(func(adc uint32) float64 {
+			t, _ := e.cal.temperature(adc)
+			return t
+		}, 1<<20-1, e.env.Temperature)
+
+		_, tFine := e.cal.temperature(tAdc)
+		if osrsP != 0 {
+			pAdc = invert(func(adc uint32) float64 {
+				return e.cal.pressure(adc, tFine)
+			}, 1<<20-1, e.env.Pressure)
+		}
+		if osrsH != 0 {
+			hAdc = invert(func(adc uint32) float64 {
+				return e.cal.humidity(adc, tFine)
+			}, 1<<16-1, e.env.Humidity)
+		}
+	}
+	e.writeADC(field, tAdc, pAdc, hAdc)
+
+	base := int(bme680.AddrEasStatus0) + field*fieldStride
+	e.regs[base] = newData | gasIndex&0x0F
+	e.regs[base+1] = e.measIndex
+	e.measIndex++
+
+	gasMSB, gasLSB := base+int(bme680.AddrGasRMSB-bme680.AddrEasStatus0), base+int(bme680.AddrGasRLSB-bme680.AddrEasStatus0)
+	runGas := e.regs[bme680.AddrCtrlGas1]&0b010000 != 0
+	if e.variant == bme680.Variant688 {
+		gasMSB, gasLSB = base+int(bme680.AddrGasR688MSB-bme680.AddrEasStatus0), base+int(bme680.AddrGasR688LSB-bme680.AddrEasStatus0)
+		runGas = e.regs[bme680.AddrCtrlGas1]&0b110000 == 0b100000
+	}
+	e.regs[gasMSB], e.regs[gasLSB] = 0, 0
+	if !runGas {
+		return
+	}
+
+	gAdc, gRange := e.gasADC(e.env.GasResistance)
+	if e.adc != nil {
+		gAdc, gRange = uint32(e.adc.Gas), e.adc.GasRange
+	}
+	status := byte(0b100000) // gas_valid
+	heaterOn := e.regs[bme680.AddrCtrlGas0]&0b1000 == 0
+	if heaterOn && e.regs[bme680.AddrResHeat0+gasIndex] != 0 && e.regs[bme680.AddrGasWait0+gasIndex] != 0 {
+		status |= 0b10000 // heat_stab
+	}
+	e.regs[gasMSB] = byte(gAdc >> 2)
+	e.regs[gasLSB] = byte(gAdc&0b11)<<6 | status | gRange
+}
+
+// writeADC stores the raw temperature, pressure and humidity values in a field.
+func (e *Emulator) writeADC(field int, t, p, h uint32) {
+	base := int(bme680.AddrEasStatus0) + field*fieldStride
+	put20 := func(addr byte, v uint32) {
+		i := base + int(addr-bme680.AddrEasStatus0)
+		e.regs[i], e.regs[i+1], e.regs[i+2] = byte(v>>12), byte(v>>4), byte(v<<4)
+	}
+	put20(bme680.AddrPressMSB, p)
+	put20(bme680.AddrTempMSB, t)
+	i := base + int(bme680.AddrHumMSB-bme680.AddrEasStatus0)
+	e.regs[i], e.regs[i+1] = byte(h>>8), byte(h)
+}
+
+// gasADC returns the raw gas value and range that compensate closest to resistance.
+func (e *Emulator) gasADC(resistance float64) (uint32, byte) {
+	var bestADC uint32
+	var bestRange byte
+	bestErr := math.Inf(1)
+
+	for gRange := byte(0); gRange < 16; gRange++ {
+		f := func(adc uint32) float64 { return e.cal.gas(adc, gRange) }
+		if e.variant == bme680.Variant688 {
+			f = func(adc uint32) float64 { return gasHigh(adc, gRange) }
+		}
+		adc := invert(f, 1<<10-1, resistance)
+		if relErr := math.Abs(f(adc)-resistance) / resistance; relErr < bestErr {
+			bestADC, bestRange, bestErr = adc, gRange, relErr
+		}
+	}
+	return bestADC, bestRange
+}
+
+// invert returns the value in [0, max] for which the monotonic function f comes closest to target.
+func invert(f func(uint32) float64, max uint32, target float64) uint32 {
+	lo, hi := uint32(0), max
+	increasing := f(hi) > f(lo)
+
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if (f(mid) < target) == increasing {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	if math.Abs(f(lo)-target) <= math.Abs(f(hi)-target) {
+		return lo
+	}
+	return hi
+}
+
+// Bus returns an i2c.Bus with the emulator at Addr. It's only usable with emulators created by New.
+func (e *Emulator) Bus() i2c.BusCloser {
+	return &bus{e}
+}
+
+type bus struct {
+	e *Emulator
+}
+
+func (b *bus) String() string                    { return "bme680test.Bus" }
+func (b *bus) Close() error                      { return nil }
+func (b *bus) SetSpeed(f physic.Frequency) error { return nil }
+
+func (b *bus) Tx(addr uint16, w, r []byte) error {
+	if b.e.spi {
+		return errors.New("bme680test: emulator uses SPI framing")
+	}
+	if addr != b.e.Addr {
+		return fmt.Errorf("bme680test: no device at address %#x", addr)
+	}
+	return b.e.Tx(w, r)
+}
+
+// Port returns an spi.Port connected to the emulator. It's only usable with emulators created by NewSPI.
+func (e *Emulator) Port() spi.PortCloser {
+	return &port{e}
+}
+
+type port struct {
+	e *Emulator
+}
+
+func (p *port) String() string                      { return "bme680test.Port" }
+func (p *port) Close() error                        { return nil }
+func (p *port) LimitSpeed(f physic.Frequency) error { return nil }
+
+func (p *port) Connect(f physic.Frequency, mode spi.Mode, bits int) (spi.Conn, error) {
+	if !p.e.spi {
+		return nil, errors.New("bme680test: emulator uses I²C framing")
+	}
+	if bits != 8 {
+		return nil, fmt.Errorf("bme680test: %d bits per word aren't supported", bits)
+	}
+	return &spiConn{p.e}, nil
+}
+
+type spiConn struct {
+	*Emulator
+}
+
+func (c *spiConn) TxPackets(packets []spi.Packet) error {
+	for _, packet := range packets {
+		if err := c.Tx(packet.W, packet.R); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ conn.Conn = &Emulator{}
+var _ spi.Conn = &spiConn{}
@@ -1,5 +1,7 @@
 package bme680
 
+import "time"
+
 type calibrationData struct {
 	t1 uint16
 	t2 int16
@@ -21,12 +23,17 @@ type calibrationData struct {
 	g1 int8
 	g2 int16
 	g3 int8
+
+	resHeatVal   int8
+	resHeatRange uint8
+	rangeSwErr   int8
 }
 
-// newCalibration parses calibration data from both buffers.
-func newCalibration(cd1, cd2 []byte) (c calibrationData) {
+// newCalibration parses calibration data from all three buffers.
+func newCalibration(cd1, cd2, cd3 []byte) (c calibrationData) {
 	// cd1 covers 0xE1 through 0xEE
 	// cd2 covers 0x8A through 0xA0
+	// cd3 covers 0x00 through 0x04
 
 	getInt16 := func(lsb, msb byte) int16 {
 		return int16(lsb) | (int16(msb) << 8)
@@ -51,10 +58,9 @@ func newCalibration(cd1, cd2 []byte) (c calibrationData) {
 	c.p9 = getInt16(cd2[20], cd2[21])
 	c.p10 = cd2[22]
 
-	h1E2 := cd1[1] & 0b11110000
-	h2E2 := cd1[1] & 0b1111
-	c.h1 = getUInt16(h1E2, cd1[2])
-	c.h2 = getUInt16(h2E2, cd1[0])
+	// h1 and h2 are 12 bits each and share 0xE2: h1 gets its lower nibble, h2 its upper one.
+	c.h1 = uint16(cd1[2])<<4 | uint16(cd1[1]&0b1111)
+	c.h2 = uint16(cd1[0])<<4 | uint16(cd1[1]>>4)
 	c.h3 = int8(cd1[3])
 	c.h4 = int8(cd1[4])
 	c.h5 = int8(cd1[5])
@@ -65,6 +71,10 @@ func newCalibration(cd1, cd2 []byte) (c calibrationData) {
 	c.g2 = getInt16(cd1[10], cd1[11])
 	c.g3 = int8(cd1[13])
 
+	c.resHeatVal = int8(cd3[0])
+	c.resHeatRange = (cd3[2] & 0b110000) >> 4
+	c.rangeSwErr = int8(cd3[4]&0b11110000) / 16
+
 	return c
 }
 
@@ -74,7 +84,7 @@ func (c calibrationData) compensateTemp(tempRaw uint32) (tempComp, tempFine floa
 
 	tempFloat := float64(tempRaw)
 	var1 = ((tempFloat / 16384.0) - (float64(c.t1) / 1024.0)) * float64(c.t2)
-	var2 = ((tempFloat / 131072.0) - (float64(c.t1)/8192.0)*((tempFloat/131072.0)-(float64(c.t1)/8192.0))) * (float64(c.t3) * 16.0)
+	var2 = (((tempFloat / 131072.0) - (float64(c.t1) / 8192.0)) * ((tempFloat / 131072.0) - (float64(c.t1) / 8192.0))) * (float64(c.t3) * 16.0)
 	tempFine = var1 + var2
 	tempComp = tempFine / 5120.0
 	return tempComp, tempFine
@@ -90,6 +100,9 @@ func (c calibrationData) compensatePressure(pressureRaw uint32, tFine float64) (
 	var2 = (var2 / 4.0) + (float64(c.p4) * 65536.0)
 	var1 = (((float64(c.p3) * var1 * var1) / 16384.0) + (float64(c.p2) * var1)) / 524288.0
 	var1 = (1.0 + (var1 / 32768.0)) * float64(c.p1)
+	if int(var1) == 0 {
+		return 0 // avoid a division by zero with broken calibration data
+	}
 
 	pressComp = 1048576.0 - float64(pressureRaw)
 	pressComp = ((pressComp - (var2 / 4096.0)) * 6250.0) / var1
@@ -99,7 +112,7 @@ func (c calibrationData) compensatePressure(pressureRaw uint32, tFine float64) (
 	var3 = (pressComp / 256.0) * (pressComp / 256.0) * (pressComp / 256.0) * (float64(c.p10) / 131072.0)
 
 	pressComp = pressComp + (var1+var2+var3+(float64(c.p7)*128.0))/16.0
-	return pressComp / 100 // divide by 100 to get pascal directly
+	return pressComp
 }
 
 // compensateHumidity returns humidity in %RH.
@@ -122,3 +135,74 @@ func (c calibrationData) compensateHumidity(humidityRaw uint16, tFine float64) (
 
 	return humidityComp
 }
+
+// lookup tables for the BME680 gas range correction factors
+var (
+	gasRangeK1 = [16]float64{0, 0, 0, 0, 0, -1, 0, -0.8, 0, 0, -0.2, -0.5, 0, -1, 0, 0}
+	gasRangeK2 = [16]float64{0, 0, 0, 0, 0.1, 0.7, 0, -0.8, -0.1, 0, 0, 0, 0, 0, 0, 0}
+)
+
+// compensateGas returns the BME680's gas resistance in Ohm.
+func (c calibrationData) compensateGas(gasRaw uint16, gasRange uint8) (gasComp float64) {
+	var var1, var2, var3 float64
+
+	var1 = 1340.0 + 5.0*float64(c.rangeSwErr)
+	var2 = var1 * (1.0 + gasRangeK1[gasRange]/100.0)
+	var3 = 1.0 + gasRangeK2[gasRange]/100.0
+
+	gasComp = 1.0 / (var3 * 0.000000125 * float64(uint32(1)<<gasRange) * (((float64(gasRaw) - 512.0) / var2) + 1.0))
+	return gasComp
+}
+
+// compensateGasHigh returns the BME688's gas resistance in Ohm.
+// Unlike the BME680, the BME688 doesn't need any calibration data for this.
+func compensateGasHigh(gasRaw uint16, gasRange uint8) (gasComp float64) {
+	var1 := float64(uint32(262144) >> gasRange)
+	var2 := 4096.0 + (float64(gasRaw)-512.0)*3.0
+
+	gasComp = 1000000.0 * var1 / var2
+	return gasComp
+}
+
+// heaterResistance returns the res_heat_x register value needed to heat the hot plate to targetTemp °C
+// at an ambient temperature of ambientTemp °C.
+func (c calibrationData) heaterResistance(targetTemp uint16, ambientTemp float64) byte {
+	var var1, var2, var3, var4, var5, resHeat float64
+
+	if targetTemp > 400 {
+		targetTemp = 400
+	}
+
+	var1 = (float64(c.g1) / 16.0) + 49.0
+	var2 = ((float64(c.g2) / 32768.0) * 0.0005) + 0.00235
+	var3 = float64(c.g3) / 1024.0
+	var4 = var1 * (1.0 + (var2 * float64(targetTemp)))
+	var5 = var4 + (var3 * ambientTemp)
+	resHeat = 3.4 * ((var5 * (4.0 / (4.0 + float64(c.resHeatRange))) * (1.0 / (1.0 + (float64(c.resHeatVal) * 0.002)))) - 25)
+
+	if resHeat < 0 {
+		return 0
+	} else if resHeat > 255 {
+		return 255
+	}
+	return byte(resHeat)
+}
+
+// maxGasWait is the longest heater duration gas_wait_x can hold, 63ms times 64.
+const maxGasWait = 0xFC0 * time.Millisecond
+
+// gasWait returns the gas_wait_x register value for the given heater duration.
+// The register holds a 6 bit value and a 2 bit multiplier (1, 4, 16, or 64) in milliseconds.
+func gasWait(dur time.Duration) byte {
+	ms := dur.Milliseconds()
+	if dur >= maxGasWait {
+		return 0xFF
+	}
+
+	var factor byte
+	for ms > 0x3F {
+		ms /= 4
+		factor++
+	}
+	return byte(ms) + factor<<6
+}
@@ -0,0 +1,127 @@
+package bme680
+
+// The fixed-point versions of the compensation formulas, as in Bosch's BME68x API without
+// BME68X_FLOAT_POINT_COMPENSATION. They return the same results on every architecture.
+//
+// C's implicit conversions are spelled out, so the results are bit-exact with the reference.
+
+// compensateTempInt returns temperature in 1/100 °C and t_fine.
+func (c calibrationData) compensateTempInt(tempRaw uint32) (tempComp int16, tempFine int32) {
+	var var1, var2, var3 int64
+
+	var1 = int64(int32(tempRaw)>>3) - int64(int32(c.t1)<<1)
+	var2 = (var1 * int64(c.t2)) >> 11
+	var3 = ((var1 >> 1) * (var1 >> 1)) >> 12
+	var3 = (var3 * int64(int32(c.t3)<<4)) >> 14
+	tempFine = int32(var2 + var3)
+	tempComp = int16(((tempFine * 5) + 128) >> 8)
+	return tempComp, tempFine
+}
+
+// compensatePressureInt returns pressure in Pascal.
+func (c calibrationData) compensatePressureInt(pressureRaw uint32, tFine int32) uint32 {
+	const presOvfCheck int32 = 0x40000000
+	var var1, var2, var3, pressComp int32
+
+	var1 = (tFine >> 1) - 64000
+	var2 = ((((var1 >> 2) * (var1 >> 2)) >> 11) * int32(c.p6)) >> 2
+	var2 = var2 + ((var1 * int32(c.p5)) << 1)
+	var2 = (var2 >> 2) + (int32(c.p4) << 16)
+	var1 = (((((var1 >> 2) * (var1 >> 2)) >> 13) * (int32(c.p3) << 5)) >> 3) + ((int32(c.p2) * var1) >> 1)
+	var1 = var1 >> 18
+	var1 = ((32768 + var1) * int32(c.p1)) >> 15
+	if var1 == 0 {
+		return 0 // avoid a division by zero with broken calibration data
+	}
+
+	pressComp = 1048576 - int32(pressureRaw)
+	pressComp = int32(uint32(pressComp-(var2>>12)) * 3125)
+	if pressComp >= presOvfCheck {
+		pressComp = (pressComp / var1) << 1
+	} else {
+		pressComp = (pressComp << 1) / var1
+	}
+
+	var1 = (int32(c.p9) * (((pressComp >> 3) * (pressComp >> 3)) >> 13)) >> 12
+	var2 = ((pressComp >> 2) * int32(c.p8)) >> 13
+	var3 = ((pressComp >> 8) * (pressComp >> 8) * (pressComp >> 8) * int32(c.p10)) >> 17
+
+	pressComp = pressComp + ((var1 + var2 + var3 + (int32(c.p7) << 7)) >> 4)
+	return uint32(pressComp)
+}
+
+// compensateHumidityInt returns humidity in 1/1000 %RH.
+func (c calibrationData) compensateHumidityInt(humidityRaw uint16, tFine int32) uint32 {
+	var var1, var2, var3, var4, var5, var6, tempScaled, humidityComp int32
+
+	tempScaled = ((tFine * 5) + 128) >> 8
+	var1 = (int32(humidityRaw) - int32(c.h1)*16) - (((tempScaled * int32(c.h3)) / 100) >> 1)
+	var2 = (int32(c.h2) * (((tempScaled * int32(c.h4)) / 100) +
+		(((tempScaled * ((tempScaled * int32(c.h5)) / 100)) >> 6) / 100) +
+		(1 << 14))) >> 10
+	var3 = var1 * var2
+	var4 = int32(c.h6) << 7
+	var4 = (var4 + ((tempScaled * int32(c.h7)) / 100)) >> 4
+	var5 = ((var3 >> 14) * (var3 >> 14)) >> 10
+	var6 = (var4 * var5) >> 1
+	humidityComp = (((var3 + var6) >> 10) * 1000) >> 12
+
+	if humidityComp > 100000 {
+		humidityComp = 100000
+	} else if humidityComp < 0 {
+		humidityComp = 0
+	}
+	return uint32(humidityComp)
+}
+
+// lookup tables for the BME680's fixed-point gas range correction
+var (
+	gasRangeLookup1 = [16]uint32{
+		2147483647, 2147483647, 2147483647, 2147483647, 2147483647, 2126008810, 2147483647, 2130303777,
+		2147483647, 2147483647, 2143188679, 2136746228, 2147483647, 2126008810, 2147483647, 2147483647,
+	}
+	gasRangeLookup2 = [16]uint32{
+		4096000000, 2048000000, 1024000000, 512000000, 255744255, 127110228, 64000000, 32258064,
+		16016016, 8000000, 4000000, 2000000, 1000000, 500000, 250000, 125000,
+	}
+)
+
+// compensateGasInt returns the BME680's gas resistance in Ohm.
+func (c calibrationData) compensateGasInt(gasRaw uint16, gasRange uint8) uint32 {
+	var var1, var3 int64
+	var var2 uint64
+
+	var1 = ((1340 + 5*int64(c.rangeSwErr)) * int64(gasRangeLookup1[gasRange])) >> 16
+	var2 = uint64(((int64(gasRaw) << 15) - 16777216) + var1)
+	var3 = (int64(gasRangeLookup2[gasRange]) * var1) >> 9
+	return uint32((var3 + (int64(var2) >> 1)) / int64(var2))
+}
+
+// compensateGasHighInt returns the BME688's gas resistance in Ohm.
+func compensateGasHighInt(gasRaw uint16, gasRange uint8) uint32 {
+	var1 := uint32(262144) >> gasRange
+	var2 := int32(gasRaw) - 512
+	var2 *= 3
+	var2 = 4096 + var2
+
+	// Multiplying by 10000, dividing, then multiplying by 100 instead of multiplying by 1000000 prevents an overflow
+	gasComp := (10000 * var1) / uint32(var2)
+	return gasComp * 100
+}
+
+// heaterResistanceInt is the fixed-point version of heaterResistance. ambientTemp is in °C.
+func (c calibrationData) heaterResistanceInt(targetTemp uint16, ambientTemp int8) byte {
+	var var1, var2, var3, var4, var5, resHeatX100 int32
+
+	if targetTemp > 400 {
+		targetTemp = 400
+	}
+
+	var1 = ((int32(ambientTemp) * int32(c.g3)) / 1000) * 256
+	var2 = (int32(c.g1) + 784) * (((((int32(c.g2) + 154009) * int32(targetTemp) * 5) / 100) + 3276800) / 10)
+	var3 = var1 + (var2 / 2)
+	var4 = var3 / (int32(c.resHeatRange) + 4)
+	var5 = (131 * int32(c.resHeatVal)) + 65536
+	resHeatX100 = ((var4 / var5) - 250) * 34
+	return byte((resHeatX100 + 50) / 100)
+}
@@ -0,0 +1,228 @@
+package bme680
+
+import (
+	"math"
+	"testing"
+)
+
+// The expected values come from Bosch's BME68x API (bme68x.c), given the same calibration
+// registers: once built with BME68X_FLOAT_POINT_COMPENSATION, which computes in single
+// precision, and once without. The first blob is the one bme680test emulates, read from a
+// real BME680. The second one has every bit the calibration doesn't use set, and negative
+// values where the first has positive ones.
+
+type tphCase struct {
+	tempRaw, pressureRaw uint32
+	humidityRaw          uint16
+
+	// float API in °C, Pa and %RH
+	temp, pressure, humidity float64
+	// integer API in 1/100 °C, t_fine, Pa and 1/1000 %RH
+	tempInt                  int16
+	tFine                    int32
+	pressureInt, humidityInt uint32
+}
+
+type gasCase struct {
+	raw      uint16
+	gasRange uint8
+
+	// BME680 and BME688 formulas in Ω, from the float and integer API
+	low, high       float64
+	lowInt, highInt uint32
+}
+
+type heaterCase struct {
+	targetTemp  uint16
+	ambientTemp int8
+
+	resHeat, resHeatInt byte // from the float and integer API
+}
+
+var compensationCorpus = []struct {
+	name          string
+	cd1, cd2, cd3 []byte
+	tph           []tphCase
+	gas           []gasCase
+	heater        []heaterCase
+}{
+	{
+		name: "bme680",
+		cd1:  []byte{0x3F, 0x10, 0x31, 0x00, 0x2D, 0x14, 0x78, 0x9C, 0x4C, 0x65, 0xC7, 0xCD, 0xE2, 0x12},
+		cd2:  []byte{0xA3, 0x66, 0x03, 0x00, 0x1F, 0x8E, 0x23, 0xD7, 0x58, 0x00, 0x77, 0x1A, 0xB0, 0xFF, 0x1D, 0x1E, 0x00, 0x00, 0xB8, 0xF6, 0x47, 0xF4, 0x1E},
+		cd3:  []byte{0x31, 0x00, 0x10, 0x00, 0x00},
+		tph: []tphCase{
+			{380000, 260000, 17000, -10.9346, 110016.789, 18.8569, -1093, -55986, 107965, 18854},
+			{460000, 300000, 21000, 14.1237, 107863.109, 41.5922, 1412, 72312, 105815, 41580},
+			{505000, 330000, 24000, 28.222, 105141, 62.0616, 2822, 144496, 105138, 62037},
+			{540000, 360000, 26000, 39.1889, 101700.602, 77.8008, 3919, 200646, 101702, 77790},
+			{600000, 420000, 30000, 57.9924, 93855.0938, 100, 5799, 296920, 93852, 100000},
+			{430000, 380000, 19500, 4.72602, 92855.4531, 32.3589, 473, 24196, 92850, 32349},
+		},
+		gas: []gasCase{
+			{0, 0, 12946861, 102400000, 12946860, 102400000},
+			{512, 4, 499500.438, 4000000, 499500, 4000000},
+			{300, 7, 74958.8359, 591907.5, 74959, 591900},
+			{1023, 15, 176.741455, 1421.21155, 177, 1400},
+			{700, 10, 6849.5874, 54935.6211, 6850, 54900},
+			{150, 5, 341431.281, 2721594.75, 341431, 2721500},
+			{900, 13, 755.574341, 6083.65039, 756, 6000},
+		},
+		heater: []heaterCase{
+			{200, 25, 83, 82},
+			{320, 21, 113, 112},
+			{400, -10, 131, 132},
+			{450, 40, 134, 132},
+			{150, 0, 69, 69},
+			{250, 30, 95, 95},
+		},
+	},
+	{
+		name: "unused bits set",
+		cd1:  []byte{0x3F, 0xD8, 0x2A, 0xF8, 0x33, 0xF6, 0xC8, 0xAB, 0x48, 0x67, 0x9E, 0xDA, 0x23, 0xEC},
+		cd2:  []byte{0xA1, 0x64, 0xFC, 0xFF, 0x0A, 0x8C, 0x28, 0xD8, 0x54, 0xFF, 0x58, 0x1B, 0x92, 0xFF, 0x28, 0xFD, 0xFF, 0xFF, 0x10, 0xF5, 0x54, 0xF2, 0xC8},
+		cd3:  []byte{0xE0, 0xFF, 0xF5, 0xFF, 0xAF},
+		tph: []tphCase{
+			{380000, 260000, 17000, -13.2187, 117202.602, 29.1378, -1322, -67680, 108987, 29141},
+			{460000, 300000, 21000, 11.3492, 114424.734, 60.6336, 1135, 58107, 106225, 60615},
+			{505000, 330000, 24000, 25.1646, 111119.164, 89.3197, 2516, 128841, 104967, 89314},
+			{540000, 360000, 26000, 35.9079, 107042.484, 100, 3591, 183848, 100880, 100000},
+			{600000, 420000, 30000, 54.3208, 97953.2188, 100, 5432, 278121, 93849, 100000},
+			{430000, 380000, 19500, 2.13735, 97132.1719, 47.699, 214, 10942, 93020, 47694},
+		},
+		gas: []gasCase{
+			{0, 0, 13132833, 102400000, 13132832, 102400000},
+			{512, 4, 499500.438, 4000000, 499500, 4000000},
+			{300, 7, 75285.9688, 591907.5, 75286, 591900},
+			{1023, 15, 175.631088, 1421.21155, 176, 1400},
+			{700, 10, 6830.30811, 54935.6211, 6830, 54900},
+			{150, 5, 344391.062, 2721594.75, 344391, 2721500},
+			{900, 13, 751.678955, 6083.65039, 752, 6000},
+		},
+		heater: []heaterCase{
+			{200, 25, 67, 68},
+			{320, 21, 95, 96},
+			{400, -10, 115, 115},
+			{450, 40, 113, 115},
+			{150, 0, 56, 56},
+			{250, 30, 78, 80},
+		},
+	},
+}
+
+// closeTo reports whether got is within tolerance of the single precision want, relative to it.
+func closeTo(got, want, tolerance float64) bool {
+	return math.Abs(got-want) <= tolerance*math.Max(1, math.Abs(want))
+}
+
+func TestCompensateFloat(t *testing.T) {
+	for _, blob := range compensationCorpus {
+		c := newCalibration(blob.cd1, blob.cd2, blob.cd3)
+
+		for _, tc := range blob.tph {
+			temp, tFine := c.compensateTemp(tc.tempRaw)
+			if !closeTo(temp, tc.temp, 1e-5) {
+				t.Errorf("%s: compensateTemp(%d) = %v, want %v", blob.name, tc.tempRaw, temp, tc.temp)
+			}
+			if p := c.compensatePressure(tc.pressureRaw, tFine); !closeTo(p, tc.pressure, 1e-5) {
+				t.Errorf("%s: compensatePressure(%d) at %v°C = %v, want %v", blob.name, tc.pressureRaw, tc.temp, p, tc.pressure)
+			}
+			if h := c.compensateHumidity(tc.humidityRaw, tFine); !closeTo(h, tc.humidity, 1e-5) {
+				t.Errorf("%s: compensateHumidity(%d) at %v°C = %v, want %v", blob.name, tc.humidityRaw, tc.temp, h, tc.humidity)
+			}
+		}
+
+		for _, tc := range blob.gas {
+			if g := c.compensateGas(tc.raw, tc.gasRange); !closeTo(g, tc.low, 1e-5) {
+				t.Errorf("%s: compensateGas(%d, %d) = %v, want %v", blob.name, tc.raw, tc.gasRange, g, tc.low)
+			}
+			if g := compensateGasHigh(tc.raw, tc.gasRange); !closeTo(g, tc.high, 1e-5) {
+				t.Errorf("%s: compensateGasHigh(%d, %d) = %v, want %v", blob.name, tc.raw, tc.gasRange, g, tc.high)
+			}
+		}
+
+		for _, tc := range blob.heater {
+			got := c.heaterResistance(tc.targetTemp, float64(tc.ambientTemp))
+			// Bosch truncates a single precision result, so it can end up one below
+			if diff := int(got) - int(tc.resHeat); diff < 0 || diff > 1 {
+				t.Errorf("%s: heaterResistance(%d, %d) = %d, want %d", blob.name, tc.targetTemp, tc.ambientTemp, got, tc.resHeat)
+			}
+		}
+	}
+}
+
+func TestCompensateInt(t *testing.T) {
+	for _, blob := range compensationCorpus {
+		c := newCalibration(blob.cd1, blob.cd2, blob.cd3)
+
+		for _, tc := range blob.tph {
+			temp, tFine := c.compensateTempInt(tc.tempRaw)
+			if temp != tc.tempInt || tFine != tc.tFine {
+				t.Errorf("%s: compensateTempInt(%d) = %d, %d, want %d, %d", blob.name, tc.tempRaw, temp, tFine, tc.tempInt, tc.tFine)
+			}
+			if p := c.compensatePressureInt(tc.pressureRaw, tc.tFine); p != tc.pressureInt {
+				t.Errorf("%s: compensatePressureInt(%d, %d) = %d, want %d", blob.name, tc.pressureRaw, tc.tFine, p, tc.pressureInt)
+			}
+			if h := c.compensateHumidityInt(tc.humidityRaw, tc.tFine); h != tc.humidityInt {
+				t.Errorf("%s: compensateHumidityInt(%d, %d) = %d, want %d", blob.name, tc.humidityRaw, tc.tFine, h, tc.humidityInt)
+			}
+		}
+
+		for _, tc := range blob.gas {
+			if g := c.compensateGasInt(tc.raw, tc.gasRange); g != tc.lowInt {
+				t.Errorf("%s: compensateGasInt(%d, %d) = %d, want %d", blob.name, tc.raw, tc.gasRange, g, tc.lowInt)
+			}
+			if g := compensateGasHighInt(tc.raw, tc.gasRange); g != tc.highInt {
+				t.Errorf("%s: compensateGasHighInt(%d, %d) = %d, want %d", blob.name, tc.raw, tc.gasRange, g, tc.highInt)
+			}
+		}
+
+		for _, tc := range blob.heater {
+			if got := c.heaterResistanceInt(tc.targetTemp, tc.ambientTemp); got != tc.resHeatInt {
+				t.Errorf("%s: heaterResistanceInt(%d, %d) = %d, want %d", blob.name, tc.targetTemp, tc.ambientTemp, got, tc.resHeatInt)
+			}
+		}
+	}
+}
+
+// FuzzNewCalibration checks that no calibration data, however broken, makes the compensation panic or
+// return something that isn't a number.
+func FuzzNewCalibration(f *testing.F) {
+	for _, blob := range compensationCorpus {
+		f.Add(append(append(append([]byte{}, blob.cd1...), blob.cd2...), blob.cd3...), uint32(500000), uint32(330000), uint16(24000), uint16(512), uint8(4), uint16(320), int8(25))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, tempRaw, pressureRaw uint32, humidityRaw, gasRaw uint16, gasRange uint8, targetTemp uint16, ambientTemp int8) {
+		if len(data) < 14+23+5 {
+			t.Skip()
+		}
+		c := newCalibration(data[:14], data[14:37], data[37:42])
+
+		// The registers only hold this many bits
+		tempRaw &= 1<<20 - 1
+		pressureRaw &= 1<<20 - 1
+		gasRaw &= 1<<10 - 1
+		gasRange &= 0x0F
+
+		temp, tFine := c.compensateTemp(tempRaw)
+		for name, v := range map[string]float64{
+			"temperature":    temp,
+			"pressure":       c.compensatePressure(pressureRaw, tFine),
+			"humidity":       c.compensateHumidity(humidityRaw, tFine),
+			"gas resistance": c.compensateGas(gasRaw, gasRange),
+			"BME688 gas":     compensateGasHigh(gasRaw, gasRange),
+		} {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				t.Errorf("%s isn't finite: %v", name, v)
+			}
+		}
+
+		_, tFineInt := c.compensateTempInt(tempRaw)
+		c.compensatePressureInt(pressureRaw, tFineInt)
+		c.compensateHumidityInt(humidityRaw, tFineInt)
+		c.compensateGasInt(gasRaw, gasRange)
+		compensateGasHighInt(gasRaw, gasRange)
+		c.heaterResistance(targetTemp, float64(ambientTemp))
+		c.heaterResistanceInt(targetTemp, ambientTemp)
+	})
+}
@@ -0,0 +1,176 @@
+package bme680
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// maxHeaterSteps is the number of res_heat_x/gas_wait_x register pairs.
+const maxHeaterSteps = 10
+
+// defaultProfileCycle is the parallel mode cycle length used by Bosch's examples.
+const defaultProfileCycle = 140 * time.Millisecond
+
+// HeaterStep is one step of a parallel mode heater profile.
+type HeaterStep struct {
+	// Temp is the target temperature of the hot plate in °C, capped at 400°C.
+	Temp uint16
+	// Cycles is how many profile cycles the hot plate is held at Temp
+	// before the gas resistance is sampled.
+	Cycles uint8
+}
+
+func (o *Opts) profileCycle() time.Duration {
+	if o.ProfileCycle == 0 {
+		return defaultProfileCycle
+	}
+	return o.ProfileCycle
+}
+
+// tphDuration returns how long the temperature, pressure, and humidity conversions of a single measurement
+// cycle take with the given oversampling settings, as per the datasheet.
+// This includes the switching and gas conversion overhead but not the heater duration.
+func (o *Opts) tphDuration(wakeUp bool) time.Duration {
+	cycles := o.Temperature.asValue() + o.Pressure.asValue() + o.Humidity.asValue()
+
+	dur := time.Duration(cycles) * 1963 * time.Microsecond
+	dur += 4 * 477 * time.Microsecond // TPH switching duration
+	dur += 5 * 477 * time.Microsecond // gas measurement duration
+	if wakeUp {
+		dur += time.Millisecond
+	}
+	return dur
+}
+
+// forcedDuration returns how long a forced mode measurement takes, including waking up and heating the hot plate.
+func (o *Opts) forcedDuration() time.Duration {
+	dur := o.tphDuration(true)
+	if o.HeaterTemp != 0 {
+		heater := o.HeaterDuration
+		if heater > maxGasWait {
+			heater = maxGasWait
+		}
+		dur += heater
+	}
+	return dur
+}
+
+func (d *Dev) isParallel() bool {
+	return len(d.opts.HeaterProfile) > 0
+}
+
+// sharedHeaterDuration returns how long the heater is on in every parallel mode cycle.
+// It's whatever is left of the cycle after the TPH measurement.
+func (d *Dev) sharedHeaterDuration() time.Duration {
+	return d.opts.profileCycle() - d.opts.tphDuration(false)
+}
+
+// sharedHeaterDurationValue returns the shd_heatr_dur register value for the given duration.
+// The register holds a 6 bit value in steps of 0.477ms and a 2 bit multiplier (1, 4, 16, or 64).
+func sharedHeaterDurationValue(dur time.Duration) byte {
+	ms := dur.Milliseconds()
+	if ms >= 0x783 {
+		return 0xFF
+	}
+
+	steps := dur.Microseconds() / 477
+	var factor byte
+	for steps > 0x3F {
+		steps >>= 2
+		factor++
+	}
+	return byte(steps) + factor<<6
+}
+
+// startParallel writes the heater profile and puts the BME688 into parallel mode.
+// It must be called with d.mu lock held.
+func (d *Dev) startParallel() error {
+	b := []byte{
+		AddrConfig, byte(d.opts.Filter) << 2,
+		AddrCtrlHum, byte(d.opts.Humidity),
+	}
+
+	for i, step := range d.opts.HeaterProfile {
+		b = append(b,
+			AddrResHeat0+byte(i), d.heaterResistance(step.Temp),
+			AddrGasWait0+byte(i), step.Cycles,
+		)
+	}
+
+	b = append(b,
+		AddrShdHeatrDur, sharedHeaterDurationValue(d.sharedHeaterDuration()),
+		AddrCtrlGas0, 0,
+		AddrCtrlGas1, noStandby|runGas688|byte(len(d.opts.HeaterProfile)),
+		AddrCtrlMeas, byte(d.opts.Temperature)<<5|byte(d.opts.Pressure)<<2|byte(parallel),
+	)
+
+	d.lastMeasIndex = -1
+	return d.writeCommands(b)
+}
+
+// readFields reads all three field data blocks and returns the measurements that haven't been returned before,
+// ordered by their sub-measurement index.
+// It must be called with d.mu lock held.
+func (d *Dev) readFields() ([]Measurement, error) {
+	buf := [fieldCount * fieldLen]byte{}
+	if err := d.readRegister(AddrEasStatus0, buf[:]); err != nil {
+		return nil, err
+	}
+
+	var ms []Measurement
+	for i := 0; i < fieldCount; i++ {
+		field := buf[i*fieldLen : (i+1)*fieldLen]
+		if field[0]&newData == 0 {
+			continue
+		}
+
+		m := Measurement{}
+		d.parseField(field, &m)
+		if d.lastMeasIndex >= 0 && int8(m.MeasIndex-uint8(d.lastMeasIndex)) <= 0 {
+			continue
+		}
+		ms = append(ms, m)
+	}
+
+	// The index wraps around, so sort relative to the oldest new measurement.
+	sort.Slice(ms, func(i, j int) bool {
+		return int8(ms[i].MeasIndex-ms[j].MeasIndex) < 0
+	})
+	if len(ms) > 0 {
+		d.lastMeasIndex = int(ms[len(ms)-1].MeasIndex)
+	}
+	return ms, nil
+}
+
+func (d *Dev) sensingParallel(sensing chan<- Measurement, stop <-chan struct{}) {
+	// Each field is refilled once per cycle at most, so polling once per cycle
+	// never misses a measurement with three fields to spare.
+	t := time.NewTicker(d.opts.profileCycle())
+	defer t.Stop()
+
+	for {
+		d.mu.Lock()
+		ms, err := d.readFields()
+		d.mu.Unlock()
+
+		if err != nil {
+			log.Printf("%s: failed to sense: %v", d, err)
+			return
+		}
+
+		for _, m := range ms {
+			select {
+			case sensing <- m:
+			case <-stop:
+				return
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package bme680
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"periph.io/x/conn/v3/physic"
+)
+
+// resetDuration is how long the sensor takes to start up again after a soft reset.
+const resetDuration = 10 * time.Millisecond
+
+// self-test parameters and limits, as in Bosch's BME68x API
+const (
+	selfTestHighTemp       = 350
+	selfTestLowTemp        = 150
+	selfTestWarmUp         = 1000 * time.Millisecond
+	selfTestHeaterDuration = 2000 * time.Millisecond
+	selfTestMeasurements   = 6
+
+	selfTestMinTemp     = 0 * physic.Celsius
+	selfTestMaxTemp     = 60 * physic.Celsius
+	selfTestMinPressure = 900 * 100 * physic.Pascal
+	selfTestMaxPressure = 1100 * 100 * physic.Pascal
+	selfTestMinHumidity = 20 * physic.PercentRH
+	selfTestMaxHumidity = 80 * physic.PercentRH
+	selfTestMinGasRatio = 1.2
+)
+
+var errParallelSensing = errors.New("can't be done while sensing continuously in parallel mode, call Halt() first")
+
+// Reset soft resets the sensor and re-reads its calibration data.
+//
+// Options are kept and written again with the next measurement. Sensors
+// sensing continuously in parallel mode must be halted first.
+func (d *Dev) Reset() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stop != nil && d.isParallel() {
+		return d.formatError(errParallelSensing)
+	}
+	return d.reset()
+}
+
+// reset must be called with d.mu lock held.
+func (d *Dev) reset() error {
+	if err := d.writeCommands([]byte{AddrReset, resetCmd}); err != nil {
+		return err
+	}
+	time.Sleep(resetDuration)
+
+	return d.initChip()
+}
+
+// SelfTestReport is the result of SelfTest().
+type SelfTestReport struct {
+	// Measurements are taken with HeaterTemps, alternating between 350°C and 150°C.
+	Measurements []Measurement
+	HeaterTemps  []uint16
+	// GasRatio is the gas resistance at 150°C relative to the one at 350°C,
+	// taken from the last three measurements. Working hot plates reach at least 1.2.
+	GasRatio float64
+	// Failures describes every check that failed.
+	Failures []string
+}
+
+// Passed returns whether all checks passed.
+func (r *SelfTestReport) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+// SelfTest runs Bosch's self-test procedure: after warming up, the hot plate is
+// heated to 350°C and 150°C in turn for six measurements. The first measurement
+// must be plausible for a room, every gas measurement must be valid, and the gas
+// resistance has to rise noticeably at the lower temperature.
+//
+// It takes about 13 seconds, during which the sensor isn't available otherwise.
+// The options are restored afterwards. Sensors sensing continuously in parallel
+// mode must be halted first.
+//
+// The returned error is only set if the sensor couldn't be communicated with.
+// Failed checks are listed in the report.
+func (d *Dev) SelfTest() (*SelfTestReport, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stop != nil && d.isParallel() {
+		return nil, d.formatError(errParallelSensing)
+	}
+
+	saved := d.opts
+	defer func() { d.opts = saved }()
+	d.opts = Opts{
+		Temperature:         O2x,
+		Pressure:            O16x,
+		Humidity:            O1x,
+		Filter:              NoFilter,
+		HeaterTemp:          selfTestHighTemp,
+		HeaterDuration:      selfTestWarmUp,
+		IntegerCompensation: saved.IntegerCompensation,
+	}
+
+	r := &SelfTestReport{}
+
+	var warmUp Measurement
+	if err := d.measure(&warmUp); err != nil {
+		return nil, err
+	}
+	if !warmUp.GasValid {
+		r.Failures = append(r.Failures, "warm-up measurement has no valid gas reading")
+	}
+
+	d.opts.HeaterDuration = selfTestHeaterDuration
+	for i := 0; i < selfTestMeasurements; i++ {
+		d.opts.HeaterTemp = selfTestHighTemp
+		if i%2 == 1 {
+			d.opts.HeaterTemp = selfTestLowTemp
+		}
+
+		var m Measurement
+		if err := d.measure(&m); err != nil {
+			return nil, err
+		}
+		r.Measurements = append(r.Measurements, m)
+		r.HeaterTemps = append(r.HeaterTemps, d.opts.HeaterTemp)
+
+		if !m.GasValid {
+			r.Failures = append(r.Failures, fmt.Sprintf("measurement %d at %d°C has no valid gas reading", i+1, d.opts.HeaterTemp))
+		}
+	}
+
+	first := r.Measurements[0]
+	if t := first.Temperature - physic.ZeroCelsius; t < selfTestMinTemp || t > selfTestMaxTemp {
+		r.Failures = append(r.Failures, fmt.Sprintf("temperature %s is outside of %s to %s", first.Temperature, selfTestMinTemp+physic.ZeroCelsius, selfTestMaxTemp+physic.ZeroCelsius))
+	}
+	if p := first.Pressure; p < selfTestMinPressure || p > selfTestMaxPressure {
+		r.Failures = append(r.Failures, fmt.Sprintf("pressure %s is outside of %s to %s", p, selfTestMinPressure, selfTestMaxPressure))
+	}
+	if h := first.Humidity; h < selfTestMinHumidity || h > selfTestMaxHumidity {
+		r.Failures = append(r.Failures, fmt.Sprintf("humidity %s is outside of %s to %s", h, selfTestMinHumidity, selfTestMaxHumidity))
+	}
+
+	// Measurements 4 and 6 are at the low temperature, 5 is at the high one in between
+	low := float64(r.Measurements[3].GasResistance) + float64(r.Measurements[5].GasResistance)
+	if high := float64(r.Measurements[4].GasResistance); high > 0 {
+		r.GasRatio = low / (2 * high)
+	}
+	if r.GasRatio < selfTestMinGasRatio {
+		r.Failures = append(r.Failures, fmt.Sprintf("gas resistance ratio %.2f between %d°C and %d°C is below %.1f", r.GasRatio, selfTestLowTemp, selfTestHighTemp, selfTestMinGasRatio))
+	}
+
+	return r, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// CurrentReading holds the latest reading for concurrent readers.
+//
+// Stored readings are shared with every reader and hook, so they must not be changed afterwards.
+type CurrentReading struct {
+	mu      sync.RWMutex
+	reading SensorReading
+	version uint64
+
+	// setMu keeps hooks called in the order readings were set
+	setMu sync.Mutex
+	hooks []func(SensorReading)
+}
+
+func NewCurrentReading() *CurrentReading {
+	return &CurrentReading{}
+}
+
+// Snapshot returns the latest reading and its version, which counts the readings set so far.
+// Before the first one, it returns an empty reading and version 0.
+func (c *CurrentReading) Snapshot() (SensorReading, uint64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.reading, c.version
+}
+
+// Set makes r the latest reading, then passes it to the hooks in the order they were added.
+// A hook that panics is logged and skipped. It returns the reading's version.
+func (c *CurrentReading) Set(r SensorReading) uint64 {
+	c.setMu.Lock()
+	defer c.setMu.Unlock()
+
+	c.mu.Lock()
+	c.reading = r
+	c.version++
+	version := c.version
+	c.mu.Unlock()
+
+	for _, hook := range c.hooks {
+		runHook(hook, r)
+	}
+	return version
+}
+
+// runHook calls hook with r, recovering if it panics so the other hooks and later readings still run.
+func runHook(hook func(SensorReading), r SensorReading) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("Hook panicked on the reading from %s: %v\n", r.UpdatedStr, err)
+		}
+	}()
+	hook(r)
+}
+
+// OnSet adds a hook that's called with every reading set from now on.
+// Hooks run on the goroutine setting the reading, so they should return quickly.
+func (c *CurrentReading) OnSet(hook func(SensorReading)) {
+	c.setMu.Lock()
+	defer c.setMu.Unlock()
+
+	c.hooks = append(c.hooks, hook)
+}
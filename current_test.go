@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// versioned is a reading as seen by a reader or hook, identified by its temperature.
+type versioned struct {
+	version     uint64
+	temperature float64
+}
+
+func TestCurrentReadingConcurrent(t *testing.T) {
+	c := NewCurrentReading()
+	if r, version := c.Snapshot(); version != 0 || r.Temperature != 0 {
+		t.Fatalf("Snapshot() before the first reading = %+v, %d", r, version)
+	}
+
+	// Hooks run one at a time, so they need no locking of their own
+	var hooked []string
+	for _, name := range []string{"first", "second"} {
+		name := name
+		c.OnSet(func(r SensorReading) {
+			hooked = append(hooked, fmt.Sprintf("%s %.0f", name, r.Temperature))
+		})
+	}
+
+	const setters, sets, readers = 4, 200, 4
+	var mu sync.Mutex
+	byVersion := map[uint64]float64{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < setters; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 1; j <= sets; j++ {
+				temperature := float64(i*sets + j)
+				version := c.Set(SensorReading{Temperature: temperature})
+
+				mu.Lock()
+				if _, ok := byVersion[version]; ok {
+					t.Errorf("version %d returned twice", version)
+				}
+				byVersion[version] = temperature
+				mu.Unlock()
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	seen := make([][]versioned, readers)
+	var readersWg sync.WaitGroup
+	for i := range seen {
+		i := i
+		readersWg.Add(1)
+		go func() {
+			defer readersWg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				r, version := c.Snapshot()
+				seen[i] = append(seen[i], versioned{version, r.Temperature})
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(stop)
+	readersWg.Wait()
+
+	if _, version := c.Snapshot(); version != setters*sets {
+		t.Fatalf("version = %d after %d readings", version, setters*sets)
+	}
+
+	// Every reader saw versions go up only, each with the reading it was returned for
+	for i, s := range seen {
+		var last uint64
+		for _, v := range s {
+			if v.version < last {
+				t.Errorf("reader %d: version went from %d back to %d", i, last, v.version)
+				break
+			}
+			last = v.version
+			if v.version != 0 && v.temperature != byVersion[v.version] {
+				t.Errorf("reader %d: version %d has reading %.0f, want %.0f", i, v.version, v.temperature, byVersion[v.version])
+				break
+			}
+		}
+	}
+
+	// Hooks got the readings in the order of their versions, in the order they were added
+	if len(hooked) != 2*setters*sets {
+		t.Fatalf("hooks were called %d times for %d readings", len(hooked), setters*sets)
+	}
+	for version := uint64(1); version <= setters*sets; version++ {
+		for j, name := range []string{"first", "second"} {
+			want := fmt.Sprintf("%s %.0f", name, byVersion[version])
+			if got := hooked[2*(version-1)+uint64(j)]; got != want {
+				t.Fatalf("hook call %d was %q, want %q", 2*(version-1)+uint64(j), got, want)
+			}
+		}
+	}
+}
+
+func TestCurrentReadingHooks(t *testing.T) {
+	c := NewCurrentReading()
+
+	var got []float64
+	c.OnSet(func(r SensorReading) {
+		if int(r.Temperature)%2 == 1 {
+			panic("odd reading")
+		}
+	})
+	release := make(chan struct{})
+	entered := make(chan struct{}, 1)
+	c.OnSet(func(r SensorReading) {
+		if r.Temperature == 2 {
+			entered <- struct{}{}
+			<-release
+		}
+	})
+	c.OnSet(func(r SensorReading) {
+		got = append(got, r.Temperature)
+	})
+
+	// A panicking hook neither stops the hooks after it nor later readings
+	if version := c.Set(SensorReading{Temperature: 1}); version != 1 {
+		t.Errorf("version = %d, want 1", version)
+	}
+
+	// A slow hook doesn't keep readers waiting, but delays the next reading's hooks
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Set(SensorReading{Temperature: 2})
+		c.Set(SensorReading{Temperature: 3})
+	}()
+	<-entered
+	if r, version := c.Snapshot(); version != 2 || r.Temperature != 2 {
+		t.Errorf("Snapshot() while a hook is slow = %.0f, %d, want 2, 2", r.Temperature, version)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, version := c.Snapshot(); version != 2 {
+		t.Errorf("version = %d while the previous reading's hooks run, want 2", version)
+	}
+	close(release)
+	<-done
+
+	if r, version := c.Snapshot(); version != 3 || r.Temperature != 3 {
+		t.Errorf("Snapshot() = %.0f, %d, want 3, 3", r.Temperature, version)
+	}
+	if fmt.Sprint(got) != "[1 2 3]" {
+		t.Errorf("last hook got %v, want [1 2 3]", got)
+	}
+}
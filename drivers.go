@@ -0,0 +1,356 @@
+package main
+
+import (
+	"ThermoServer/bme680"
+	"ThermoServer/scd4x"
+	"ThermoServer/sensor"
+	"fmt"
+	"log"
+	"math"
+	"periph.io/x/conn/v3/i2c"
+	"periph.io/x/conn/v3/physic"
+	"sync"
+	"time"
+)
+
+func init() {
+	sensor.Register("bme680", openBMEDriver)
+	sensor.Register("scd4x", openSCDDriver)
+}
+
+// bmeDriver measures continuously in the background and hands out the latest complete measurement.
+type bmeDriver struct {
+	dev *bme680.Dev
+	gas bool // the gas heater is enabled
+
+	mu      sync.Mutex
+	latest  sensor.Sample
+	stopped bool
+}
+
+func openBMEDriver(bus i2c.Bus) (sensor.Driver, error) {
+	deviceOpts := bme680.Opts{
+		Temperature: bme680.O4x,
+		Pressure:    bme680.O4x,
+		Humidity:    bme680.O4x,
+		Filter:      bme680.NoFilter,
+
+		HeaterTemp:     args.HeaterTemp,
+		HeaterDuration: time.Duration(args.HeaterDuration) * time.Millisecond,
+		HeaterProfile:  args.HeaterProfile,
+		ProfileCycle:   time.Duration(args.ProfileCycle) * time.Millisecond,
+
+		IntegerCompensation: args.IntegerComp,
+	}
+
+	dev, err := bme680.NewI2C(bus, BMEAddress, deviceOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	// MeasureContinuous takes one measurement immediately before looping
+	ch, err := dev.MeasureContinuous(time.Duration(args.Interval) * time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &bmeDriver{dev: dev, gas: deviceOpts.HeaterTemp != 0 || len(deviceOpts.HeaterProfile) > 0}
+	go d.collect(ch)
+	return d, nil
+}
+
+// collect turns measurements into samples until the device stops sensing.
+func (d *bmeDriver) collect(ch <-chan bme680.Measurement) {
+	// In parallel mode, every measurement belongs to one heater step.
+	// Only complete profiles are turned into samples.
+	gasProfile := make([]float64, len(d.dev.Opts().HeaterProfile))
+
+	for m := range ch {
+		if len(gasProfile) > 0 {
+			if int(m.GasIndex) >= len(gasProfile) {
+				continue
+			}
+			gasProfile[m.GasIndex] = float64(m.GasResistance) / float64(physic.Ohm)
+			if int(m.GasIndex) < len(gasProfile)-1 {
+				continue
+			}
+		}
+
+		s := sensor.Sample{
+			Time: time.Now(),
+			Values: map[sensor.Quantity]float64{
+				sensor.Temperature: m.Temperature.Celsius(),
+				sensor.Pressure:    float64(m.Pressure) / float64(HectoPascal),
+				sensor.Humidity:    float64(m.Humidity) / float64(physic.PercentRH),
+			},
+		}
+		if d.gas {
+			s.Values[sensor.Gas] = float64(m.GasResistance) / float64(physic.Ohm)
+			s.GasValid, s.HeatStable = m.GasValid, m.HeatStable
+		}
+		if len(gasProfile) > 0 {
+			s.GasProfile = append([]float64(nil), gasProfile...)
+		}
+
+		d.mu.Lock()
+		d.latest = s
+		d.mu.Unlock()
+	}
+
+	// The BME680 stops sensing after an error, which closes the channel
+	d.mu.Lock()
+	d.stopped = true
+	d.mu.Unlock()
+}
+
+func (d *bmeDriver) Name() string    { return "bme680" }
+func (d *bmeDriver) Model() string   { return d.dev.Name() }
+func (d *bmeDriver) Address() uint16 { return BMEAddress }
+
+func (d *bmeDriver) Quantities() []sensor.Quantity {
+	if d.gas {
+		return []sensor.Quantity{sensor.Temperature, sensor.Pressure, sensor.Humidity, sensor.Gas}
+	}
+	return []sensor.Quantity{sensor.Temperature, sensor.Pressure, sensor.Humidity}
+}
+
+func (d *bmeDriver) Read() (sensor.Sample, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stopped {
+		return sensor.Sample{}, sensor.ErrStopped
+	}
+	if d.latest.Time.IsZero() {
+		return sensor.Sample{}, sensor.ErrNotReady
+	}
+	return d.latest, nil
+}
+
+func (d *bmeDriver) Halt() error {
+	return d.dev.Halt()
+}
+
+// scdFRCOnce schedules the forced recalibration given by --scd-frc.
+var scdFRCOnce sync.Once
+
+// scdDriver reads the SCD4x in the --scd-mode measurement mode.
+type scdDriver struct {
+	dev  *scd4x.Dev
+	mode string
+
+	pressure uint16 // ambient pressure in hPa last sent to the sensor
+
+	mu    sync.Mutex
+	timer *time.Timer
+	shot  sensor.Sample // single shot modes: the latest measurement, zero once it's been read
+	err   error         // single shot modes: the error of the latest measurement
+}
+
+func openSCDDriver(bus i2c.Bus) (sensor.Driver, error) {
+	dev, err := scd4x.NewI2C(bus)
+	if err != nil {
+		return nil, err
+	}
+	d := &scdDriver{dev: dev, mode: args.SCDMode}
+
+	// Single shots are timed to be done SCDScheduleMargin before the read they're for, after the previous one
+	_, duration := d.singleShot()
+	if minInterval := duration + SCDScheduleMargin; time.Duration(args.Interval)*time.Second < minInterval {
+		return nil, fmt.Errorf("--scd-mode %s needs an --interval of at least %.0fs", d.mode, math.Ceil(minInterval.Seconds()))
+	}
+
+	fmt.Println("Initializing SCD4x…")
+	if err := dev.StopPeriodicMeasurement(); err != nil {
+		return nil, fmt.Errorf("couldn't stop periodic measurements: %v", err)
+	}
+	if duration != 0 {
+		variant, err := dev.Variant()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't check for an SCD41, which --scd-mode %s needs: %v", d.mode, err)
+		}
+		if variant != scd4x.SCD41 {
+			return nil, fmt.Errorf("--scd-mode %s needs an SCD41, but the sensor is an %s", d.mode, variant)
+		}
+	}
+	if err := dev.Configure(scdSettings(), args.SCDPersist); err != nil {
+		return nil, fmt.Errorf("couldn't configure: %v", err)
+	}
+
+	switch d.mode {
+	case "periodic":
+		if err := dev.StartPeriodicMeasurement(); err != nil {
+			return nil, fmt.Errorf("couldn't start periodic measurements: %v", err)
+		}
+	case "low-power":
+		if err := dev.StartLowPowerPeriodicMeasurement(); err != nil {
+			return nil, fmt.Errorf("couldn't start low power periodic measurements: %v", err)
+		}
+	}
+	fmt.Println("Done")
+
+	// Once is enough, even if the sensor is opened again after failing
+	scdFRCOnce.Do(func() {
+		if args.SCDFRC == 0 {
+			return
+		}
+		time.AfterFunc(SCDFRCWarmUp, func() {
+			// The sensor may have been opened again since, or be failing right now
+			s, dev := supervised("scd4x"), scdDevice()
+			if s == nil || dev == nil || s.State() != SensorOK {
+				log.Println("Skipping SCD4x forced recalibration, the sensor isn't working")
+				return
+			}
+
+			log.Printf("Performing SCD4x forced recalibration to %d ppm\n", args.SCDFRC)
+			correction, err := dev.PerformForcedRecalibration(args.SCDFRC)
+			if err != nil {
+				log.Printf("SCD4x forced recalibration failed: %v\n", err)
+				return
+			}
+			log.Printf("SCD4x forced recalibration corrected by %d ppm\n", correction)
+		})
+	})
+
+	return d, nil
+}
+
+// scdSettings returns the SCD4x settings given as flags.
+func scdSettings() scd4x.Settings {
+	s := scd4x.Settings{
+		TemperatureOffset: args.SCDTempOffset,
+		Altitude:          args.SCDAltitude,
+	}
+	if args.SCDASC != "" {
+		asc := args.SCDASC == "on"
+		s.AutomaticSelfCalibration = &asc
+	}
+	return s
+}
+
+func (d *scdDriver) Name() string    { return "scd4x" }
+func (d *scdDriver) Model() string   { return "SCD4x" }
+func (d *scdDriver) Address() uint16 { return scd4x.Addr }
+
+func (d *scdDriver) Quantities() []sensor.Quantity {
+	if d.mode == "single-shot-rht" {
+		return []sensor.Quantity{sensor.Temperature, sensor.Humidity}
+	}
+	return []sensor.Quantity{sensor.CO2, sensor.Temperature, sensor.Humidity}
+}
+
+func (d *scdDriver) Read() (sensor.Sample, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch d.mode {
+	case "single-shot", "single-shot-rht":
+		s, err := d.shot, d.err
+		d.shot, d.err = sensor.Sample{}, nil
+		if err != nil {
+			return sensor.Sample{}, err
+		}
+		if s.Time.IsZero() {
+			return sensor.Sample{}, sensor.ErrNotReady
+		}
+		return s, nil
+	}
+
+	// The sensor refuses to hand out a measurement twice, so don't ask before the next one is ready
+	ready, err := d.dev.DataReady()
+	if err != nil {
+		return sensor.Sample{}, err
+	}
+	if !ready {
+		return sensor.Sample{}, sensor.ErrNotReady
+	}
+	m, err := d.dev.ReadMeasurement()
+	if err != nil {
+		return sensor.Sample{}, err
+	}
+	return scdSample(m, true), nil
+}
+
+// singleShot returns how to take a single shot measurement in --scd-mode and how long it takes.
+// In periodic modes, it returns nil and 0.
+func (d *scdDriver) singleShot() (func() (scd4x.Measurement, error), time.Duration) {
+	switch d.mode {
+	case "single-shot":
+		return d.dev.MeasureSingleShot, scd4x.SingleShotDuration
+	case "single-shot-rht":
+		return d.dev.MeasureSingleShotRHT, scd4x.SingleShotRHTDuration
+	}
+	return nil, 0
+}
+
+// Schedule takes a single shot measurement in time for the next read.
+func (d *scdDriver) Schedule(next time.Time) {
+	measure, duration := d.singleShot()
+	if measure == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.timer = time.AfterFunc(time.Until(next.Add(-duration-SCDScheduleMargin)), func() {
+		m, err := measure()
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if err != nil {
+			d.err = err
+			return
+		}
+		d.shot = scdSample(m, d.mode != "single-shot-rht")
+	})
+}
+
+// scdSample turns a measurement into a sample, without CO2 for temperature and humidity only measurements.
+func scdSample(m scd4x.Measurement, co2 bool) sensor.Sample {
+	s := sensor.Sample{
+		Time: time.Now(),
+		Values: map[sensor.Quantity]float64{
+			sensor.Temperature: m.Temperature.Celsius(),
+			sensor.Humidity:    float64(m.Humidity) / float64(physic.PercentRH),
+		},
+	}
+	if co2 {
+		s.Values[sensor.CO2] = float64(m.CO2)
+	}
+	return s
+}
+
+// CompensatePressure sends the ambient pressure to the SCD4x for CO2 compensation
+// if it has changed by at least --pressure-delta since it was last sent.
+// While a single shot measurement runs, the sensor doesn't take commands, so it's sent after the next read.
+func (d *scdDriver) CompensatePressure(pressure float64) float64 {
+	if args.PressureDelta < 0 || pressure < scd4x.MinAmbientPressure || pressure > scd4x.MaxAmbientPressure || d.dev.Measuring() {
+		return float64(d.pressure)
+	}
+
+	hPa := uint16(math.Round(pressure))
+	if d.pressure != 0 && math.Abs(float64(hPa)-float64(d.pressure)) < args.PressureDelta {
+		return float64(d.pressure)
+	}
+
+	if err := d.dev.SetAmbientPressure(hPa); err != nil {
+		log.Printf("Couldn't set SCD4x ambient pressure: %v\n", err)
+		return float64(d.pressure)
+	}
+	d.pressure = hPa
+	return float64(d.pressure)
+}
+
+func (d *scdDriver) Halt() error {
+	d.mu.Lock()
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.mu.Unlock()
+
+	return d.dev.Halt()
+}
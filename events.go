@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// subscriberBuffer is how many readings a subscriber may fall behind before it's dropped.
+	subscriberBuffer  = 16
+	heartbeatInterval = 15 * time.Second
+)
+
+// Broadcaster fans out readings to any number of subscribers.
+// Subscribers that don't keep up are dropped by closing their channel.
+type Broadcaster struct {
+	mu   sync.Mutex
+	subs map[chan SensorReading]struct{}
+}
+
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{subs: make(map[chan SensorReading]struct{})}
+}
+
+// Subscribe returns a channel that receives every reading published from now on.
+func (b *Broadcaster) Subscribe() chan SensorReading {
+	ch := make(chan SensorReading, subscriberBuffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subs[ch] = struct{}{}
+	return ch
+}
+
+// Unsubscribe stops sending readings to ch and closes it, unless it was already dropped.
+func (b *Broadcaster) Unsubscribe(ch chan SensorReading) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// Publish sends a reading to all subscribers without blocking.
+func (b *Broadcaster) Publish(r SensorReading) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- r:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// eventID identifies a reading in the event stream by its timestamp.
+func eventID(r SensorReading) int64 {
+	return r.Updated.UnixNano()
+}
+
+// eventsHandler serves /events, a Server-Sent Events stream of new readings.
+//
+// Clients that reconnect with a Last-Event-ID header (or lastEventId query parameter)
+// first get all readings after that one that are still in the history.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+
+	// Subscribe before replaying so no reading falls through the gap.
+	readings := broadcaster.Subscribe()
+	defer broadcaster.Unsubscribe(readings)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+
+	var sent int64
+	if lastID != "" {
+		if id, err := strconv.ParseInt(lastID, 10, 64); err == nil {
+			sent = id
+			for _, reading := range history.Range(time.Unix(0, id+1), time.Now()) {
+				if err := writeEvent(w, reading); err != nil {
+					return
+				}
+				sent = eventID(reading)
+			}
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case reading, ok := <-readings:
+			if !ok {
+				log.Printf("Dropped slow event stream client %s\n", r.RemoteAddr)
+				return
+			}
+			if eventID(reading) <= sent {
+				continue
+			}
+			if err := writeEvent(w, reading); err != nil {
+				return
+			}
+			sent = eventID(reading)
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, reading SensorReading) error {
+	data, err := json.Marshal(reading)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", eventID(reading), data)
+	return err
+}
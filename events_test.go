@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withEvents gives the test its own history and broadcaster, with readings of 1, 2, … °C added to the history
+// a second apart until a minute ago.
+func withEvents(t *testing.T, readings int) []SensorReading {
+	oldHistory, oldBroadcaster := history, broadcaster
+	history, broadcaster = NewHistory(10), NewBroadcaster()
+	t.Cleanup(func() {
+		history, broadcaster = oldHistory, oldBroadcaster
+	})
+
+	var rs []SensorReading
+	for i := 0; i < readings; i++ {
+		r := NewSensorReading(time.Now().Add(-time.Minute).Add(time.Duration(i-readings) * time.Second))
+		r.Temperature = float64(i + 1)
+		history.Add(r)
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+// nextEvent reads the fields of the next event off an event stream.
+func nextEvent(t *testing.T, stream *bufio.Reader) map[string]string {
+	t.Helper()
+
+	event := map[string]string{}
+	for {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return event
+		}
+		field, value, _ := strings.Cut(line, ": ")
+		event[field] = value
+	}
+}
+
+// checkEvent fails the test unless event is reading r.
+func checkEvent(t *testing.T, event map[string]string, r SensorReading) {
+	t.Helper()
+
+	if _, ok := event["event"]; ok {
+		t.Errorf("event is named %q, onmessage doesn't get it", event["event"])
+	}
+	if id := strconv.FormatInt(eventID(r), 10); event["id"] != id {
+		t.Fatalf("event has ID %s, want %s", event["id"], id)
+	}
+	var got SensorReading
+	if err := json.Unmarshal([]byte(event["data"]), &got); err != nil || got.Temperature != r.Temperature {
+		t.Errorf("event data %s, %v, want a reading of %.0f°C", event["data"], err, r.Temperature)
+	}
+}
+
+func TestEventsReplay(t *testing.T) {
+	for name, resume := range map[string]func(req *http.Request, id string){
+		"header": func(req *http.Request, id string) { req.Header.Set("Last-Event-ID", id) },
+		"query":  func(req *http.Request, id string) { req.URL.RawQuery = "lastEventId=" + id },
+	} {
+		resume := resume
+		t.Run(name, func(t *testing.T) {
+			readings := withEvents(t, 4)
+			srv := httptest.NewServer(http.HandlerFunc(eventsHandler))
+			defer srv.Close()
+
+			req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resume(req, strconv.FormatInt(eventID(readings[1]), 10))
+			res, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+			if err != nil {
+				t.Fatalf("GET /events: %v", err)
+			}
+			defer res.Body.Close()
+			if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+			stream := bufio.NewReader(res.Body)
+
+			if event := nextEvent(t, stream); event["retry"] != "5000" {
+				t.Errorf("first event = %v, want the retry time", event)
+			}
+
+			// The readings after the last one seen are replayed from the history
+			checkEvent(t, nextEvent(t, stream), readings[2])
+			checkEvent(t, nextEvent(t, stream), readings[3])
+
+			// New readings follow, without those already sent again
+			broadcaster.Publish(readings[3])
+			next := NewSensorReading(time.Now())
+			next.Temperature = 5
+			broadcaster.Publish(next)
+			checkEvent(t, nextEvent(t, stream), next)
+		})
+	}
+}
+
+// stalledWriter is the connection of a client that stopped reading. Writes block until resume is closed.
+type stalledWriter struct {
+	header  http.Header
+	stalled chan struct{} // closed by the first write
+	resume  chan struct{}
+	once    sync.Once
+
+	mu   sync.Mutex
+	body bytes.Buffer
+}
+
+func (w *stalledWriter) Header() http.Header { return w.header }
+func (w *stalledWriter) WriteHeader(int)     {}
+func (w *stalledWriter) Flush()              {}
+
+func (w *stalledWriter) Write(b []byte) (int, error) {
+	w.once.Do(func() { close(w.stalled) })
+	<-w.resume
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.body.Write(b)
+}
+
+func TestEventsDropSlowClient(t *testing.T) {
+	withEvents(t, 0)
+	w := &stalledWriter{header: http.Header{}, stalled: make(chan struct{}), resume: make(chan struct{})}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		eventsHandler(w, httptest.NewRequest(http.MethodGet, "/events", nil))
+	}()
+	<-w.stalled
+
+	// A reading more than the client may fall behind by drops it, without blocking the others
+	fast := broadcaster.Subscribe()
+	defer broadcaster.Unsubscribe(fast)
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 0; i <= subscriberBuffer; i++ {
+			broadcaster.Publish(NewSensorReading(time.Now().Add(time.Duration(i) * time.Second)))
+			<-fast
+		}
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Publish blocked on a stalled client")
+	}
+
+	// The client gets what was buffered, then the stream ends
+	close(w.resume)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stream of a dropped client didn't end")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if n := strings.Count(w.body.String(), "data: "); n != subscriberBuffer {
+		t.Errorf("dropped client got %d events, want the %d buffered", n, subscriberBuffer)
+	}
+
+	broadcaster.mu.Lock()
+	defer broadcaster.mu.Unlock()
+	if len(broadcaster.subs) != 1 {
+		t.Errorf("%d subscribers left, want only the one that kept up", len(broadcaster.subs))
+	}
+}
@@ -3,14 +3,17 @@ module ThermoServer
 go 1.19
 
 require (
-	github.com/aldernero/scd4x v0.0.0-20220130180236-4b75adf24948
+	github.com/coreos/go-systemd/v22 v22.5.0
+	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.5.0
 	github.com/jessevdk/go-flags v1.5.0
 	periph.io/x/conn/v3 v3.7.0
 	periph.io/x/host/v3 v3.8.0
 )
 
 require (
-	github.com/coreos/go-systemd v0.0.0-20191104093116-d3cd4ed1dbcf // indirect
-	golang.org/x/sys v0.1.0 // indirect
+	golang.org/x/net v0.8.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+	golang.org/x/sys v0.6.0 // indirect
 )
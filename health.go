@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HealthStatus is how well ThermoServer or one of its components works.
+type HealthStatus string
+
+const (
+	HealthOK       HealthStatus = "ok"
+	HealthDegraded HealthStatus = "degraded" // working, but some readings are missing or stale
+	HealthDown     HealthStatus = "down"     // not producing readings
+)
+
+// startedAt is when ThermoServer started. Components that haven't produced anything yet are as old.
+var startedAt = time.Now()
+
+// add adds a component, lowering the overall status to the component's.
+func (h *Health) add(name string, c ComponentHealth) {
+	h.Components[name] = c
+	if c.Status == HealthDown || (c.Status == HealthDegraded && h.Status == HealthOK) {
+		h.Status = c.Status
+	}
+}
+
+// checkHealth returns the health at now. The reading loop and sensors are down once they haven't
+// produced anything for --health-intervals intervals, sensors also if they couldn't be opened again.
+func checkHealth(now time.Time) Health {
+	maxAge := time.Duration(args.HealthIntervals) * time.Duration(args.Interval) * time.Second
+	h := Health{Status: HealthOK, Components: map[string]ComponentHealth{}}
+
+	reading, _ := current.Snapshot()
+	loop := ComponentHealth{Status: HealthOK}
+	updated := startedAt
+	if !reading.Updated.IsZero() {
+		updated = reading.Updated
+		loop.LastRead = reading.UpdatedStr
+	}
+	if age := now.Sub(updated); age > maxAge {
+		loop.Status, loop.Detail = HealthDown, fmt.Sprintf("no new reading for %s", age.Round(time.Second))
+	} else if len(reading.Stale) > 0 {
+		var stale []string
+		for name := range reading.Stale {
+			stale = append(stale, name)
+		}
+		sort.Strings(stale)
+		loop.Status, loop.Detail = HealthDegraded, "stale fields: "+strings.Join(stale, ", ")
+	}
+	h.add("readings", loop)
+
+	for _, d := range sensors {
+		stats := sensorStats[d.Name()]
+		status := stats.Status()
+		c := ComponentHealth{Status: HealthOK, LastRead: status.LastRead}
+		if s, ok := d.(*supervisedSensor); ok {
+			c.State = s.State()
+		}
+
+		lastRead, _ := stats.Snapshot()
+		if lastRead.IsZero() {
+			lastRead = startedAt
+		}
+		switch age := now.Sub(lastRead); {
+		case c.State == SensorFailed:
+			c.Status, c.Detail = HealthDown, "couldn't be opened again: "+status.Error
+		case age > maxAge:
+			c.Status, c.Detail = HealthDown, fmt.Sprintf("no successful read for %s", age.Round(time.Second))
+		case c.State == SensorDegraded || c.State == SensorRecovering:
+			c.Status, c.Detail = HealthDegraded, status.Error
+		}
+		h.add(d.Name(), c)
+	}
+
+	return h
+}
+
+// checkReadiness returns whether every sensor made it into a reading yet.
+func checkReadiness() Health {
+	h := Health{Status: HealthOK, Components: map[string]ComponentHealth{}}
+
+	reading, version := current.Snapshot()
+	loop := ComponentHealth{Status: HealthOK, LastRead: reading.UpdatedStr}
+	if version == 0 {
+		loop.Status, loop.Detail = HealthDown, "no reading yet"
+	}
+	h.add("readings", loop)
+
+	// The reading's own sensor status is used, so the sensors' first values are in it once they're ready
+	for _, d := range sensors {
+		c := ComponentHealth{Status: HealthOK, LastRead: reading.Sensors[d.Name()].LastRead}
+		if c.LastRead == "" {
+			c.Status, c.Detail = HealthDown, "no successful read yet"
+		}
+		h.add(d.Name(), c)
+	}
+
+	return h
+}
+
+// healthzHandler serves /healthz. It responds with 503 Service Unavailable if anything is down.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	h := checkHealth(time.Now())
+
+	status := http.StatusOK
+	if h.Status == HealthDown {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSONStatus(w, status, h)
+}
+
+// readyzHandler serves /readyz. It responds with 503 Service Unavailable until every sensor was read.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	h := checkReadiness()
+
+	status := http.StatusOK
+	if h.Status != HealthOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSONStatus(w, status, h)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	const never = time.Duration(-1)
+
+	for _, c := range []struct {
+		name        string
+		sinceStart  time.Duration
+		readingAge  time.Duration // never if there was no reading yet
+		stale       bool
+		state       SensorState
+		sensorAge   time.Duration // of the last successful read, never if there was none
+		wantLoop    HealthStatus
+		wantSensor  HealthStatus
+		wantOverall HealthStatus
+		wantCode    int
+	}{
+		{"all fresh", time.Hour, 5 * time.Second, false, SensorOK, 5 * time.Second, HealthOK, HealthOK, HealthOK, http.StatusOK},
+		{"stale fields", time.Hour, 5 * time.Second, true, SensorOK, 5 * time.Second, HealthDegraded, HealthOK, HealthDegraded, http.StatusOK},
+		{"sensor degraded", time.Hour, 5 * time.Second, false, SensorDegraded, 5 * time.Second, HealthOK, HealthDegraded, HealthDegraded, http.StatusOK},
+		{"sensor recovering", time.Hour, 5 * time.Second, false, SensorRecovering, 5 * time.Second, HealthOK, HealthDegraded, HealthDegraded, http.StatusOK},
+		{"sensor failed", time.Hour, 5 * time.Second, false, SensorFailed, 5 * time.Second, HealthOK, HealthDown, HealthDown, http.StatusServiceUnavailable},
+		{"sensor not read for too long", time.Hour, 5 * time.Second, false, SensorDegraded, 2 * time.Minute, HealthOK, HealthDown, HealthDown, http.StatusServiceUnavailable},
+		{"no new reading for too long", time.Hour, 2 * time.Minute, true, SensorOK, 5 * time.Second, HealthDown, HealthOK, HealthDown, http.StatusServiceUnavailable},
+		{"just started", 10 * time.Second, never, false, SensorOK, never, HealthOK, HealthOK, HealthOK, http.StatusOK},
+		{"nothing since starting", 2 * time.Minute, never, false, SensorOK, never, HealthDown, HealthDown, HealthDown, http.StatusServiceUnavailable},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			s := newSupervisedSensor(&fakeDriver{}, nil)
+			withSensors(t, s)
+			args.Interval, args.HealthIntervals = 10, 6 // down after a minute
+
+			oldStartedAt := startedAt
+			t.Cleanup(func() { startedAt = oldStartedAt })
+			now := time.Now()
+			startedAt = now.Add(-c.sinceStart)
+
+			if c.readingAge != never {
+				r := NewSensorReading(now.Add(-c.readingAge))
+				if c.stale {
+					r.Stale = map[string]string{"co2": r.UpdatedStr, "temperature": r.UpdatedStr}
+				}
+				current.Set(r)
+			}
+			s.state = c.state
+			if c.sensorAge != never {
+				sensorStats["fake"].ReadOK(now.Add(-c.sensorAge))
+			}
+
+			h := checkHealth(now)
+			if h.Status != c.wantOverall || h.Components["readings"].Status != c.wantLoop || h.Components["fake"].Status != c.wantSensor {
+				t.Errorf("health = %+v, want %s with readings %s and the sensor %s", h, c.wantOverall, c.wantLoop, c.wantSensor)
+			}
+			if loop := h.Components["readings"]; c.stale && c.wantLoop == HealthDegraded && loop.Detail != "stale fields: co2, temperature" {
+				t.Errorf("readings detail = %q, want the stale fields", loop.Detail)
+			}
+			if sensor := h.Components["fake"]; sensor.State != c.state || (sensor.Status == HealthDown && sensor.Detail == "") {
+				t.Errorf("sensor = %+v, want state %s and why it's down", sensor, c.state)
+			}
+
+			w := httptest.NewRecorder()
+			healthzHandler(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			var served Health
+			if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+				t.Fatalf("/healthz: %v", err)
+			}
+			if w.Code != c.wantCode || served.Status != c.wantOverall {
+				t.Errorf("/healthz = %d, %s, want %d, %s", w.Code, served.Status, c.wantCode, c.wantOverall)
+			}
+		})
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		reading    bool
+		sensorRead bool // the reading has a successful read of the sensor
+		wantLoop   HealthStatus
+		wantSensor HealthStatus
+		wantCode   int
+	}{
+		{"no reading yet", false, false, HealthDown, HealthDown, http.StatusServiceUnavailable},
+		{"sensor not read yet", true, false, HealthOK, HealthDown, http.StatusServiceUnavailable},
+		{"ready", true, true, HealthOK, HealthOK, http.StatusOK},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			withSensors(t, newSupervisedSensor(&fakeDriver{}, nil))
+
+			if c.reading {
+				r := NewSensorReading(time.Now())
+				r.Sensors = map[string]SensorStatus{"fake": {State: SensorRecovering}}
+				if c.sensorRead {
+					r.Sensors["fake"] = SensorStatus{State: SensorOK, LastRead: r.UpdatedStr}
+				}
+				current.Set(r)
+			}
+
+			h := checkReadiness()
+			if h.Components["readings"].Status != c.wantLoop || h.Components["fake"].Status != c.wantSensor {
+				t.Errorf("readiness = %+v, want readings %s and the sensor %s", h, c.wantLoop, c.wantSensor)
+			}
+
+			w := httptest.NewRecorder()
+			readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			var served Health
+			if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+				t.Fatalf("/readyz: %v", err)
+			}
+			if w.Code != c.wantCode || (served.Status == HealthOK) != (c.wantCode == http.StatusOK) {
+				t.Errorf("/readyz = %d, %s, want %d", w.Code, served.Status, c.wantCode)
+			}
+		})
+	}
+}
@@ -1,5 +1,11 @@
 package main
 
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
 func min(is ...int) int {
 	min := is[0]
 	for _, i := range is[1:] {
@@ -19,3 +25,23 @@ func max(is ...int) int {
 	}
 	return max
 }
+
+// writeJSON sends v as a JSON response.
+func writeJSON(w http.ResponseWriter, v any) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+// writeJSONStatus sends v as a JSON response with the given status code.
+func writeJSONStatus(w http.ResponseWriter, status int, v any) {
+	jsonStr, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err = w.Write(jsonStr); err != nil {
+		log.Printf("Couldn't send response: %v\n", err)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// History is a fixed-size ring buffer of the most recent readings.
+type History struct {
+	mu       sync.RWMutex
+	readings []SensorReading
+	next     int
+	full     bool
+}
+
+func NewHistory(size int) *History {
+	return &History{readings: make([]SensorReading, size)}
+}
+
+// Add stores a reading, overwriting the oldest one if the buffer is full.
+func (h *History) Add(r SensorReading) {
+	if len(h.readings) == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.readings[h.next] = r
+	h.next = (h.next + 1) % len(h.readings)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Range returns all readings updated within [from, to] in chronological order.
+func (h *History) Range(from, to time.Time) []SensorReading {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var ordered []SensorReading
+	if h.full {
+		ordered = append(ordered, h.readings[h.next:]...)
+	}
+	ordered = append(ordered, h.readings[:h.next]...)
+
+	// Readings are added in chronological order, so the range can be found by bisection.
+	start := sort.Search(len(ordered), func(i int) bool {
+		return !ordered[i].Updated.Before(from)
+	})
+	end := sort.Search(len(ordered), func(i int) bool {
+		return ordered[i].Updated.After(to)
+	})
+	if start >= end {
+		return []SensorReading{}
+	}
+
+	return append([]SensorReading(nil), ordered[start:end]...)
+}
+
+// Aggregation is how the readings within a bucket are combined when downsampling.
+type Aggregation string
+
+const (
+	AggregateMin  Aggregation = "min"
+	AggregateMax  Aggregation = "max"
+	AggregateMean Aggregation = "mean"
+)
+
+// readingField gives uniform access to a numeric SensorReading field.
+type readingField struct {
+	name string // JSON key
+	get  func(r *SensorReading) float64
+	set  func(r *SensorReading, v float64)
+}
+
+// aggregatedFields are the fields combined by Downsample and persisted to the store.
+// All other fields are taken from the bucket's last reading.
+var aggregatedFields = []readingField{
+	{"temperature", func(r *SensorReading) float64 { return r.Temperature }, func(r *SensorReading, v float64) { r.Temperature = v }},
+	{"pressure", func(r *SensorReading) float64 { return r.Pressure }, func(r *SensorReading, v float64) { r.Pressure = v }},
+	{"humidity", func(r *SensorReading) float64 { return r.Humidity }, func(r *SensorReading, v float64) { r.Humidity = v }},
+	{"co2", func(r *SensorReading) float64 { return float64(r.CO2) }, func(r *SensorReading, v float64) { r.CO2 = uint16(math.Round(v)) }},
+	{"gasResistance", func(r *SensorReading) float64 { return r.GasResistance }, func(r *SensorReading, v float64) { r.GasResistance = v }},
+	{"iaq", func(r *SensorReading) float64 { return r.IAQ }, func(r *SensorReading, v float64) { r.IAQ = v }},
+}
+
+// Downsample combines chronologically ordered readings into buckets of length step, starting at from.
+// Every bucket is stamped with its start time. Empty buckets are left out.
+func Downsample(readings []SensorReading, from time.Time, step time.Duration, agg Aggregation) []SensorReading {
+	buckets := []SensorReading{}
+
+	for i := 0; i < len(readings); {
+		bucketStart := from.Add(readings[i].Updated.Sub(from) / step * step)
+		bucketEnd := bucketStart.Add(step)
+
+		j := i
+		for j < len(readings) && readings[j].Updated.Before(bucketEnd) {
+			j++
+		}
+
+		buckets = append(buckets, aggregate(readings[i:j], bucketStart, agg))
+		i = j
+	}
+
+	return buckets
+}
+
+// aggregate combines a non-empty bucket of readings into one.
+func aggregate(bucket []SensorReading, start time.Time, agg Aggregation) SensorReading {
+	result := bucket[len(bucket)-1]
+	result.Updated = start
+	result.UpdatedStr = NewSensorReading(start).UpdatedStr
+	result.GasProfile = nil
+
+	for _, r := range bucket {
+		result.GasValid = result.GasValid && r.GasValid
+		result.HeatStable = result.HeatStable && r.HeatStable
+		if r.IAQAccuracy < result.IAQAccuracy {
+			result.IAQAccuracy = r.IAQAccuracy
+		}
+	}
+
+	for _, field := range aggregatedFields {
+		v := field.get(&bucket[0])
+		for i := 1; i < len(bucket); i++ {
+			switch agg {
+			case AggregateMin:
+				v = math.Min(v, field.get(&bucket[i]))
+			case AggregateMax:
+				v = math.Max(v, field.get(&bucket[i]))
+			default:
+				v += field.get(&bucket[i])
+			}
+		}
+		if agg == AggregateMean {
+			v /= float64(len(bucket))
+		}
+		field.set(&result, v)
+	}
+
+	return result
+}
+
+// parseTimeParam parses a time given either as RFC 3339 or as a Unix timestamp in seconds.
+func parseTimeParam(value string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseTimeRange parses the from and to query parameters, which default to the zero time and now.
+func parseTimeRange(query url.Values) (from, to time.Time, err error) {
+	to = time.Now()
+
+	if v := query.Get("from"); v != "" {
+		if from, err = parseTimeParam(v); err != nil {
+			return from, to, fmt.Errorf("invalid from: %v", err)
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if to, err = parseTimeParam(v); err != nil {
+			return from, to, fmt.Errorf("invalid to: %v", err)
+		}
+	}
+	return from, to, nil
+}
+
+// historyHandler serves /history?from=…&to=…&step=…&agg=…
+//
+// from and to default to the beginning of the history and now, respectively.
+// If step is given, the readings are downsampled with agg, which defaults to mean.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	from, to, err := parseTimeRange(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	readings := history.Range(from, to)
+
+	if v := query.Get("step"); v != "" {
+		step, err := time.ParseDuration(v)
+		if err == nil && step <= 0 {
+			err = errors.New("must be positive")
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid step: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		agg := Aggregation(query.Get("agg"))
+		switch agg {
+		case "":
+			agg = AggregateMean
+		case AggregateMin, AggregateMax, AggregateMean:
+		default:
+			http.Error(w, fmt.Sprintf("invalid agg %q, must be min, max, or mean", agg), http.StatusBadRequest)
+			return
+		}
+
+		if len(readings) > 0 && from.IsZero() {
+			from = readings[0].Updated
+		}
+		readings = Downsample(readings, from, step, agg)
+	}
+
+	writeJSON(w, readings)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// readingAt returns a reading at t with the given temperature.
+func readingAt(t time.Time, temperature float64) SensorReading {
+	r := NewSensorReading(t)
+	r.Temperature = temperature
+	return r
+}
+
+// temperatures returns the temperatures of readings, which identify them in these tests.
+func temperatures(readings []SensorReading) string {
+	var ts []float64
+	for _, r := range readings {
+		ts = append(ts, r.Temperature)
+	}
+	return fmt.Sprint(ts)
+}
+
+func TestHistoryRange(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+	minute := func(m int) time.Time { return start.Add(time.Duration(m) * time.Minute) }
+
+	// Readings 0 to 7 a minute apart, of which a history of 5 keeps 3 to 7
+	wrapped := NewHistory(5)
+	for i := 0; i < 8; i++ {
+		wrapped.Add(readingAt(minute(i), float64(i)))
+	}
+	partial := NewHistory(5)
+	for i := 0; i < 3; i++ {
+		partial.Add(readingAt(minute(i), float64(i)))
+	}
+
+	for _, c := range []struct {
+		history  *History
+		from, to time.Time
+		want     string
+	}{
+		{wrapped, time.Time{}, minute(100), "[3 4 5 6 7]"},
+		{wrapped, minute(4), minute(6), "[4 5 6]"},
+		{wrapped, minute(4).Add(time.Second), minute(6).Add(-time.Second), "[5]"},
+		{wrapped, minute(7), minute(7), "[7]"},
+		{wrapped, minute(0), minute(2), "[]"},
+		{wrapped, minute(8), minute(100), "[]"},
+		{wrapped, minute(6), minute(4), "[]"},
+		{partial, time.Time{}, minute(100), "[0 1 2]"},
+		{partial, minute(1), minute(100), "[1 2]"},
+		{NewHistory(0), time.Time{}, minute(100), "[]"},
+	} {
+		if got := temperatures(c.history.Range(c.from, c.to)); got != c.want {
+			t.Errorf("Range(%s, %s) = %s, want %s", c.from.Format(TimeFormat), c.to.Format(TimeFormat), got, c.want)
+		}
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+	var readings []SensorReading
+	for i, c := range []struct {
+		offset      time.Duration
+		temperature float64
+		co2         uint16
+		gasValid    bool
+		accuracy    uint8
+	}{
+		{0, 1, 400, true, 3},
+		{20 * time.Second, 2, 401, false, 1},
+		{40 * time.Second, 6, 403, true, 2},
+		{70 * time.Second, 4, 500, true, 3},
+		{200 * time.Second, 5, 600, true, 3},
+	} {
+		r := readingAt(start.Add(c.offset), c.temperature)
+		r.CO2, r.GasValid, r.HeatStable, r.IAQAccuracy = c.co2, c.gasValid, true, c.accuracy
+		r.CO2Pressure = uint16(i)
+		readings = append(readings, r)
+	}
+
+	for _, c := range []struct {
+		name  string
+		from  time.Time
+		agg   Aggregation
+		times []time.Duration // bucket starts after start
+		temps string
+		co2   []uint16
+	}{
+		// Buckets with nothing in them are left out
+		{"mean", start, AggregateMean, []time.Duration{0, time.Minute, 3 * time.Minute}, "[3 4 5]", []uint16{401, 500, 600}},
+		{"min", start, AggregateMin, []time.Duration{0, time.Minute, 3 * time.Minute}, "[1 4 5]", []uint16{400, 500, 600}},
+		{"max", start, AggregateMax, []time.Duration{0, time.Minute, 3 * time.Minute}, "[6 4 5]", []uint16{403, 500, 600}},
+		// Buckets are aligned to from, not to the readings
+		{"aligned to from", start.Add(-30 * time.Second), AggregateMean, []time.Duration{-30 * time.Second, 30 * time.Second, 150 * time.Second}, "[1.5 5 5]", []uint16{401, 452, 600}},
+	} {
+		buckets := Downsample(readings, c.from, time.Minute, c.agg)
+		if got := temperatures(buckets); got != c.temps {
+			t.Errorf("%s: temperatures %s, want %s", c.name, got, c.temps)
+			continue
+		}
+		for i, b := range buckets {
+			if want := start.Add(c.times[i]); !b.Updated.Equal(want) || b.UpdatedStr != want.Format(TimeFormat) {
+				t.Errorf("%s: bucket %d starts at %s, want %s", c.name, i, b.UpdatedStr, want.Format(TimeFormat))
+			}
+			if b.CO2 != c.co2[i] {
+				t.Errorf("%s: bucket %d has %d ppm CO2, want %d", c.name, i, b.CO2, c.co2[i])
+			}
+		}
+	}
+
+	// Flags hold only if they do for every reading, the accuracy is the lowest, anything else is the last reading's
+	first := Downsample(readings, start, time.Minute, AggregateMean)[0]
+	if first.GasValid || !first.HeatStable || first.IAQAccuracy != 1 || first.CO2Pressure != 2 {
+		t.Errorf("first bucket has gas valid %t, heat stable %t, accuracy %d, CO2 pressure %d, want false, true, 1, 2",
+			first.GasValid, first.HeatStable, first.IAQAccuracy, first.CO2Pressure)
+	}
+
+	if buckets := Downsample(nil, start, time.Minute, AggregateMean); len(buckets) != 0 {
+		t.Errorf("Downsample of nothing = %d buckets", len(buckets))
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	oldHistory := history
+	t.Cleanup(func() { history = oldHistory })
+
+	// Readings 0 to 9, 20 seconds apart, an hour ago
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	history = NewHistory(10)
+	for i := 0; i < 10; i++ {
+		history.Add(readingAt(start.Add(time.Duration(i)*20*time.Second), float64(i)))
+	}
+	unix := func(seconds int) string {
+		return strconv.FormatInt(start.Add(time.Duration(seconds)*time.Second).Unix(), 10)
+	}
+
+	for _, c := range []struct {
+		query  string
+		status int
+		want   string
+	}{
+		{"", http.StatusOK, "[0 1 2 3 4 5 6 7 8 9]"},
+		{"?from=" + unix(40) + "&to=" + unix(100), http.StatusOK, "[2 3 4 5]"},
+		{"?from=" + start.Add(150*time.Second).Format(time.RFC3339), http.StatusOK, "[8 9]"},
+		{"?to=" + unix(-1), http.StatusOK, "[]"},
+		{"?step=1m", http.StatusOK, "[1 4 7 9]"},
+		{"?step=1m&agg=max", http.StatusOK, "[2 5 8 9]"},
+		{"?step=1m&agg=min&from=" + unix(30), http.StatusOK, "[2 5 8]"},
+		{"?step=abc", http.StatusBadRequest, ""},
+		{"?step=0s", http.StatusBadRequest, ""},
+		{"?step=-1m", http.StatusBadRequest, ""},
+		{"?step=1m&agg=median", http.StatusBadRequest, ""},
+		{"?from=yesterday", http.StatusBadRequest, ""},
+		{"?to=2024-03-01", http.StatusBadRequest, ""},
+	} {
+		w := httptest.NewRecorder()
+		historyHandler(w, httptest.NewRequest(http.MethodGet, "/history"+c.query, nil))
+		if w.Code != c.status {
+			t.Errorf("%s: status %d, want %d: %s", c.query, w.Code, c.status, w.Body)
+			continue
+		}
+		if c.status != http.StatusOK {
+			continue
+		}
+
+		var readings []SensorReading
+		if err := json.Unmarshal(w.Body.Bytes(), &readings); err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		if got := temperatures(readings); got != c.want {
+			t.Errorf("%s: temperatures %s, want %s", c.query, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package iaq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Accuracy describes how far the estimator has come in learning its baseline,
+// and with it, how much the index can be trusted.
+type Accuracy uint8
+
+const (
+	// Stabilizing means the gas sensor is still burning in. The index is
+	// computed against the restored baseline, if any, but is unreliable.
+	Stabilizing Accuracy = 0
+	// Low means the baseline has been learned for less than an hour.
+	Low Accuracy = 1
+	// Medium means the baseline has been learned for less than a day.
+	Medium Accuracy = 2
+	// High means the baseline has been learned for at least a day.
+	High Accuracy = 3
+)
+
+func (a Accuracy) String() string {
+	switch a {
+	case Stabilizing:
+		return "stabilizing"
+	case Low:
+		return "low"
+	case Medium:
+		return "medium"
+	case High:
+		return "high"
+	default:
+		return fmt.Sprintf("Accuracy(%d)", a)
+	}
+}
+
+const (
+	// BurnIn is how long the gas sensor needs after startup before its readings are used for learning.
+	BurnIn = 5 * time.Minute
+
+	// referenceHumidity is the relative humidity all gas readings are compensated to.
+	referenceHumidity = 40.0
+	// humiditySlope is the ln(R) change per %RH. MOX sensors read lower resistances in humid air.
+	humiditySlope = 0.03
+
+	// The baseline follows cleaner air quickly and decays towards dirtier air over a few days,
+	// so it ends up tracking the cleanest air seen recently.
+	riseTime  = 10 * time.Minute
+	decayTime = 4 * 24 * time.Hour
+
+	// cleanAirIndex is the index for air as clean as the baseline, as on the BSEC scale.
+	cleanAirIndex = 25.0
+	// indexPerDecade is how much the index rises when the compensated resistance drops to a tenth of the baseline.
+	indexPerDecade = 400.0
+	maxIndex       = 500.0
+
+	// maxStep caps how much learning time a single update can account for, so downtime isn't counted.
+	maxStep = 5 * time.Minute
+)
+
+// State is the part of the estimator that survives restarts.
+type State struct {
+	// Baseline is the humidity compensated clean air gas resistance in Ohm.
+	Baseline float64 `json:"baseline"`
+	// Learned is how long the baseline has been learned for in total.
+	Learned time.Duration `json:"learned"`
+	// Updated is the time of the last update that went into the baseline.
+	Updated time.Time `json:"updated"`
+}
+
+// Estimator turns gas resistance readings into an indoor air quality index from 0 (clean) to 500 (heavily polluted).
+type Estimator struct {
+	mu      sync.Mutex
+	state   State
+	started time.Time
+	last    time.Time
+}
+
+// NewEstimator returns an estimator without a baseline.
+func NewEstimator() *Estimator {
+	return &Estimator{}
+}
+
+// Update feeds a gas resistance in Ohm and the relative humidity in % next to the sensor into the estimator
+// and returns the resulting index and its accuracy.
+func (e *Estimator) Update(t time.Time, gasResistance, humidity float64) (float64, Accuracy) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.started.IsZero() {
+		e.started = t
+	}
+
+	compensated := compensateHumidity(gasResistance, humidity)
+	if t.Sub(e.started) < BurnIn {
+		e.last = t
+		return e.index(compensated), Stabilizing
+	}
+
+	step := maxStep
+	if !e.last.IsZero() && t.Sub(e.last) < maxStep {
+		step = t.Sub(e.last)
+	}
+	e.last = t
+
+	e.learn(compensated, step)
+	e.state.Learned += step
+	e.state.Updated = t
+
+	return e.index(compensated), e.accuracy()
+}
+
+// learn moves the baseline towards the compensated resistance.
+// It must be called with e.mu lock held.
+func (e *Estimator) learn(compensated float64, step time.Duration) {
+	if e.state.Baseline <= 0 {
+		e.state.Baseline = compensated
+		return
+	}
+
+	tau := decayTime
+	if compensated > e.state.Baseline {
+		tau = riseTime
+	}
+
+	alpha := 1 - math.Exp(-float64(step)/float64(tau))
+	e.state.Baseline += (compensated - e.state.Baseline) * alpha
+}
+
+// index maps the compensated resistance to the IAQ scale.
+// It must be called with e.mu lock held.
+func (e *Estimator) index(compensated float64) float64 {
+	if e.state.Baseline <= 0 || compensated <= 0 {
+		return cleanAirIndex
+	}
+
+	ratio := math.Min(compensated/e.state.Baseline, 1)
+	index := cleanAirIndex - indexPerDecade*math.Log10(ratio)
+	return math.Min(index, maxIndex)
+}
+
+// accuracy must be called with e.mu lock held.
+func (e *Estimator) accuracy() Accuracy {
+	switch {
+	case e.state.Learned < time.Hour:
+		return Low
+	case e.state.Learned < 24*time.Hour:
+		return Medium
+	default:
+		return High
+	}
+}
+
+// compensateHumidity scales a gas resistance to what it would be at the reference humidity.
+func compensateHumidity(gasResistance, humidity float64) float64 {
+	return gasResistance * math.Exp(humiditySlope*(humidity-referenceHumidity))
+}
+
+// State returns a copy of the estimator's persistent state.
+func (e *Estimator) State() State {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.state
+}
+
+// Load restores the estimator's state from the file at path.
+// A missing file is not an error; the estimator then starts from scratch.
+func (e *Estimator) Load(path string) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var state State
+	if err := json.Unmarshal(b, &state); err != nil {
+		return fmt.Errorf("iaq: couldn't parse state file %s: %v", path, err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.state = state
+	return nil
+}
+
+// Save writes the estimator's state to the file at path, creating its directory if needed.
+// The file is replaced atomically so a power cut can't leave a truncated state behind.
+func (e *Estimator) Save(path string) error {
+	b, err := json.Marshal(e.State())
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Without syncing first, the rename may reach the disk before the data does
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
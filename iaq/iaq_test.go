@@ -0,0 +1,197 @@
+package iaq
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// feed updates e once a minute for n minutes from start and returns the time of the last update and its result.
+func feed(e *Estimator, start time.Time, n int, gasResistance, humidity float64) (time.Time, float64, Accuracy) {
+	var index float64
+	var accuracy Accuracy
+	t := start
+	for i := 0; i < n; i++ {
+		t = start.Add(time.Duration(i) * time.Minute)
+		index, accuracy = e.Update(t, gasResistance, humidity)
+	}
+	return t, index, accuracy
+}
+
+// burntIn returns an estimator that has learned a baseline of 100kΩ at the reference humidity, and the time of
+// its last update.
+func burntIn(t *testing.T) (*Estimator, time.Time) {
+	t.Helper()
+
+	e := NewEstimator()
+	last, _, _ := feed(e, testStart, int(BurnIn/time.Minute)+1, 100000, referenceHumidity)
+	if baseline := e.State().Baseline; baseline != 100000 {
+		t.Fatalf("baseline = %.0f after the burn-in, want 100000", baseline)
+	}
+	return e, last
+}
+
+func TestBurnIn(t *testing.T) {
+	e := NewEstimator()
+	for i := 0; i < int(BurnIn/time.Minute); i++ {
+		index, accuracy := e.Update(testStart.Add(time.Duration(i)*time.Minute), 50000, 50)
+		if accuracy != Stabilizing || index != cleanAirIndex {
+			t.Errorf("minute %d: index %.0f, accuracy %s during the burn-in, want %.0f, stabilizing", i, index, accuracy, cleanAirIndex)
+		}
+	}
+	if state := e.State(); state.Baseline != 0 || state.Learned != 0 {
+		t.Errorf("state = %+v after the burn-in, want nothing learned", state)
+	}
+
+	// The first reading after the burn-in is the baseline
+	if index, accuracy := e.Update(testStart.Add(BurnIn), 50000, referenceHumidity); accuracy != Low || index != cleanAirIndex {
+		t.Errorf("index %.0f, accuracy %s after the burn-in, want %.0f, low", index, accuracy, cleanAirIndex)
+	}
+
+	// A restored baseline is used during the burn-in, but not learned from
+	e2 := NewEstimator()
+	e2.state = State{Baseline: 100000, Learned: 48 * time.Hour}
+	if index, accuracy := e2.Update(testStart, 10000, referenceHumidity); accuracy != Stabilizing || math.Abs(index-(cleanAirIndex+indexPerDecade)) > 1e-9 {
+		t.Errorf("index %.0f, accuracy %s at a tenth of the restored baseline, want %.0f, stabilizing", index, accuracy, cleanAirIndex+indexPerDecade)
+	}
+	if state := e2.State(); state.Baseline != 100000 || state.Learned != 48*time.Hour {
+		t.Errorf("state = %+v, want the restored one", state)
+	}
+}
+
+func TestAccuracy(t *testing.T) {
+	e, last := burntIn(t)
+
+	// Every minute of learning counts, from the first update after the burn-in
+	for minute := 2; minute <= 25*60; minute++ {
+		_, accuracy := e.Update(last.Add(time.Duration(minute-1)*time.Minute), 100000, referenceHumidity)
+
+		want := Low
+		if minute >= 24*60 {
+			want = High
+		} else if minute >= 60 {
+			want = Medium
+		}
+		if accuracy != want {
+			t.Fatalf("accuracy = %s after %d minutes, want %s", accuracy, minute, want)
+		}
+	}
+
+	// Downtime only counts as much as a single update can
+	learned := e.State().Learned
+	e.Update(last.Add(30*time.Hour), 100000, referenceHumidity)
+	if got := e.State().Learned - learned; got != maxStep {
+		t.Errorf("an update 5 hours after the last one learned for %s, want %s", got, maxStep)
+	}
+}
+
+func TestBaseline(t *testing.T) {
+	// The baseline after n minutes of learning a steady resistance
+	after := func(from, to float64, n int, tau time.Duration) float64 {
+		return to + (from-to)*math.Exp(-float64(time.Duration(n)*time.Minute)/float64(tau))
+	}
+	within := func(got, want float64) bool {
+		return math.Abs(got-want) < 1e-6*want
+	}
+
+	// Cleaner air is followed within minutes
+	e, last := burntIn(t)
+	feed(e, last.Add(time.Minute), 10, 200000, referenceHumidity)
+	if got, want := e.State().Baseline, after(100000, 200000, 10, riseTime); !within(got, want) {
+		t.Errorf("baseline = %.0f after 10 minutes of 200kΩ, want %.0f", got, want)
+	}
+
+	// Dirtier air takes days
+	e, last = burntIn(t)
+	_, index, _ := feed(e, last.Add(time.Minute), 60, 50000, referenceHumidity)
+	if got, want := e.State().Baseline, after(100000, 50000, 60, decayTime); !within(got, want) || got < 99000 {
+		t.Errorf("baseline = %.0f after an hour of 50kΩ, want %.0f", got, want)
+	}
+	if index < cleanAirIndex+100 {
+		t.Errorf("index = %.0f at half the baseline, want well above clean air", index)
+	}
+}
+
+func TestHumidityCompensation(t *testing.T) {
+	// MOX sensors read lower in humid air, so the same resistance means cleaner air when it's humid
+	e, last := burntIn(t)
+	dry, _ := e.Update(last.Add(time.Minute), 50000, 20)
+	reference, _ := e.Update(last.Add(2*time.Minute), 50000, referenceHumidity)
+	humid, _ := e.Update(last.Add(3*time.Minute), 50000, 60)
+	if !(dry > reference && reference > humid) {
+		t.Errorf("index at 20%%, 40%%, 60%% RH = %.0f, %.0f, %.0f, want falling with humidity", dry, reference, humid)
+	}
+
+	if got := compensateHumidity(50000, referenceHumidity); got != 50000 {
+		t.Errorf("compensated resistance at the reference humidity = %.0f, want 50000", got)
+	}
+}
+
+func TestIndexRange(t *testing.T) {
+	e, last := burntIn(t)
+	for _, c := range []struct {
+		gasResistance float64
+		want          float64
+	}{
+		{1000000, cleanAirIndex}, // cleaner than the baseline
+		{100000, cleanAirIndex},
+		{10000, cleanAirIndex + indexPerDecade},
+		{1000, maxIndex},
+		{1, maxIndex},
+	} {
+		// Keep the baseline where it is, the update itself moves it by a fraction of an index point at most
+		e.state.Baseline = 100000
+		last = last.Add(time.Minute)
+		if index, _ := e.Update(last, c.gasResistance, referenceHumidity); math.Abs(index-c.want) > 0.1 {
+			t.Errorf("index at %.0fΩ = %.2f, want %.0f", c.gasResistance, index, c.want)
+		}
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	e, last := burntIn(t)
+	feed(e, last.Add(time.Minute), 90, 120000, 50)
+	saved := e.State()
+
+	// The state directory may not exist yet
+	path := filepath.Join(t.TempDir(), "thermoserver", "iaq-state.json")
+	if err := e.Save(path); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if _, err := os.Stat(path + ".tmp"); err == nil {
+		t.Errorf("temporary file left behind")
+	}
+
+	loaded := NewEstimator()
+	if err := loaded.Load(path); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if state := loaded.State(); state.Baseline != saved.Baseline || state.Learned != saved.Learned || !state.Updated.Equal(saved.Updated) {
+		t.Errorf("loaded state %+v, want %+v", state, saved)
+	}
+
+	// Saving again replaces the state
+	feed(e, last.Add(time.Hour), 10, 80000, 50)
+	if err := e.Save(path); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := loaded.Load(path); err != nil || loaded.State().Learned != e.State().Learned {
+		t.Errorf("Load after saving again = %+v, %v, want %+v", loaded.State(), err, e.State())
+	}
+
+	// Starting from scratch is fine, a broken state isn't
+	fresh := NewEstimator()
+	if err := fresh.Load(filepath.Join(t.TempDir(), "missing.json")); err != nil || fresh.State() != (State{}) {
+		t.Errorf("Load of a missing file = %+v, %v, want nothing", fresh.State(), err)
+	}
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fresh.Load(path); err == nil {
+		t.Errorf("Load of a broken file succeeded")
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
-	"ThermoServer/bme680"
+	"ThermoServer/iaq"
+	"ThermoServer/sensor"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/aldernero/scd4x"
+	"github.com/coreos/go-systemd/v22/daemon"
 	"github.com/gorilla/mux"
 	"github.com/jessevdk/go-flags"
 	"log"
@@ -13,10 +15,13 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"periph.io/x/conn/v3/i2c"
 	"periph.io/x/conn/v3/i2c/i2creg"
 	"periph.io/x/conn/v3/physic"
 	"periph.io/x/host/v3"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -26,48 +31,280 @@ type ProgramArgs struct {
 	Port uint16 `short:"P" long:"port" default:"27315" description:"Port to listen on"`
 
 	// Sensor Options
-	Interval  uint16 `short:"I" long:"interval" default:"10" description:"Interval between readings"`
-	I2CDevice string `short:"D" long:"i2cdev" description:"The used I2C device (default: auto)"`
+	Sensors         []string          `long:"sensor" default:"bme680" default:"scd4x" description:"Sensor driver to use, may be given multiple times (available: bme680, scd4x)"`
+	Sources         map[string]string `long:"source" default:"humidity:scd4x,bme680" description:"Sensors a quantity is taken from in order of preference as quantity:sensor,sensor…, may be given multiple times (other quantities take the sensors in the order of --sensor)"`
+	Interval        uint16            `short:"I" long:"interval" default:"10" description:"Interval between readings"`
+	I2CDevice       string            `short:"D" long:"i2cdev" description:"The used I2C device (default: auto)"`
+	History         uint32            `long:"history" default:"8640" description:"Number of readings kept in memory for /history"`
+	MaxFailures     uint              `long:"sensor-max-failures" default:"3" description:"Consecutive failed reads after which a sensor is opened again"`
+	MaxBackoff      time.Duration     `long:"sensor-max-backoff" default:"5m" description:"Longest wait between attempts to open a failed sensor again"`
+	HealthIntervals uint              `long:"health-intervals" default:"6" description:"Intervals without a new reading or successful sensor read after which /healthz reports it as down"`
+	StaleAfter      time.Duration     `long:"stale-after" default:"1m" description:"Age after which fields that couldn't be measured again are marked as stale"`
+
+	// Simulation Options
+	Simulate       bool       `long:"simulate" description:"Use simulated sensors instead of the I2C bus"`
+	SimulateSeed   int64      `long:"simulate-seed" description:"Seed of the simulation (default: random)"`
+	SimulateFaults FaultRates `long:"simulate-faults" description:"Probabilities of simulated faults per read as comma-separated fault=probability pairs, e.g. error=0.05,stuck=0.01,spike=0.01"`
+
+	// Storage Options
+	StoreDir         string        `long:"store-dir" description:"Directory readings are persisted to (default: disabled)"`
+	StoreRetention   time.Duration `long:"store-retention" default:"168h" description:"How long raw readings are kept on disk (0 keeps them forever)"`
+	StoreRetention1m time.Duration `long:"store-retention-1m" default:"2160h" description:"How long 1-minute rollups are kept on disk (0 keeps them forever)"`
+	StoreRetention1h time.Duration `long:"store-retention-1h" default:"0" description:"How long 1-hour rollups are kept on disk (0 keeps them forever)"`
+	StoreMaxSize     uint32        `long:"store-max-size" default:"0" description:"Maximum size of the reading store in MiB, oldest data is deleted first (0 is unlimited)"`
+
+	// Gas Sensor Options
+	HeaterTemp     uint16        `long:"heater-temp" default:"320" description:"BME680 gas heater target temperature in °C (0 disables gas readings)"`
+	HeaterDuration uint16        `long:"heater-duration" default:"150" description:"BME680 gas heater duration in milliseconds"`
+	HeaterProfile  HeaterProfile `long:"heater-profile" description:"BME688 parallel mode heater profile as comma-separated temp:cycles steps, e.g. 320:5,100:2,200:10"`
+	ProfileCycle   uint16        `long:"profile-cycle" default:"140" description:"BME688 parallel mode cycle length in milliseconds"`
+	IAQStateFile   string        `long:"iaq-state" default:"/var/lib/thermoserver/iaq-state.json" description:"File the IAQ baseline is kept in across restarts, in $STATE_DIRECTORY if systemd sets it (empty to disable)"`
+	IntegerComp    bool          `long:"integer-compensation" description:"Use Bosch's fixed-point BME680 compensation instead of the floating point one"`
+
+	// CO2 Sensor Options
+	PressureDelta float64  `long:"pressure-delta" default:"1" description:"Minimum ambient pressure change in hPa before it's sent to the SCD4x again (negative disables pressure compensation)"`
+	SCDMode       string   `long:"scd-mode" default:"periodic" choice:"periodic" choice:"low-power" choice:"single-shot" choice:"single-shot-rht" description:"SCD4x measurement mode: every 5s, every 30s, or once per --interval (SCD41 only), optionally without CO2"`
+	SCDTempOffset *float64 `long:"scd-temp-offset" description:"SCD4x temperature offset in °C to make up for self-heating (default: keep the sensor's)"`
+	SCDAltitude   *uint16  `long:"scd-altitude" description:"SCD4x altitude in meters above sea level, used for CO2 compensation without pressure (default: keep the sensor's)"`
+	SCDASC        string   `long:"scd-asc" choice:"on" choice:"off" description:"Turn SCD4x automatic self-calibration on or off (default: keep the sensor's)"`
+	SCDPersist    bool     `long:"scd-persist" description:"Persist the SCD4x settings to its EEPROM, which endures about 2000 writes"`
+	SCDFRC        uint16   `long:"scd-frc" description:"Recalibrate the SCD4x to this CO2 concentration in ppm 3 minutes after startup"`
+
+	// MQTT Options
+	MQTTBroker          string `long:"mqtt-broker" description:"MQTT broker URL to publish readings to, e.g. tcp://localhost:1883 or ssl://broker:8883 (default: disabled)"`
+	MQTTClientID        string `long:"mqtt-client-id" default:"thermoserver" description:"MQTT client ID, also used as the Home Assistant node ID"`
+	MQTTUsername        string `long:"mqtt-username" description:"MQTT username"`
+	MQTTPassword        string `long:"mqtt-password" env:"THERMOSERVER_MQTT_PASSWORD" description:"MQTT password"`
+	MQTTTopic           string `long:"mqtt-topic" default:"thermoserver" description:"MQTT topic prefix"`
+	MQTTQoS             byte   `long:"mqtt-qos" default:"0" description:"MQTT QoS level for readings (0, 1 or 2)"`
+	MQTTRetain          bool   `long:"mqtt-retain" description:"Retain the latest reading on the MQTT broker"`
+	MQTTDiscoveryPrefix string `long:"mqtt-discovery-prefix" default:"homeassistant" description:"Home Assistant MQTT discovery prefix (empty to disable discovery)"`
+	MQTTCAFile          string `long:"mqtt-ca" description:"CA certificate file to verify the MQTT broker with"`
+	MQTTCertFile        string `long:"mqtt-cert" description:"Client certificate file for MQTT TLS authentication"`
+	MQTTKeyFile         string `long:"mqtt-key" description:"Client key file for MQTT TLS authentication"`
+
+	// WebSocket Options
+	WSToken string `long:"ws-token" env:"THERMOSERVER_WS_TOKEN" description:"Token WebSocket clients need to send commands (default: commands disabled)"`
+
+	// Admin Options
+	AdminToken string `long:"admin-token" env:"THERMOSERVER_ADMIN_TOKEN" description:"Bearer token needed for the /admin endpoints (default: admin endpoints disabled)"`
 }
 
 var (
 	args ProgramArgs
 
-	currentEnv     physic.Env
-	currentReading SensorReading
+	current     = NewCurrentReading()
+	history     *History
+	broadcaster = NewBroadcaster()
 
-	scdDev *scd4x.SCD4x
+	sensors     []sensor.Driver
+	sensorStats = map[string]*SensorStats{}
+
+	iaqEstimator = iaq.NewEstimator()
+	iaqSaved     time.Time
+
+	mqttPublisher *MQTTPublisher
 )
 
 const (
 	MinTimeoutSeconds = 2
+	BMEAddress        = 0x76
 	HectoPascal       = 100 * physic.Pascal
+	IAQSaveInterval   = 10 * time.Minute
+	SCDFRCWarmUp      = 3 * time.Minute        // the SCD4x must measure this long before a forced recalibration
+	SCDScheduleMargin = 500 * time.Millisecond // single shot SCD4x measurements are done this long before they're read
 )
 
-func updateReading(ch <-chan physic.Env) {
-	for env := range ch {
-		log.Println("New readings")
+// updateReading takes a reading from all sensors every interval.
+func updateReading(priorities sensor.Priorities) {
+	ticker := time.NewTicker(time.Duration(args.Interval) * time.Second)
+	defer ticker.Stop()
 
-		reading := NewSensorReading(time.Now())
+	var lastGas time.Time // time of the last gas sample fed to the IAQ estimator
 
-		currentEnv = env
-		scdData, err := scdDev.ReadMeasurement()
+	for ; true; <-ticker.C {
+		log.Println("New readings")
+		lastGas = takeReading(priorities, lastGas)
+	}
+}
+
+// takeReading reads all sensors and sets the current reading. Gas samples taken after lastGas are fed to the
+// IAQ estimator, the time of the last one fed is returned.
+func takeReading(priorities sensor.Priorities, lastGas time.Time) time.Time {
+	previous, _ := current.Snapshot()
+	reading := NewSensorReading(time.Now())
+	next := reading.Updated.Add(time.Duration(args.Interval) * time.Second)
+
+	samples := map[string]sensor.Sample{}
+	for _, d := range sensors {
+		s, err := d.Read()
+		if errors.Is(err, sensor.ErrNotReady) {
+			continue
+		}
 		if err != nil {
-			fmt.Printf("SCD4x error, reusing previous data. Details: %v\n", err)
-			reading.Humidity = currentReading.Humidity
-			reading.CO2 = currentReading.CO2
+			sensorStats[d.Name()].ReadFailed(err)
+			log.Printf("%s error, using other sensors or previous data. Details: %v\n", d.Model(), err)
+			continue
+		}
+		sensorStats[d.Name()].ReadOK(s.Time)
+		samples[d.Name()] = s
+	}
+	for _, d := range sensors {
+		if scheduled, ok := d.(sensor.Scheduled); ok {
+			scheduled.Schedule(next)
+		}
+	}
+
+	merged, sources := sensor.Merge(samples, priorities)
+
+	// Quantities no sensor could provide keep their previous value
+	reading.Sources = map[string]string{}
+	reading.Measured = map[string]time.Time{}
+	for _, q := range sensor.Quantities {
+		field := quantityField(q)
+		if v, ok := merged.Values[q]; ok {
+			field.set(&reading, v)
+			reading.Sources[field.name] = sources[q]
+			reading.Measured[field.name] = samples[sources[q]].Time
 		} else {
-			// SCD41
-			reading.Humidity = scdData.Rh
-			reading.CO2 = scdData.CO2
+			field.set(&reading, field.get(&previous))
+			if source, ok := previous.Sources[field.name]; ok {
+				reading.Sources[field.name] = source
+				reading.Measured[field.name] = previous.Measured[field.name]
+			}
+		}
+	}
+
+	// Values that were carried over for too long are flagged, so they aren't mistaken for fresh ones
+	reading.Stale = map[string]string{}
+	for name, measured := range reading.Measured {
+		if reading.Updated.Sub(measured) > args.StaleAfter {
+			reading.Stale[name] = measured.Format(TimeFormat)
+		}
+	}
+	reading.Sensors = map[string]SensorStatus{}
+	for _, d := range sensors {
+		status := sensorStats[d.Name()].Status()
+		if s, ok := d.(*supervisedSensor); ok {
+			status.State = s.State()
+		}
+		reading.Sensors[d.Name()] = status
+	}
+
+	if reading.Pressure != 0 {
+		for _, d := range sensors {
+			if c, ok := d.(sensor.PressureCompensated); ok {
+				compensated := c.CompensatePressure(reading.Pressure)
+				if d.Name() == reading.Sources["co2"] {
+					reading.CO2Pressure = uint16(compensated)
+				}
+			}
+		}
+	}
+
+	if _, ok := merged.Values[sensor.Gas]; ok {
+		reading.GasValid = merged.GasValid
+		reading.HeatStable = merged.HeatStable
+		reading.GasProfile = merged.GasProfile
+	}
+
+	gasSample := samples[sources[sensor.Gas]]
+	if reading.gasUsable() && gasSample.Time.After(lastGas) {
+		// The gas sensor's own humidity matches its conditions best
+		humidity, ok := gasSample.Values[sensor.Humidity]
+		if !ok {
+			humidity = reading.Humidity
+		}
+		index, accuracy := iaqEstimator.Update(gasSample.Time, reading.GasResistance, humidity)
+		reading.IAQ = index
+		reading.IAQAccuracy = uint8(accuracy)
+		lastGas = gasSample.Time
+
+		if reading.Updated.Sub(iaqSaved) >= IAQSaveInterval {
+			saveIAQState()
+			iaqSaved = reading.Updated
+		}
+	} else {
+		reading.IAQ = previous.IAQ
+		reading.IAQAccuracy = previous.IAQAccuracy
+	}
+
+	current.Set(reading)
+	return lastGas
+}
+
+// quantityField returns the SensorReading field a quantity is stored in.
+func quantityField(q sensor.Quantity) readingField {
+	name := string(q)
+	if q == sensor.Gas {
+		name = "gasResistance"
+	}
+	for _, f := range aggregatedFields {
+		if f.name == name {
+			return f
+		}
+	}
+	panic("no reading field for quantity " + name)
+}
+
+// openSensors opens the drivers given by --sensor.
+func openSensors(bus i2c.Bus) {
+	for _, name := range args.Sensors {
+		if _, ok := sensorStats[name]; ok {
+			log.Fatalf("Sensor %s is given more than once", name)
+		}
+
+		var d sensor.Driver
+		var err error
+		if args.Simulate {
+			d, err = openSimSensor(name, 0)
+		} else {
+			d, err = sensor.Open(name, bus)
+		}
+		if err != nil {
+			log.Fatalf("Couldn't initialize sensor %s: %v", name, err)
+		}
+
+		sensors = append(sensors, newSupervisedSensor(d, openSupervised(name)))
+		sensorStats[name] = &SensorStats{Model: d.Model(), Address: d.Address()}
+	}
+}
+
+// sourcePriorities returns the priorities given by --source.
+// Quantities without a --source take the open sensors in the order of --sensor.
+func sourcePriorities() sensor.Priorities {
+	priorities := sensor.DefaultPriorities(sensors)
+	registered := map[string]bool{}
+	for _, name := range sensor.Names() {
+		registered[name] = true
+	}
+
+	for name, list := range args.Sources {
+		q, err := sensor.ParseQuantity(name)
+		if err != nil {
+			log.Fatalf("Invalid --source: %v", err)
 		}
 
-		// BME680
-		reading.Temperature = currentEnv.Temperature.Celsius()
-		reading.Pressure = float64(currentEnv.Pressure) / float64(physic.Pascal)
-		//reading.HumidityBME = float64(currentEnv.Humidity) / float64(physic.PercentRH)
+		var names []string
+		for _, driver := range strings.Split(list, ",") {
+			if !registered[driver] {
+				log.Fatalf("Invalid --source: unknown sensor %q", driver)
+			}
+			// Sensors that aren't open never provide anything, so they don't need to be filtered
+			names = append(names, driver)
+		}
+		priorities[q] = names
+	}
+
+	return priorities
+}
 
-		currentReading = reading
+func saveIAQState() {
+	if args.IAQStateFile == "" {
+		return
+	}
+	if err := iaqEstimator.Save(args.IAQStateFile); err != nil {
+		log.Printf("Couldn't save IAQ state: %v\n", err)
 	}
 }
 
@@ -96,123 +333,165 @@ func setupI2CBus(i2cdev string) i2c.BusCloser {
 	return bus
 }
 
-// setupBMESensor returns the bus and the device. the caller has the responsibility to close the bus
-func setupBMESensor(i2cBus i2c.BusCloser) *bme680.Dev {
-	deviceOpts := bme680.Opts{
-		Temperature: bme680.O4x,
-		Pressure:    bme680.O4x,
-		Humidity:    bme680.O4x,
-		Filter:      bme680.NoFilter,
-	}
-
-	dev, err := bme680.NewI2C(i2cBus, 0x76, deviceOpts)
+// readingHandler serves the current reading.
+func readingHandler(w http.ResponseWriter, r *http.Request) {
+	reading, _ := current.Snapshot()
+	jsonStr, err := json.Marshal(reading)
 	if err != nil {
-		log.Fatalf("Couldn't initialize sensor: %v", err)
+		w.WriteHeader(500)
+		return
 	}
 
-	return dev
-}
-
-func setupSCDSensor(i2cBus i2c.BusCloser) *scd4x.SCD4x {
-	sensor, err := scd4x.SensorInit(i2cBus, false)
+	_, err = fmt.Fprintf(w, string(jsonStr))
 	if err != nil {
-		log.Fatalln(err.Error())
+		log.Fatalf("Couldn't send response: %v\n", err)
 	}
-
-	fmt.Println("Initializing SCD4x…")
-	if err := sensor.StopMeasurements(); err != nil {
-		log.Fatalf("Error while trying to stop periodic measurements: %v\n", err)
-	}
-	if err := sensor.StartMeasurements(); err != nil {
-		log.Fatalf("Error while trying to start periodic measurements: %v\n", err)
-	}
-	fmt.Println("Done")
-
-	return sensor
 }
 
 func main() {
 	args = ProgramArgs{}
 	argParser := flags.NewParser(&args, flags.Default)
+	argParser.SubcommandsOptional = true
+	argParser.AddCommand("selftest", "Run the BME680 self-test", "Runs Bosch's BME680 self-test, prints the report and exits with status 1 if the sensor failed.", &SelfTestCommand{})
+	argParser.AddCommand("reset", "Soft reset the BME680", "Soft resets the BME680 and exits.", &ResetCommand{})
 
 	_, err := argParser.Parse()
 	if err != nil {
 		log.Fatal("arg parse fail")
 	}
+	if argParser.Active != nil {
+		return // a subcommand ran instead of the server
+	}
+	// systemd's StateDirectory= takes precedence over the default, but not over --iaq-state
+	if dir := os.Getenv("STATE_DIRECTORY"); dir != "" && !argParser.FindOptionByLongName("iaq-state").IsSet() {
+		args.IAQStateFile = filepath.Join(strings.Split(dir, ":")[0], "iaq-state.json")
+	}
 
-	// Boring i2c setup (error handling happens in these functions)
-	bus := setupI2CBus(args.I2CDevice)
-	defer bus.Close()
+	history = NewHistory(int(args.History))
+	if args.StoreDir != "" {
+		openStore()
+	}
 
-	bmeDev := setupBMESensor(bus)
+	var bus i2c.BusCloser
+	if args.Simulate {
+		setupSimulation()
+	} else {
+		// Boring i2c setup (error handling happens in these functions)
+		bus = setupI2CBus(args.I2CDevice)
+	}
 
-	// SenseContinuous will take one reading immediately before looping
-	intervalDuration := time.Duration(args.Interval)
-	readingChannel, err := bmeDev.SenseContinuous(intervalDuration * time.Second)
-	if err != nil {
-		log.Fatalf("Couldn't start taking readings: %v", err)
+	if args.IAQStateFile != "" {
+		if err := iaqEstimator.Load(args.IAQStateFile); err != nil {
+			log.Printf("Couldn't load IAQ state, starting from scratch: %v\n", err)
+		}
 	}
-	defer bmeDev.Halt()
 
-	scdDev = setupSCDSensor(bus)
-	defer scdDev.StopMeasurements()
+	openSensors(bus)
+	priorities := sourcePriorities()
 
-	fmt.Println("Waking up in a second…")
+	if args.MQTTBroker != "" {
+		if mqttPublisher, err = NewMQTTPublisher(); err != nil {
+			log.Fatalf("Couldn't set up MQTT: %v", err)
+		}
+	}
 
-	// give the sensors time to wake up
-	time.Sleep(1 * time.Second)
+	// Everything else gets new readings from the current one
+	current.OnSet(history.Add)
+	current.OnSet(storeReading)
+	current.OnSet(broadcaster.Publish)
+	if mqttPublisher != nil {
+		current.OnSet(mqttPublisher.Publish)
+	}
+	current.OnSet(systemdNotifier())
+	go watchSystemd()
+
+	// Start background measurements. Sensors that haven't woken up yet aren't ready, see /readyz
+	go updateReading(priorities)
 
-	// Start background measurements
-	go updateReading(readingChannel)
+	timeoutLen := max(MinTimeoutSeconds, int(args.Interval))
+	timeout := time.Duration(timeoutLen) * time.Second
 
 	r := mux.NewRouter()
-	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		jsonStr, err := json.Marshal(currentReading)
-		if err != nil {
-			w.WriteHeader(500)
-			return
-		}
 
-		_, err = fmt.Fprintf(w, string(jsonStr))
-		if err != nil {
-			log.Fatalf("Couldn't send response: %v\n", err)
-		}
+	// Streaming endpoints stay open indefinitely, so they're exempt from the write timeout
+	r.HandleFunc("/events", eventsHandler)
+	r.HandleFunc("/ws", wsHandler)
+
+	// Diagnostics may take a while, so they're exempt from the write timeout as well
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(adminAuth)
+	admin.HandleFunc("/bme680/reset", bmeResetHandler).Methods(http.MethodPost)
+	admin.HandleFunc("/bme680/selftest", bmeSelfTestHandler).Methods(http.MethodPost)
+	admin.HandleFunc("/scd4x/settings", scdSettingsHandler).Methods(http.MethodGet, http.MethodPost)
+	admin.HandleFunc("/scd4x/frc", scdFRCHandler).Methods(http.MethodPost)
+
+	api := r.PathPrefix("/").Subrouter()
+	api.Use(func(next http.Handler) http.Handler {
+		return http.TimeoutHandler(next, timeout, "")
 	})
 
-	timeoutLen := max(MinTimeoutSeconds, int(args.Interval))
+	api.HandleFunc("/", readingHandler)
+
+	api.HandleFunc("/history", historyHandler)
+	api.HandleFunc("/store", storeHandler)
+	api.HandleFunc("/metrics", metricsHandler)
+	api.HandleFunc("/healthz", healthzHandler)
+	api.HandleFunc("/readyz", readyzHandler)
 
 	addr := fmt.Sprintf("%s:%d", args.Host, args.Port)
 	srv := &http.Server{
-		Addr:         addr,
-		ReadTimeout:  time.Duration(timeoutLen) * time.Second,
-		WriteTimeout: time.Duration(timeoutLen) * time.Second,
-		IdleTimeout:  120 * time.Second,
-		Handler:      r,
+		Addr:        addr,
+		ReadTimeout: timeout,
+		IdleTimeout: 120 * time.Second,
+		Handler:     r,
 	}
 
+	// With socket activation, systemd decides where to listen instead of --host and --port
+	listener := systemdListener()
 	go func() {
-		if args.Host == "0.0.0.0" {
-			localIP := getOutboundIP() // resolve local IP for easier debugging
-			log.Printf("Listening on %s:%d…\n", localIP.String(), args.Port)
+		var err error
+		if listener != nil {
+			log.Printf("Listening on %s passed by systemd…\n", listener.Addr())
+			err = srv.Serve(listener)
 		} else {
-			log.Printf("Listening on %s…\n", addr)
+			if args.Host == "0.0.0.0" {
+				localIP := getOutboundIP() // resolve local IP for easier debugging
+				log.Printf("Listening on %s:%d…\n", localIP.String(), args.Port)
+			} else {
+				log.Printf("Listening on %s…\n", addr)
+			}
+			err = srv.ListenAndServe()
 		}
-
-		err := srv.ListenAndServe()
 		log.Printf("Shutdown (%v)\n", err)
 	}()
 
 	sigChan := make(chan os.Signal, 1)
-	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
-	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
-	signal.Notify(sigChan, os.Interrupt)
+	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C) or SIGTERM, which systemd stops services with.
+	// SIGKILL or SIGQUIT (Ctrl+/) will not be caught.
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
 	<-sigChan
+	sdNotify(daemon.SdNotifyStopping)
 
 	// Give the server a timeout period of 4 seconds
 	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
 	defer cancel()
 	// Doesn't block if no connections, but will otherwise wait until the timeout deadline.
 	_ = srv.Shutdown(ctx)
+
+	// os.Exit skips deferred calls. The sensors are halted first, so they're left idle and nothing new is read.
+	for _, d := range sensors {
+		if err := d.Halt(); err != nil {
+			log.Printf("Couldn't halt %s: %v\n", d.Model(), err)
+		}
+	}
+	if bus != nil {
+		bus.Close()
+	}
+	saveIAQState()
+	closeStore()
+	if mqttPublisher != nil {
+		mqttPublisher.Close()
+	}
 	os.Exit(0)
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"ThermoServer/sensor"
+	"testing"
+	"time"
+)
+
+// withSensors gives the test its own current reading and sensors, restoring the real ones afterwards.
+func withSensors(t *testing.T, drivers ...sensor.Driver) {
+	oldArgs, oldSensors, oldStats, oldCurrent := args, sensors, sensorStats, current
+	t.Cleanup(func() {
+		args, sensors, sensorStats, current = oldArgs, oldSensors, oldStats, oldCurrent
+	})
+
+	sensors, sensorStats, current = drivers, map[string]*SensorStats{}, NewCurrentReading()
+	for _, d := range drivers {
+		sensorStats[d.Name()] = &SensorStats{Model: d.Model(), Address: d.Address()}
+	}
+}
+
+func TestStaleFields(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		staleAfter time.Duration
+		age        time.Duration // of the previous reading's values
+		readFails  bool
+		wantStale  []string
+	}{
+		{"carried over", time.Minute, 30 * time.Second, true, nil},
+		{"carried over for too long", time.Minute, 2 * time.Minute, true, []string{"temperature", "humidity"}},
+		{"measured again", time.Minute, 2 * time.Minute, false, []string{"humidity"}},
+		{"longer --stale-after", 5 * time.Minute, 2 * time.Minute, true, nil},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			d := &fakeDriver{}
+			withSensors(t, d)
+			args.StaleAfter, args.Interval = c.staleAfter, 10
+			if c.readFails {
+				d.fail(errFake)
+			}
+
+			// The fake driver measures the temperature, no sensor measures the humidity anymore
+			measured := time.Now().Add(-c.age)
+			previous := NewSensorReading(measured)
+			previous.Temperature, previous.Humidity, previous.Pressure = 20, 40, 1000
+			previous.Sources = map[string]string{"temperature": "fake", "humidity": "gone"}
+			previous.Measured = map[string]time.Time{"temperature": measured, "humidity": measured}
+			current.Set(previous)
+
+			takeReading(sensor.DefaultPriorities(sensors), time.Time{})
+			r, _ := current.Snapshot()
+
+			if len(r.Stale) != len(c.wantStale) {
+				t.Errorf("stale fields %v, want %v", r.Stale, c.wantStale)
+			}
+			for _, name := range c.wantStale {
+				if r.Stale[name] != measured.Format(TimeFormat) {
+					t.Errorf("%s is stale since %q, want %s", name, r.Stale[name], measured.Format(TimeFormat))
+				}
+			}
+
+			// Values carried over keep their source, fields never measured aren't stale
+			wantTemperature := 21.0
+			if c.readFails {
+				wantTemperature = 20
+			}
+			if r.Temperature != wantTemperature || r.Humidity != 40 || r.Sources["humidity"] != "gone" {
+				t.Errorf("%.0f°C, %.0f%% from %q, want %.0f°C and 40%% from gone", r.Temperature, r.Humidity, r.Sources["humidity"], wantTemperature)
+			}
+			if _, ok := r.Measured["pressure"]; ok {
+				t.Errorf("pressure was never measured, but has a time")
+			}
+		})
+	}
+}
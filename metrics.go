@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SensorStats tracks the outcome of a sensor's reads.
+type SensorStats struct {
+	Model   string
+	Address uint16
+
+	mu        sync.Mutex
+	lastRead  time.Time
+	errors    uint64
+	lastError error // error of the latest read, nil if it succeeded
+}
+
+// ReadOK records a successful read at t.
+func (s *SensorStats) ReadOK(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastRead = t
+	s.lastError = nil
+}
+
+// ReadFailed records a failed read.
+func (s *SensorStats) ReadFailed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.errors++
+	s.lastError = err
+}
+
+// Status returns the sensor's state for readings.
+func (s *SensorStats) Status() SensorStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := SensorStatus{}
+	if !s.lastRead.IsZero() {
+		status.LastRead = s.lastRead.Format(TimeFormat)
+	}
+	if s.lastError != nil {
+		status.Error = s.lastError.Error()
+	}
+	return status
+}
+
+// Snapshot returns the time of the last successful read and the number of failed reads.
+func (s *SensorStats) Snapshot() (lastRead time.Time, errors uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastRead, s.errors
+}
+
+func (s *SensorStats) labels() string {
+	return fmt.Sprintf(`sensor=%q,address="0x%02X"`, s.Model, s.Address)
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	sb strings.Builder
+}
+
+func (m *metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(&m.sb, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (m *metricsWriter) sample(name, labels string, value float64) {
+	fmt.Fprintf(&m.sb, "%s{%s} %s\n", name, labels, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+// metricsHandler serves /metrics for Prometheus.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	reading, _ := current.Snapshot()
+
+	m := &metricsWriter{}
+
+	// Every gauge is labelled with the sensor its reading field was taken from
+	gauges := []struct {
+		name, help, source string
+		value              float64
+		ok                 bool
+	}{
+		{"thermoserver_temperature_celsius", "Temperature in degrees Celsius.", "temperature", reading.Temperature, true},
+		{"thermoserver_pressure_pascals", "Air pressure in Pascal.", "pressure", reading.Pressure * 100, true},
+		{"thermoserver_humidity_percent", "Relative humidity in percent.", "humidity", reading.Humidity, true},
+		{"thermoserver_co2_ppm", "CO2 concentration in parts per million.", "co2", float64(reading.CO2), true},
+		{"thermoserver_gas_resistance_ohms", "Gas sensor resistance in Ohm.", "gasResistance", reading.GasResistance, reading.GasValid},
+		{"thermoserver_iaq", "Indoor air quality index from 0 to 500.", "gasResistance", reading.IAQ, reading.gasUsable()},
+	}
+
+	for _, g := range gauges {
+		stats, ok := sensorStats[reading.Sources[g.source]]
+		if _, stale := reading.Stale[g.source]; !ok || !g.ok || stale {
+			continue
+		}
+		m.header(g.name, "gauge", g.help)
+		m.sample(g.name, stats.labels(), g.value)
+	}
+
+	m.header("thermoserver_last_read_timestamp_seconds", "gauge", "Unix time of the last successful read.")
+	for _, d := range sensors {
+		s := sensorStats[d.Name()]
+		if lastRead, _ := s.Snapshot(); !lastRead.IsZero() {
+			m.sample("thermoserver_last_read_timestamp_seconds", s.labels(), float64(lastRead.UnixNano())/1e9)
+		}
+	}
+
+	m.header("thermoserver_read_errors_total", "counter", "Number of failed reads.")
+	for _, d := range sensors {
+		s := sensorStats[d.Name()]
+		_, errors := s.Snapshot()
+		m.sample("thermoserver_read_errors_total", s.labels(), float64(errors))
+	}
+
+	m.header("thermoserver_sensor_state", "gauge", "Whether a sensor is in the state given by the state label.")
+	for _, d := range sensors {
+		supervised, ok := d.(*supervisedSensor)
+		if !ok {
+			continue
+		}
+		state := supervised.State()
+		for _, label := range []SensorState{SensorOK, SensorDegraded, SensorFailed, SensorRecovering} {
+			value := 0.0
+			if label == state {
+				value = 1
+			}
+			m.sample("thermoserver_sensor_state", fmt.Sprintf("%s,state=%q", sensorStats[d.Name()].labels(), label), value)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write([]byte(m.sb.String()))
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	mqttOnline  = "online"
+	mqttOffline = "offline"
+
+	mqttTimeout = 5 * time.Second
+)
+
+// discoveryField describes how a SensorReading field shows up in Home Assistant.
+type discoveryField struct {
+	key         string // JSON key in the state message
+	name        string
+	unit        string
+	deviceClass string
+}
+
+var discoveryFields = []discoveryField{
+	{"temperature", "Temperature", "°C", "temperature"},
+	{"pressure", "Pressure", "hPa", "atmospheric_pressure"},
+	{"humidity", "Humidity", "%", "humidity"},
+	{"co2", "CO2", "ppm", "carbon_dioxide"},
+	{"gasResistance", "Gas Resistance", "Ω", ""},
+	{"iaq", "Air Quality Index", "", "aqi"},
+}
+
+// MQTTPublisher publishes every reading to an MQTT broker.
+//
+// Topics, relative to the configured prefix:
+//
+//	status  "online" while connected, "offline" otherwise (retained, set as last will)
+//	state   the latest reading as JSON
+type MQTTPublisher struct {
+	client          mqtt.Client
+	prefix          string
+	discoveryPrefix string
+	nodeID          string
+	qos             byte
+	retain          bool
+}
+
+// nonTopicChars matches everything Home Assistant doesn't allow in node and object IDs.
+var nonTopicChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// NewMQTTPublisher connects to the broker given by --mqtt-broker.
+// The connection is retried in the background if the broker is unreachable.
+func NewMQTTPublisher() (*MQTTPublisher, error) {
+	if args.MQTTQoS > 2 {
+		return nil, fmt.Errorf("invalid MQTT QoS %d", args.MQTTQoS)
+	}
+
+	p := &MQTTPublisher{
+		prefix:          args.MQTTTopic,
+		discoveryPrefix: args.MQTTDiscoveryPrefix,
+		nodeID:          nonTopicChars.ReplaceAllString(args.MQTTClientID, "_"),
+		qos:             args.MQTTQoS,
+		retain:          args.MQTTRetain,
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(args.MQTTBroker).
+		SetClientID(args.MQTTClientID).
+		SetUsername(args.MQTTUsername).
+		SetPassword(args.MQTTPassword).
+		SetWill(p.topic("status"), mqttOffline, 1, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(p.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("MQTT connection lost: %v\n", err)
+		})
+
+	if args.MQTTCAFile != "" || args.MQTTCertFile != "" {
+		tlsConfig, err := mqttTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	p.client = mqtt.NewClient(opts)
+	// With SetConnectRetry, this only fails for invalid options
+	token := p.client.Connect()
+	if token.WaitTimeout(mqttTimeout) && token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	return p, nil
+}
+
+func mqttTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if args.MQTTCAFile != "" {
+		ca, err := os.ReadFile(args.MQTTCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", args.MQTTCAFile)
+		}
+	}
+
+	if args.MQTTCertFile != "" {
+		if args.MQTTKeyFile == "" {
+			return nil, errors.New("--mqtt-cert requires --mqtt-key")
+		}
+		cert, err := tls.LoadX509KeyPair(args.MQTTCertFile, args.MQTTKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func (p *MQTTPublisher) topic(name string) string {
+	return p.prefix + "/" + name
+}
+
+// onConnect announces availability and (re-)sends the discovery configs, which brokers may have lost.
+func (p *MQTTPublisher) onConnect(client mqtt.Client) {
+	log.Println("MQTT connected")
+
+	p.publish(p.topic("status"), mqttOnline, true)
+	if p.discoveryPrefix != "" {
+		p.publishDiscovery()
+	}
+}
+
+// publishDiscovery sends a Home Assistant discovery config for every reading field.
+func (p *MQTTPublisher) publishDiscovery() {
+	var models []string
+	for _, d := range sensors {
+		models = append(models, d.Model())
+	}
+
+	device := map[string]any{
+		"identifiers":  []string{p.nodeID},
+		"name":         "ThermoServer " + args.MQTTClientID,
+		"model":        strings.Join(models, " + "),
+		"manufacturer": "ThermoServer",
+	}
+
+	for _, field := range discoveryFields {
+		config := map[string]any{
+			"name":               field.name,
+			"unique_id":          p.nodeID + "_" + field.key,
+			"state_topic":        p.topic("state"),
+			"value_template":     fmt.Sprintf("{{ value_json.%s }}", field.key),
+			"state_class":        "measurement",
+			"availability_topic": p.topic("status"),
+			"device":             device,
+		}
+		if field.unit != "" {
+			config["unit_of_measurement"] = field.unit
+		}
+		if field.deviceClass != "" {
+			config["device_class"] = field.deviceClass
+		}
+
+		payload, err := json.Marshal(config)
+		if err != nil {
+			log.Printf("Couldn't encode MQTT discovery config: %v\n", err)
+			continue
+		}
+
+		topic := fmt.Sprintf("%s/sensor/%s/%s/config", p.discoveryPrefix, p.nodeID, field.key)
+		p.publish(topic, payload, true)
+	}
+}
+
+// Publish sends a reading to the state topic.
+func (p *MQTTPublisher) Publish(r SensorReading) {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("Couldn't encode MQTT state: %v\n", err)
+		return
+	}
+
+	p.publish(p.topic("state"), payload, p.retain)
+}
+
+// publish sends a message without blocking the caller. Errors are logged.
+func (p *MQTTPublisher) publish(topic string, payload any, retain bool) {
+	token := p.client.Publish(topic, p.qos, retain, payload)
+	go func() {
+		if !token.WaitTimeout(mqttTimeout) {
+			log.Printf("MQTT publish to %s timed out\n", topic)
+		} else if err := token.Error(); err != nil {
+			log.Printf("MQTT publish to %s failed: %v\n", topic, err)
+		}
+	}()
+}
+
+// Close marks the publisher offline and disconnects from the broker.
+func (p *MQTTPublisher) Close() {
+	if p.client.IsConnected() {
+		p.client.Publish(p.topic("status"), 1, true, mqttOffline).WaitTimeout(mqttTimeout)
+	}
+	p.client.Disconnect(250)
+}
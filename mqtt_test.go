@@ -0,0 +1,223 @@
+package main
+
+import (
+	"ThermoServer/sensor"
+	"encoding/json"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mqttMessage is a message published to the fake broker.
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// fakeBroker is an in-process MQTT broker that records what its clients publish.
+// It applies the client's will if the connection breaks without a DISCONNECT.
+type fakeBroker struct {
+	listener net.Listener
+
+	mu           sync.Mutex
+	will         *mqttMessage
+	published    []mqttMessage
+	retained     map[string][]byte
+	disconnected bool
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("No local port for an MQTT broker: %v", err)
+	}
+	b := &fakeBroker{listener: l, retained: map[string][]byte{}}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			b.mu.Lock()
+			if b.will != nil {
+				b.store(*b.will)
+			}
+			b.mu.Unlock()
+			return
+		}
+
+		var reply packets.ControlPacket
+		b.mu.Lock()
+		switch p := packet.(type) {
+		case *packets.ConnectPacket:
+			b.will, b.disconnected = nil, false
+			if p.WillFlag {
+				b.will = &mqttMessage{p.WillTopic, p.WillMessage, p.WillRetain}
+			}
+			reply = packets.NewControlPacket(packets.Connack)
+		case *packets.PublishPacket:
+			b.store(mqttMessage{p.TopicName, p.Payload, p.Retain})
+			switch p.Qos {
+			case 1:
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				reply = ack
+			case 2:
+				rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				rec.MessageID = p.MessageID
+				reply = rec
+			}
+		case *packets.PubrelPacket:
+			comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			comp.MessageID = p.MessageID
+			reply = comp
+		case *packets.PingreqPacket:
+			reply = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			b.will, b.disconnected = nil, true
+		}
+		b.mu.Unlock()
+
+		if reply != nil {
+			if err := reply.Write(conn); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// store records a published message. b.mu must be held.
+func (b *fakeBroker) store(m mqttMessage) {
+	b.published = append(b.published, m)
+	if m.retain {
+		b.retained[m.topic] = m.payload
+	}
+}
+
+// await waits until cond, which is called with b.mu held, is true.
+func (b *fakeBroker) await(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		b.mu.Lock()
+		done := cond()
+		b.mu.Unlock()
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("broker didn't get %s", what)
+		}
+	}
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	b := newFakeBroker(t)
+
+	oldArgs, oldSensors := args, sensors
+	args.MQTTBroker, args.MQTTClientID, args.MQTTTopic = b.url(), "test.node", "thermoserver"
+	args.MQTTDiscoveryPrefix, args.MQTTQoS, args.MQTTRetain = "homeassistant", 1, false
+	sensors = []sensor.Driver{&fakeDriver{}}
+	t.Cleanup(func() {
+		args, sensors = oldArgs, oldSensors
+	})
+
+	p, err := NewMQTTPublisher()
+	if err != nil {
+		t.Fatalf("NewMQTTPublisher: %v", err)
+	}
+
+	// Availability is retained, with the will set to take it back
+	b.await(t, "the status", func() bool { return string(b.retained["thermoserver/status"]) == mqttOnline })
+	b.mu.Lock()
+	if w := b.will; w == nil || w.topic != "thermoserver/status" || string(w.payload) != mqttOffline || !w.retain {
+		t.Errorf("will = %+v, want offline retained on thermoserver/status", b.will)
+	}
+	b.mu.Unlock()
+
+	// Discovery configs are retained, so Home Assistant finds them whenever it starts
+	for _, field := range discoveryFields {
+		topic := "homeassistant/sensor/test_node/" + field.key + "/config"
+		var payload []byte
+		b.await(t, topic, func() bool {
+			payload = b.retained[topic]
+			return payload != nil
+		})
+
+		var config map[string]any
+		if err := json.Unmarshal(payload, &config); err != nil {
+			t.Fatalf("%s: %v", topic, err)
+		}
+		for key, want := range map[string]string{
+			"unique_id":          "test_node_" + field.key,
+			"state_topic":        "thermoserver/state",
+			"availability_topic": "thermoserver/status",
+			"value_template":     "{{ value_json." + field.key + " }}",
+		} {
+			if config[key] != want {
+				t.Errorf("%s: %s = %v, want %q", topic, key, config[key], want)
+			}
+		}
+	}
+
+	// Every reading set is published as state
+	c := NewCurrentReading()
+	c.OnSet(p.Publish)
+	temperatures := []float64{20.5, 21, 21.5}
+	for _, temperature := range temperatures {
+		c.Set(SensorReading{Temperature: temperature})
+	}
+
+	var states []mqttMessage
+	b.await(t, "every state", func() bool {
+		states = states[:0]
+		for _, m := range b.published {
+			if m.topic == "thermoserver/state" {
+				states = append(states, m)
+			}
+		}
+		return len(states) >= len(temperatures)
+	})
+	if len(states) != len(temperatures) {
+		t.Fatalf("%d states published for %d readings", len(states), len(temperatures))
+	}
+	for i, m := range states {
+		var r SensorReading
+		if err := json.Unmarshal(m.payload, &r); err != nil {
+			t.Fatalf("state %d: %v", i, err)
+		}
+		if r.Temperature != temperatures[i] || m.retain {
+			t.Errorf("state %d has temperature %.1f, retained %t, want %.1f not retained", i, r.Temperature, m.retain, temperatures[i])
+		}
+	}
+
+	// Closing takes availability back before disconnecting
+	p.Close()
+	b.await(t, "the disconnect", func() bool { return b.disconnected })
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if status := string(b.retained["thermoserver/status"]); status != mqttOffline {
+		t.Errorf("status = %q after Close, want %q", status, mqttOffline)
+	}
+}
@@ -0,0 +1,515 @@
+package scd4x
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"periph.io/x/conn/v3"
+	"periph.io/x/conn/v3/i2c"
+	"periph.io/x/conn/v3/physic"
+)
+
+// Addr is the fixed I²C address of all SCD4x sensors.
+const Addr uint16 = 0x62
+
+// command is a 16 bit SCD4x command along with the time the sensor needs to execute it.
+type command struct {
+	code  uint16
+	delay time.Duration
+	desc  string // used in error messages
+}
+
+// Supported commands, as per the datasheet.
+var (
+	cmdStartPeriodicMeasurement = command{0x21B1, PeriodicInterval, "start periodic measurement"} // wait for the first measurement
+	cmdStartLowPowerPeriodic    = command{0x21AC, 1 * time.Millisecond, "start low power periodic measurement"}
+	cmdMeasureSingleShot        = command{0x219D, SingleShotDuration, "measure single shot"}
+	cmdMeasureSingleShotRHT     = command{0x2196, SingleShotRHTDuration, "measure single shot rht only"}
+	cmdReadMeasurement          = command{0xEC05, 1 * time.Millisecond, "read measurement"}
+	cmdStopPeriodicMeasurement  = command{0x3F86, 500 * time.Millisecond, "stop periodic measurement"}
+	cmdSetAmbientPressure       = command{0xE000, 1 * time.Millisecond, "set ambient pressure"}
+	cmdGetAmbientPressure       = command{0xE000, 1 * time.Millisecond, "get ambient pressure"}
+	cmdPerformFRC               = command{0x362F, 400 * time.Millisecond, "perform forced recalibration"}
+	cmdSetTemperatureOffset     = command{0x241D, 1 * time.Millisecond, "set temperature offset"}
+	cmdGetTemperatureOffset     = command{0x2318, 1 * time.Millisecond, "get temperature offset"}
+	cmdSetSensorAltitude        = command{0x2427, 1 * time.Millisecond, "set sensor altitude"}
+	cmdGetSensorAltitude        = command{0x2322, 1 * time.Millisecond, "get sensor altitude"}
+	cmdSetASCEnabled            = command{0x2416, 1 * time.Millisecond, "set automatic self calibration enabled"}
+	cmdGetASCEnabled            = command{0x2313, 1 * time.Millisecond, "get automatic self calibration enabled"}
+	cmdPersistSettings          = command{0x3615, 800 * time.Millisecond, "persist settings"}
+	cmdGetDataReadyStatus       = command{0xE4B8, 1 * time.Millisecond, "get data ready status"}
+	cmdGetSensorVariant         = command{0x202F, 1 * time.Millisecond, "get sensor variant"}
+)
+
+// dataReadyMask selects the bits of get_data_ready_status that are 0 if no measurement is ready.
+const dataReadyMask = 0x07FF
+
+// variantShift selects the bits of get_sensor_variant that hold the variant.
+const variantShift = 12
+
+// frcFailed is returned by perform_forced_recalibration if the recalibration failed.
+const frcFailed = 0xFFFF
+
+const (
+	crc8Polynomial byte = 0x31
+	crc8Init       byte = 0xFF
+)
+
+// Ambient pressure range the SCD4x accepts for compensation, in hPa.
+const (
+	MinAmbientPressure = 700
+	MaxAmbientPressure = 1200
+)
+
+// Measurement timing, as per the datasheet.
+const (
+	PeriodicInterval         = 5 * time.Second
+	LowPowerPeriodicInterval = 30 * time.Second
+	SingleShotDuration       = 5 * time.Second
+	SingleShotRHTDuration    = 50 * time.Millisecond
+)
+
+// Setting ranges, as per the datasheet.
+const (
+	MaxTemperatureOffset = 20   // °C
+	MaxAltitude          = 3000 // m
+)
+
+// Variant is the model of an SCD4x sensor.
+type Variant uint8
+
+// Variants as reported by get_sensor_variant.
+const (
+	SCD40 Variant = 0b0000
+	SCD41 Variant = 0b0001
+	SCD43 Variant = 0b0101
+)
+
+func (v Variant) String() string {
+	switch v {
+	case SCD40:
+		return "SCD40"
+	case SCD41:
+		return "SCD41"
+	case SCD43:
+		return "SCD43"
+	}
+	return fmt.Sprintf("unknown SCD4x variant %#b", uint8(v))
+}
+
+// Measurement is a single reading of the SCD4x.
+type Measurement struct {
+	CO2         uint16 // ppm
+	Temperature physic.Temperature
+	Humidity    physic.RelativeHumidity
+}
+
+// Dev is a handle to an SCD4x device.
+type Dev struct {
+	d *i2c.Dev
+
+	// The sensor can't handle multiple commands at once
+	mu        sync.Mutex
+	periodic  *command // start command of the running periodic measurement, nil if idle
+	measuring bool     // a single shot measurement is running
+}
+
+// NewI2C returns an object that communicates with an SCD4x over I²C.
+//
+// The sensor is not touched until the first command is sent.
+func NewI2C(b i2c.Bus) (*Dev, error) {
+	return &Dev{d: &i2c.Dev{Bus: b, Addr: Addr}}, nil
+}
+
+func (d *Dev) String() string {
+	return fmt.Sprintf("SCD4x{%s}", d.d)
+}
+
+// StartPeriodicMeasurement starts a new measurement every 5 seconds.
+func (d *Dev) StartPeriodicMeasurement() error {
+	return d.startPeriodic(&cmdStartPeriodicMeasurement)
+}
+
+// StartLowPowerPeriodicMeasurement starts a new measurement every 30 seconds, which saves power.
+// Unlike StartPeriodicMeasurement, it doesn't wait for the first measurement.
+func (d *Dev) StartLowPowerPeriodicMeasurement() error {
+	return d.startPeriodic(&cmdStartLowPowerPeriodic)
+}
+
+func (d *Dev) startPeriodic(cmd *command) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.sendCommand(*cmd); err != nil {
+		return err
+	}
+	d.periodic = cmd
+	return nil
+}
+
+// StopPeriodicMeasurement stops periodic measurements.
+// Most configuration commands are only accepted while the sensor is idle.
+func (d *Dev) StopPeriodicMeasurement() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.sendCommand(cmdStopPeriodicMeasurement); err != nil {
+		return err
+	}
+	d.periodic = nil
+	return nil
+}
+
+// ReadMeasurement reads the latest measurement.
+// A measurement can only be read once; reading it again before the next one is ready fails.
+func (d *Dev) ReadMeasurement() (Measurement, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.readMeasurement()
+}
+
+// DataReady returns whether a new measurement can be read.
+func (d *Dev) DataReady() (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	words, err := d.readCommand(cmdGetDataReadyStatus, 1)
+	if err != nil {
+		return false, err
+	}
+	return words[0]&dataReadyMask != 0, nil
+}
+
+// MeasureSingleShot takes a single measurement, which takes 5 seconds.
+// Only the SCD41 supports this, and only while periodic measurement is stopped.
+func (d *Dev) MeasureSingleShot() (Measurement, error) {
+	return d.measureSingleShot(cmdMeasureSingleShot)
+}
+
+// MeasureSingleShotRHT takes a single measurement of only temperature and humidity, which takes 50ms.
+// The CO2 concentration is reported as 0. Only the SCD41 supports this, and only while periodic measurement is
+// stopped.
+func (d *Dev) MeasureSingleShotRHT() (Measurement, error) {
+	return d.measureSingleShot(cmdMeasureSingleShotRHT)
+}
+
+// measureSingleShot doesn't hold d.mu while the sensor measures, so Measuring can be called meanwhile.
+func (d *Dev) measureSingleShot(cmd command) (Measurement, error) {
+	d.mu.Lock()
+	if d.periodic != nil || d.measuring {
+		d.mu.Unlock()
+		return Measurement{}, d.formatError(cmd, errors.New("a measurement is running"))
+	}
+	if err := d.tx(cmd); err != nil {
+		d.mu.Unlock()
+		return Measurement{}, err
+	}
+	d.measuring = true
+	d.mu.Unlock()
+
+	time.Sleep(cmd.delay)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.measuring = false
+	return d.readMeasurement()
+}
+
+// Measuring returns whether a single shot measurement is running.
+// The sensor doesn't respond to other commands until it's done.
+func (d *Dev) Measuring() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.measuring
+}
+
+// Variant returns which SCD4x the sensor is. Older sensors may not support this.
+// Periodic measurement is stopped for this and restarted afterwards.
+func (d *Dev) Variant() (Variant, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var v Variant
+	err := d.whileIdle(func() error {
+		words, err := d.readCommand(cmdGetSensorVariant, 1)
+		if err != nil {
+			return err
+		}
+		v = Variant(words[0] >> variantShift)
+		return nil
+	})
+	return v, err
+}
+
+// readMeasurement must be called with d.mu lock held.
+func (d *Dev) readMeasurement() (Measurement, error) {
+	words, err := d.readCommand(cmdReadMeasurement, 3)
+	if err != nil {
+		return Measurement{}, err
+	}
+
+	tempComp := -45 + 175*float64(words[1])/65536
+	humidityComp := 100 * float64(words[2]) / 65536
+
+	return Measurement{
+		CO2:         words[0],
+		Temperature: physic.Temperature(tempComp*float64(physic.Celsius)) + physic.ZeroCelsius,
+		Humidity:    physic.RelativeHumidity(humidityComp * float64(physic.PercentRH)),
+	}, nil
+}
+
+// SetAmbientPressure makes the sensor compensate CO2 readings for the given ambient pressure in hPa.
+// It overrides any altitude compensation and can be sent during periodic measurements.
+func (d *Dev) SetAmbientPressure(hPa uint16) error {
+	if hPa < MinAmbientPressure || hPa > MaxAmbientPressure {
+		return fmt.Errorf("scd4x: ambient pressure %dhPa out of range", hPa)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.writeCommand(cmdSetAmbientPressure, hPa)
+}
+
+// AmbientPressure returns the ambient pressure in hPa the sensor currently compensates for.
+func (d *Dev) AmbientPressure() (uint16, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	words, err := d.readCommand(cmdGetAmbientPressure, 1)
+	if err != nil {
+		return 0, err
+	}
+	return words[0], nil
+}
+
+// PerformForcedRecalibration recalibrates the sensor to read targetPPM in its current environment and returns
+// the correction that was applied in ppm.
+//
+// The sensor should have been measuring for at least 3 minutes in air with a constant CO2 concentration of
+// targetPPM. Periodic measurement is stopped for the recalibration and restarted afterwards.
+func (d *Dev) PerformForcedRecalibration(targetPPM uint16) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var correction int
+	err := d.whileIdle(func() error {
+		if err := d.writeCommand(cmdPerformFRC, targetPPM); err != nil {
+			return err
+		}
+		words, err := d.readWords(cmdPerformFRC, 1)
+		if err != nil {
+			return err
+		}
+		if words[0] == frcFailed {
+			return d.formatError(cmdPerformFRC, errors.New("sensor reported failure"))
+		}
+		correction = int(words[0]) - 0x8000
+		return nil
+	})
+	return correction, err
+}
+
+// Settings are the sensor's configuration. Configure leaves nil fields alone.
+// Settings are kept in RAM until they are persisted.
+type Settings struct {
+	// TemperatureOffset is subtracted from temperature readings to make up for self-heating, in °C.
+	// It also affects humidity readings.
+	TemperatureOffset *float64
+	// Altitude in meters above sea level is used for CO2 compensation, unless an ambient pressure is set.
+	Altitude *uint16
+	// AutomaticSelfCalibration continuously recalibrates the sensor to the lowest CO2 concentration seen.
+	// It assumes the sensor sees fresh air regularly.
+	AutomaticSelfCalibration *bool
+}
+
+// Settings reads the sensor's configuration.
+// Periodic measurement is stopped for this and restarted afterwards.
+func (d *Dev) Settings() (Settings, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var s Settings
+	err := d.whileIdle(func() error {
+		words, err := d.readCommand(cmdGetTemperatureOffset, 1)
+		if err != nil {
+			return err
+		}
+		offset := 175 * float64(words[0]) / 65536
+		s.TemperatureOffset = &offset
+
+		if words, err = d.readCommand(cmdGetSensorAltitude, 1); err != nil {
+			return err
+		}
+		s.Altitude = &words[0]
+
+		if words, err = d.readCommand(cmdGetASCEnabled, 1); err != nil {
+			return err
+		}
+		asc := words[0] != 0
+		s.AutomaticSelfCalibration = &asc
+		return nil
+	})
+	return s, err
+}
+
+// Configure changes the settings that are set in s. With persist, all settings are written to EEPROM
+// afterwards, so they survive power cycles. The EEPROM only endures about 2000 writes.
+// Periodic measurement is stopped for this and restarted afterwards.
+func (d *Dev) Configure(s Settings, persist bool) error {
+	if s.TemperatureOffset != nil && (*s.TemperatureOffset < 0 || *s.TemperatureOffset > MaxTemperatureOffset) {
+		return fmt.Errorf("scd4x: temperature offset %g°C out of range", *s.TemperatureOffset)
+	}
+	if s.Altitude != nil && *s.Altitude > MaxAltitude {
+		return fmt.Errorf("scd4x: altitude %dm out of range", *s.Altitude)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.whileIdle(func() error {
+		if s.TemperatureOffset != nil {
+			word := uint16(math.Round(*s.TemperatureOffset * 65536 / 175))
+			if err := d.writeCommand(cmdSetTemperatureOffset, word); err != nil {
+				return err
+			}
+		}
+		if s.Altitude != nil {
+			if err := d.writeCommand(cmdSetSensorAltitude, *s.Altitude); err != nil {
+				return err
+			}
+		}
+		if s.AutomaticSelfCalibration != nil {
+			var word uint16
+			if *s.AutomaticSelfCalibration {
+				word = 1
+			}
+			if err := d.writeCommand(cmdSetASCEnabled, word); err != nil {
+				return err
+			}
+		}
+		if persist {
+			return d.sendCommand(cmdPersistSettings)
+		}
+		return nil
+	})
+}
+
+// whileIdle runs f with periodic measurement stopped, as most commands require, and restarts it afterwards.
+// If f succeeded but periodic measurement couldn't be restarted, it returns why.
+// It must be called with d.mu lock held.
+func (d *Dev) whileIdle(f func() error) (err error) {
+	if d.periodic != nil {
+		if err := d.sendCommand(cmdStopPeriodicMeasurement); err != nil {
+			return err
+		}
+		defer func() {
+			if restartErr := d.sendCommand(*d.periodic); restartErr != nil {
+				d.periodic = nil
+				if err == nil {
+					err = restartErr
+				}
+			}
+		}()
+	}
+	return f()
+}
+
+// Halt stops periodic measurements.
+func (d *Dev) Halt() error {
+	return d.StopPeriodicMeasurement()
+}
+
+// sendCommand sends a command without arguments.
+// It must be called with d.mu lock held.
+func (d *Dev) sendCommand(cmd command) error {
+	if err := d.tx(cmd); err != nil {
+		return err
+	}
+
+	time.Sleep(cmd.delay)
+	return nil
+}
+
+// tx sends a command without waiting for the sensor to execute it.
+// It must be called with d.mu lock held.
+func (d *Dev) tx(cmd command) error {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], cmd.code)
+	if err := d.d.Tx(b[:], nil); err != nil {
+		return d.formatError(cmd, err)
+	}
+	return nil
+}
+
+// writeCommand sends a command with a single argument word.
+// It must be called with d.mu lock held.
+func (d *Dev) writeCommand(cmd command, arg uint16) error {
+	var b [5]byte
+	binary.BigEndian.PutUint16(b[0:2], cmd.code)
+	binary.BigEndian.PutUint16(b[2:4], arg)
+	b[4] = crc8(b[2:4])
+	if err := d.d.Tx(b[:], nil); err != nil {
+		return d.formatError(cmd, err)
+	}
+
+	time.Sleep(cmd.delay)
+	return nil
+}
+
+// readCommand sends a command, waits for the sensor to execute it and reads n response words.
+// It must be called with d.mu lock held.
+func (d *Dev) readCommand(cmd command, n int) ([]uint16, error) {
+	if err := d.sendCommand(cmd); err != nil {
+		return nil, err
+	}
+	return d.readWords(cmd, n)
+}
+
+// readWords reads n response words and checks their CRCs.
+// It must be called with d.mu lock held.
+func (d *Dev) readWords(cmd command, n int) ([]uint16, error) {
+	r := make([]byte, 3*n)
+	if err := d.d.Tx(nil, r); err != nil {
+		return nil, d.formatError(cmd, err)
+	}
+
+	words := make([]uint16, n)
+	for i := range words {
+		word := r[3*i : 3*i+2]
+		if crc8(word) != r[3*i+2] {
+			return nil, d.formatError(cmd, errors.New("CRC mismatch"))
+		}
+		words[i] = binary.BigEndian.Uint16(word)
+	}
+	return words, nil
+}
+
+func (d *Dev) formatError(cmd command, err error) error {
+	return fmt.Errorf("scd4x: error while trying to %s: %v", cmd.desc, err)
+}
+
+// crc8 computes the checksum the SCD4x sends after and expects with every data word.
+// Adapted from the C example in the SCD4x datasheet.
+func crc8(data []byte) byte {
+	crc := crc8Init
+	for _, b := range data {
+		crc ^= b
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x80 != 0 {
+				crc = (crc << 1) ^ crc8Polynomial
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+var _ conn.Resource = &Dev{}
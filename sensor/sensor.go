@@ -0,0 +1,180 @@
+// Package sensor decouples ThermoServer from specific sensor chips.
+//
+// Every chip is wrapped in a Driver that declares the quantities it measures.
+// Drivers register a factory under a name, so which chips are used is a matter of
+// configuration. Readings of several drivers are merged according to Priorities.
+package sensor
+
+import (
+	"errors"
+	"fmt"
+	"periph.io/x/conn/v3/i2c"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Quantity is something a sensor measures.
+type Quantity string
+
+const (
+	Temperature Quantity = "temperature" // in °C
+	Humidity    Quantity = "humidity"    // relative humidity in %
+	Pressure    Quantity = "pressure"    // in hPa
+	CO2         Quantity = "co2"         // in ppm
+	Gas         Quantity = "gas"         // gas sensor resistance in Ω
+)
+
+// Quantities lists all known quantities.
+var Quantities = []Quantity{Temperature, Humidity, Pressure, CO2, Gas}
+
+// ParseQuantity returns the quantity with the given name.
+func ParseQuantity(name string) (Quantity, error) {
+	for _, q := range Quantities {
+		if string(q) == name {
+			return q, nil
+		}
+	}
+	return "", fmt.Errorf("sensor: unknown quantity %q", name)
+}
+
+// ErrNotReady is returned by Driver.Read if the sensor has no new measurement available yet.
+var ErrNotReady = errors.New("sensor: no measurement available yet")
+
+// ErrStopped is returned by Driver.Read if the sensor stopped measuring and has to be opened again.
+var ErrStopped = errors.New("sensor: stopped sensing")
+
+// Sample is one measurement of a driver.
+type Sample struct {
+	Time   time.Time
+	Values map[Quantity]float64
+
+	// Only meaningful if Values contains Gas.
+	GasValid   bool      // the gas measurement completed
+	HeatStable bool      // the heater reached its target temperature
+	GasProfile []float64 // gas resistances of every heater step in parallel mode
+}
+
+// Driver is a sensor chip.
+type Driver interface {
+	// Name is the name the driver was registered under.
+	Name() string
+	// Model is the chip's model name, e.g. "BME688".
+	Model() string
+	// Address is the chip's I²C address.
+	Address() uint16
+	// Quantities lists the quantities the driver's samples contain.
+	Quantities() []Quantity
+	// Read returns the latest measurement.
+	Read() (Sample, error)
+	// Halt stops the sensor.
+	Halt() error
+}
+
+// PressureCompensated is implemented by drivers whose readings depend on the ambient pressure.
+type PressureCompensated interface {
+	// CompensatePressure passes the ambient pressure in hPa to the sensor and returns
+	// the pressure its readings are currently compensated for, 0 if none.
+	CompensatePressure(hPa float64) float64
+}
+
+// Scheduled is implemented by drivers that measure on demand rather than continuously.
+type Scheduled interface {
+	// Schedule is called after every round of reads with the time of the next one,
+	// so the driver can have a measurement ready by then.
+	Schedule(next time.Time)
+}
+
+// Factory opens a driver on an I²C bus.
+type Factory func(bus i2c.Bus) (Driver, error)
+
+var (
+	mu        sync.Mutex
+	factories = map[string]Factory{}
+)
+
+// Register makes a driver available under name. It panics if name is already taken.
+func Register(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := factories[name]; ok {
+		panic("sensor: driver " + name + " registered twice")
+	}
+	factories[name] = factory
+}
+
+// Names returns the names of all registered drivers in alphabetical order.
+func Names() []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open opens the driver registered under name.
+func Open(name string, bus i2c.Bus) (Driver, error) {
+	mu.Lock()
+	factory, ok := factories[name]
+	mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("sensor: unknown driver %q", name)
+	}
+	return factory(bus)
+}
+
+// Priorities lists the names of the drivers each quantity is taken from, most preferred first.
+type Priorities map[Quantity][]string
+
+// DefaultPriorities returns priorities that take every quantity from the first of drivers that provides it.
+func DefaultPriorities(drivers []Driver) Priorities {
+	p := Priorities{}
+	for _, d := range drivers {
+		for _, q := range d.Quantities() {
+			p[q] = append(p[q], d.Name())
+		}
+	}
+	return p
+}
+
+// Merge combines the samples of several drivers, keyed by driver name, into one.
+// Every quantity is taken from the most preferred driver whose sample contains it.
+// Quantities no driver could provide are left out.
+// Merge also returns which driver each quantity was taken from.
+func Merge(samples map[string]Sample, p Priorities) (Sample, map[Quantity]string) {
+	merged := Sample{Values: map[Quantity]float64{}}
+	sources := map[Quantity]string{}
+
+	for q, names := range p {
+		for _, name := range names {
+			s, ok := samples[name]
+			if !ok {
+				continue
+			}
+			v, ok := s.Values[q]
+			if !ok {
+				continue
+			}
+
+			merged.Values[q] = v
+			sources[q] = name
+			if q == Gas {
+				merged.GasValid = s.GasValid
+				merged.HeatStable = s.HeatStable
+				merged.GasProfile = s.GasProfile
+			}
+			if s.Time.After(merged.Time) {
+				merged.Time = s.Time
+			}
+			break
+		}
+	}
+
+	return merged, sources
+}
@@ -0,0 +1,245 @@
+package sim
+
+import (
+	"ThermoServer/sensor"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault is something that can go wrong when reading a sensor.
+type Fault uint8
+
+const (
+	NoFault Fault = iota
+	// ReadError makes a read fail.
+	ReadError
+	// Stuck makes a read return the same values as the previous one.
+	Stuck
+	// Spike makes a read return one value far off the real one.
+	Spike
+)
+
+var faultNames = map[Fault]string{NoFault: "none", ReadError: "error", Stuck: "stuck", Spike: "spike"}
+
+func (f Fault) String() string {
+	if name, ok := faultNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("Fault(%d)", f)
+}
+
+// ParseFault returns the fault with the given name.
+func ParseFault(name string) (Fault, error) {
+	for f, n := range faultNames {
+		if n == name {
+			return f, nil
+		}
+	}
+	return NoFault, fmt.Errorf("sim: unknown fault %q, must be error, stuck or spike", name)
+}
+
+// ErrSimulated is returned by reads that fail because of a ReadError fault.
+var ErrSimulated = errors.New("sim: simulated read error")
+
+// FaultRates are the probabilities of faults happening on any read.
+type FaultRates map[Fault]float64
+
+// ParseFaultRates parses comma-separated fault=probability pairs, e.g. "error=0.05,spike=0.01".
+func ParseFaultRates(value string) (FaultRates, error) {
+	rates := FaultRates{}
+	for _, pair := range strings.Split(value, ",") {
+		name, probStr, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("sim: fault rate %q is not in fault=probability format", pair)
+		}
+
+		f, err := ParseFault(name)
+		if err != nil {
+			return nil, err
+		}
+		prob, err := strconv.ParseFloat(probStr, 64)
+		if err != nil || prob < 0 || prob > 1 {
+			return nil, fmt.Errorf("sim: invalid probability %q for fault %s", probStr, name)
+		}
+		rates[f] = prob
+	}
+	return rates, nil
+}
+
+// clock returns the time reads measure the environment at. Tests replace it to read at given times.
+var clock = time.Now
+
+// Device is a simulated sensor. It implements sensor.Driver.
+type Device struct {
+	name       string
+	model      string
+	address    uint16
+	quantities []sensor.Quantity
+	measure    func(t time.Time, rng *rand.Rand) sensor.Sample
+
+	mu       sync.Mutex
+	rng      *rand.Rand
+	rates    FaultRates
+	injected []Fault
+	last     sensor.Sample
+}
+
+func newDevice(seed int64, rates FaultRates) *Device {
+	return &Device{rng: rand.New(rand.NewSource(seed)), rates: rates}
+}
+
+func (d *Device) Name() string                  { return d.name }
+func (d *Device) Model() string                 { return d.model }
+func (d *Device) Address() uint16               { return d.address }
+func (d *Device) Quantities() []sensor.Quantity { return d.quantities }
+func (d *Device) Halt() error                   { return nil }
+
+// Inject makes the next n reads fail with f, regardless of the fault rates.
+func (d *Device) Inject(f Fault, n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		d.injected = append(d.injected, f)
+	}
+}
+
+// nextFault returns the fault the next read suffers from.
+func (d *Device) nextFault() Fault {
+	if len(d.injected) > 0 {
+		f := d.injected[0]
+		d.injected = d.injected[1:]
+		return f
+	}
+
+	p := d.rng.Float64()
+	for _, f := range []Fault{ReadError, Stuck, Spike} {
+		if p < d.rates[f] {
+			return f
+		}
+		p -= d.rates[f]
+	}
+	return NoFault
+}
+
+// Read measures the environment at the current time.
+func (d *Device) Read() (sensor.Sample, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := clock()
+
+	switch d.nextFault() {
+	case ReadError:
+		return sensor.Sample{}, ErrSimulated
+	case Stuck:
+		if !d.last.Time.IsZero() {
+			s := d.last
+			s.Time = now
+			return s, nil
+		}
+	case Spike:
+		s := d.measure(now, d.rng)
+		q := d.quantities[d.rng.Intn(len(d.quantities))]
+		s.Values[q] *= 1 + (d.rng.Float64()-0.5)*4 // up to 200% off
+		return s, nil
+	}
+
+	d.last = d.measure(now, d.rng)
+	return d.last, nil
+}
+
+// NewBME680 returns a simulated BME680. Without heater temperatures, it doesn't measure gas.
+// With more than one, it runs them as a BME688 heater profile.
+func NewBME680(env *Environment, seed int64, rates FaultRates, heaterTemps []uint16) *Device {
+	d := newDevice(seed, rates)
+	d.name = "bme680"
+	d.model = "BME680 (simulated)"
+	d.address = 0x76
+	d.quantities = []sensor.Quantity{sensor.Temperature, sensor.Pressure, sensor.Humidity}
+	if len(heaterTemps) > 0 {
+		d.quantities = append(d.quantities, sensor.Gas)
+	}
+	if len(heaterTemps) > 1 {
+		d.model = "BME688 (simulated)"
+	}
+
+	d.measure = func(t time.Time, rng *rand.Rand) sensor.Sample {
+		s := sensor.Sample{
+			Time: t,
+			Values: map[sensor.Quantity]float64{
+				sensor.Temperature: env.Temperature(t) + rng.NormFloat64()*0.02,
+				sensor.Pressure:    env.Pressure(t) + rng.NormFloat64()*0.05,
+				sensor.Humidity:    env.Humidity(t) + rng.NormFloat64()*0.2,
+			},
+		}
+		if len(heaterTemps) == 0 {
+			return s
+		}
+
+		// Hotter heaters burn off more gas and read lower resistances
+		gas := env.GasResistance(t)
+		for _, temp := range heaterTemps {
+			r := gas * math.Pow(320/math.Max(float64(temp), 100), 1.5) * (1 + rng.NormFloat64()*0.01)
+			s.GasProfile = append(s.GasProfile, r)
+		}
+		s.Values[sensor.Gas] = s.GasProfile[len(s.GasProfile)-1]
+		s.GasValid, s.HeatStable = true, true
+		if len(heaterTemps) == 1 {
+			s.GasProfile = nil
+		}
+		return s
+	}
+
+	return d
+}
+
+// SCD4x is a simulated SCD4x, which also takes the ambient pressure into account.
+type SCD4x struct {
+	*Device
+
+	pressure float64 // hPa
+}
+
+// NewSCD4x returns a simulated SCD4x.
+func NewSCD4x(env *Environment, seed int64, rates FaultRates) *SCD4x {
+	d := &SCD4x{Device: newDevice(seed, rates)}
+	d.name = "scd4x"
+	d.model = "SCD4x (simulated)"
+	d.address = 0x62
+	d.quantities = []sensor.Quantity{sensor.CO2, sensor.Temperature, sensor.Humidity}
+
+	d.measure = func(t time.Time, rng *rand.Rand) sensor.Sample {
+		co2 := env.CO2(t)
+		// Without compensation, the sensor assumes sea level pressure
+		if d.pressure == 0 {
+			co2 *= 1013.25 / env.Pressure(t)
+		}
+
+		return sensor.Sample{
+			Time: t,
+			Values: map[sensor.Quantity]float64{
+				sensor.CO2:         math.Round(co2 + rng.NormFloat64()*5),
+				sensor.Temperature: env.Temperature(t) + 0.6 + rng.NormFloat64()*0.05, // self-heating
+				sensor.Humidity:    env.Humidity(t) - 2 + rng.NormFloat64()*0.3,
+			},
+		}
+	}
+
+	return d
+}
+
+// CompensatePressure stores the ambient pressure as the real SCD4x would.
+func (d *SCD4x) CompensatePressure(hPa float64) float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.pressure = math.Round(hPa)
+	return d.pressure
+}
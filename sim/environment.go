@@ -0,0 +1,146 @@
+// Package sim simulates sensors so ThermoServer can run without hardware.
+//
+// All simulated sensors measure the same Environment, a model of an office-sized room
+// with a day/night temperature cycle, people coming and going, and passing weather fronts.
+// Given the same seed and start time, an Environment always develops the same way.
+package sim
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	outdoorCO2 = 420.0 // ppm
+
+	// co2PerPerson is how fast one person raises the CO2 concentration of the room in ppm per hour.
+	// A person exhales about 18 l of CO2 per hour into about 50 m³ of air.
+	co2PerPerson = 360.0
+	// airChanges is how often per hour the room's air is exchanged with outdoor air.
+	airChanges = 1.0
+
+	co2Step = time.Minute // integration step of the CO2 concentration
+
+	// occupancySlot is how long the number of people in the room stays the same.
+	occupancySlot = 15 * time.Minute
+	maxPeople     = 4
+)
+
+// front is a sinusoidal pressure change, which is what passing weather systems look like from indoors.
+type front struct {
+	amplitude float64 // hPa
+	period    time.Duration
+	phase     float64
+}
+
+// Environment is a simulated room.
+type Environment struct {
+	seed   int64
+	start  time.Time
+	fronts []front
+
+	mu      sync.Mutex
+	co2     float64
+	co2Time time.Time
+}
+
+// NewEnvironment returns a room that starts developing at start.
+func NewEnvironment(seed int64, start time.Time) *Environment {
+	rng := rand.New(rand.NewSource(seed))
+
+	e := &Environment{
+		seed:    seed,
+		start:   start,
+		co2:     outdoorCO2 + 100*rng.Float64(),
+		co2Time: start,
+	}
+	for i := 0; i < 3; i++ {
+		e.fronts = append(e.fronts, front{
+			amplitude: 3 + 5*rng.Float64(),
+			period:    time.Duration((2 + 4*rng.Float64()) * float64(24*time.Hour)),
+			phase:     2 * math.Pi * rng.Float64(),
+		})
+	}
+
+	return e
+}
+
+// People returns the number of people in the room at t.
+// The room is busiest on weekday afternoons and empty at night.
+func (e *Environment) People(t time.Time) int {
+	t = t.Local()
+	hour := float64(t.Hour()) + float64(t.Minute())/60
+
+	var busy float64
+	switch {
+	case hour < 7 || hour >= 22:
+		return 0
+	case hour >= 8 && hour < 18:
+		busy = 0.8
+	default:
+		busy = 0.2
+	}
+	if t.Weekday() == time.Saturday || t.Weekday() == time.Sunday {
+		busy /= 4
+	}
+
+	// Every slot gets its own, but reproducible, chance of people being around
+	slot := uint64(t.Unix() / int64(occupancySlot/time.Second))
+	chance := float64(splitmix64(uint64(e.seed)^slot)>>11) / (1 << 53)
+	return int(math.Round(busy * chance * maxPeople))
+}
+
+// Temperature returns the air temperature in °C at t, which peaks in the afternoon.
+func (e *Environment) Temperature(t time.Time) float64 {
+	hour := float64(t.Local().Hour()) + float64(t.Local().Minute())/60
+	return 21 + 2*math.Sin(2*math.Pi*(hour-9)/24) + 0.3*float64(e.People(t))
+}
+
+// Humidity returns the relative humidity in % at t. Warmer air is drier, people add moisture.
+func (e *Environment) Humidity(t time.Time) float64 {
+	rh := 45 - 2*(e.Temperature(t)-21) + 2*float64(e.People(t))
+	return math.Max(20, math.Min(80, rh))
+}
+
+// Pressure returns the air pressure in hPa at t.
+func (e *Environment) Pressure(t time.Time) float64 {
+	p := 1013.25
+	for _, f := range e.fronts {
+		p += f.amplitude * math.Sin(2*math.Pi*float64(t.Sub(e.start))/float64(f.period)+f.phase)
+	}
+	return p
+}
+
+// CO2 returns the CO2 concentration in ppm at t, which rises while people are in the room
+// and decays towards the outdoor concentration while it's empty.
+//
+// The concentration is integrated over time, so it can't go back: times before the last
+// queried one return the last concentration.
+func (e *Environment) CO2(t time.Time) float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	hours := co2Step.Hours()
+	for !e.co2Time.Add(co2Step).After(t) {
+		people := float64(e.People(e.co2Time))
+		e.co2 += (people*co2PerPerson - airChanges*(e.co2-outdoorCO2)) * hours
+		e.co2Time = e.co2Time.Add(co2Step)
+	}
+	return e.co2
+}
+
+// GasResistance returns the resistance in Ω of a MOX gas sensor heated to 320 °C at t.
+// People emit VOCs, which lower the resistance, as does humid air.
+func (e *Environment) GasResistance(t time.Time) float64 {
+	return 150000 * math.Exp(-0.25*float64(e.People(t))) * math.Exp(-0.03*(e.Humidity(t)-40))
+}
+
+// splitmix64 scrambles x into a well-distributed pseudo-random number.
+func splitmix64(x uint64) uint64 {
+	x += 0x9E3779B97F4A7C15
+	x = (x ^ (x >> 30)) * 0xBF58476D1CE4E5B9
+	x = (x ^ (x >> 27)) * 0x94D049BB133111EB
+	return x ^ (x >> 31)
+}
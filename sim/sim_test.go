@@ -0,0 +1,110 @@
+package sim
+
+import (
+	"ThermoServer/sensor"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2024, 3, 4, 6, 0, 0, 0, time.UTC)
+
+// read is the result of a single read.
+type read struct {
+	sample sensor.Sample
+	err    error
+}
+
+// readSeries reads d once a minute for n minutes from start.
+func readSeries(t *testing.T, d *Device, start time.Time, n int) []read {
+	oldClock := clock
+	t.Cleanup(func() { clock = oldClock })
+
+	series := make([]read, n)
+	for i := range series {
+		now := start.Add(time.Duration(i) * time.Minute)
+		clock = func() time.Time { return now }
+		series[i].sample, series[i].err = d.Read()
+	}
+	return series
+}
+
+func TestDeterminism(t *testing.T) {
+	rates := FaultRates{ReadError: 0.1, Stuck: 0.1, Spike: 0.1}
+	series := func(seed int64) []read {
+		env := NewEnvironment(seed, testStart)
+		bme := readSeries(t, NewBME680(env, seed+1, rates, []uint16{200, 320}), testStart, 24*60)
+		scd := readSeries(t, NewSCD4x(env, seed+2, rates).Device, testStart, 24*60)
+		return append(bme, scd...)
+	}
+
+	first := series(42)
+	if !reflect.DeepEqual(first, series(42)) {
+		t.Errorf("a day of reads differs between runs with the same seed")
+	}
+	if reflect.DeepEqual(first, series(43)) {
+		t.Errorf("a day of reads is the same with another seed")
+	}
+}
+
+func TestFaultRates(t *testing.T) {
+	rates := FaultRates{ReadError: 0.1, Stuck: 0.05, Spike: 0.02}
+	env := NewEnvironment(1, testStart)
+	const n = 50000
+
+	// Noise is far below the thresholds, spikes are far above them in all but a few cases
+	spiked := func(s sensor.Sample) bool {
+		return math.Abs(s.Values[sensor.Temperature]-env.Temperature(s.Time)) > 0.2 ||
+			math.Abs(s.Values[sensor.Pressure]-env.Pressure(s.Time)) > 0.5 ||
+			math.Abs(s.Values[sensor.Humidity]-env.Humidity(s.Time)) > 2
+	}
+
+	counts := map[Fault]int{}
+	var last sensor.Sample
+	for _, r := range readSeries(t, NewBME680(env, 1, rates, nil), testStart, n) {
+		switch {
+		case r.err != nil:
+			if !errors.Is(r.err, ErrSimulated) {
+				t.Fatalf("Read: %v, want a simulated error", r.err)
+			}
+			counts[ReadError]++
+		case last.Values != nil && reflect.DeepEqual(r.sample.Values, last.Values):
+			counts[Stuck]++
+		case spiked(r.sample):
+			counts[Spike]++
+		default:
+			last = r.sample
+		}
+	}
+
+	for f, rate := range rates {
+		if want := rate * n; math.Abs(float64(counts[f])-want) > 0.1*want {
+			t.Errorf("%d reads of %d suffered from %s, want about %.0f", counts[f], n, f, want)
+		}
+	}
+}
+
+func TestInject(t *testing.T) {
+	d := NewSCD4x(NewEnvironment(1, testStart), 1, nil)
+	d.Inject(Stuck, 1)
+	d.Inject(ReadError, 2)
+
+	series := readSeries(t, d.Device, testStart.Add(12*time.Hour), 5)
+
+	// Nothing to be stuck on yet
+	if series[0].err != nil {
+		t.Fatalf("first read: %v", series[0].err)
+	}
+	for i, r := range series[1:3] {
+		if !errors.Is(r.err, ErrSimulated) {
+			t.Errorf("read %d after injecting errors: %v, want a simulated error", i+2, r.err)
+		}
+	}
+	for i, r := range series[3:] {
+		if r.err != nil || reflect.DeepEqual(r.sample.Values, series[0].sample.Values) {
+			t.Errorf("read %d after the injected faults = %v, %v, want a new sample", i+4, r.sample.Values, r.err)
+		}
+	}
+}
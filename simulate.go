@@ -0,0 +1,65 @@
+package main
+
+import (
+	"ThermoServer/sensor"
+	"ThermoServer/sim"
+	"fmt"
+	"log"
+	"time"
+)
+
+// simEnv is the simulated room measured by all sensors in --simulate mode.
+var simEnv *sim.Environment
+
+// setupSimulation creates the simulated room. Without --simulate-seed, a random seed is used and logged,
+// so interesting runs can be repeated.
+func setupSimulation() {
+	if args.SimulateSeed == 0 {
+		args.SimulateSeed = time.Now().UnixNano()
+	}
+	log.Printf("Simulating sensors with seed %d\n", args.SimulateSeed)
+
+	simEnv = sim.NewEnvironment(args.SimulateSeed, time.Now())
+}
+
+// openSimSensor returns a simulated version of the sensor registered under name. Each time a sensor is
+// opened again gets a new seed, so it doesn't replay the faults it was opened again for.
+func openSimSensor(name string, attempt int64) (sensor.Driver, error) {
+	rates := sim.FaultRates(args.SimulateFaults)
+
+	switch name {
+	case "bme680":
+		var heaterTemps []uint16
+		if len(args.HeaterProfile) > 0 {
+			for _, step := range args.HeaterProfile {
+				heaterTemps = append(heaterTemps, step.Temp)
+			}
+		} else if args.HeaterTemp != 0 {
+			heaterTemps = []uint16{args.HeaterTemp}
+		}
+		return sim.NewBME680(simEnv, args.SimulateSeed+2*attempt+1, rates, heaterTemps), nil
+	case "scd4x":
+		return sim.NewSCD4x(simEnv, args.SimulateSeed+2*attempt+2, rates), nil
+	default:
+		return nil, fmt.Errorf("sensor %s can't be simulated", name)
+	}
+}
+
+// injectFault makes the next count reads of a simulated sensor fail with fault.
+func injectFault(name string, fault sim.Fault, count int) error {
+	for _, d := range sensors {
+		if d.Name() != name {
+			continue
+		}
+		if s, ok := d.(*supervisedSensor); ok {
+			d = s.Driver()
+		}
+		injector, ok := d.(interface{ Inject(sim.Fault, int) })
+		if !ok {
+			return fmt.Errorf("sensor %s isn't simulated", name)
+		}
+		injector.Inject(fault, count)
+		return nil
+	}
+	return fmt.Errorf("sensor %s isn't in use", name)
+}
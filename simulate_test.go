@@ -0,0 +1,101 @@
+package main
+
+import (
+	"ThermoServer/iaq"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// getJSON fetches path from srv and decodes the JSON response into v.
+func getJSON(t *testing.T, srv *httptest.Server, path string, v any) int {
+	t.Helper()
+
+	res, err := http.Get(srv.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer res.Body.Close()
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	return res.StatusCode
+}
+
+func TestSimulatedServer(t *testing.T) {
+	oldArgs, oldSensors, oldStats := args, sensors, sensorStats
+	oldCurrent, oldEnv, oldEstimator := current, simEnv, iaqEstimator
+	args = ProgramArgs{
+		Sensors:    []string{"bme680", "scd4x"},
+		Interval:   10,
+		StaleAfter: time.Minute,
+		HeaterTemp: 320,
+
+		Simulate:     true,
+		SimulateSeed: 42,
+	}
+	sensors, sensorStats = nil, map[string]*SensorStats{}
+	current, iaqEstimator = NewCurrentReading(), iaq.NewEstimator()
+	t.Cleanup(func() {
+		args, sensors, sensorStats = oldArgs, oldSensors, oldStats
+		current, simEnv, iaqEstimator = oldCurrent, oldEnv, oldEstimator
+	})
+
+	setupSimulation()
+	openSensors(nil)
+	priorities := sourcePriorities()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", readingHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// Not ready until the first reading
+	var h Health
+	if status := getJSON(t, srv, "/readyz", &h); status != http.StatusServiceUnavailable || h.Status != HealthDown {
+		t.Errorf("/readyz before the first reading = %d, %s, want 503, down", status, h.Status)
+	}
+
+	takeReading(priorities, time.Time{})
+
+	if status := getJSON(t, srv, "/readyz", &h); status != http.StatusOK || h.Status != HealthOK {
+		t.Errorf("/readyz after the first reading = %d, %+v, want 200, ok", status, h)
+	}
+	for _, name := range []string{"readings", "bme680", "scd4x"} {
+		if c, ok := h.Components[name]; !ok || c.LastRead == "" {
+			t.Errorf("/readyz component %s = %+v, want read", name, c)
+		}
+	}
+
+	var r SensorReading
+	if status := getJSON(t, srv, "/", &r); status != http.StatusOK {
+		t.Fatalf("/ = %d", status)
+	}
+	if r.Temperature < 15 || r.Temperature > 30 || r.Pressure < 950 || r.Pressure > 1070 || r.Humidity < 20 || r.Humidity > 80 {
+		t.Errorf("/ = %.1f°C, %.1f hPa, %.1f%%, want a room's climate", r.Temperature, r.Pressure, r.Humidity)
+	}
+	if r.CO2 < 400 || r.GasResistance <= 0 || !r.GasValid || !r.HeatStable {
+		t.Errorf("/ = %d ppm CO2, %.0fΩ gas valid %t heat stable %t, want CO2 and a usable gas reading", r.CO2, r.GasResistance, r.GasValid, r.HeatStable)
+	}
+	if iaq.Accuracy(r.IAQAccuracy) != iaq.Stabilizing {
+		t.Errorf("IAQ accuracy = %s on the first reading, want stabilizing", iaq.Accuracy(r.IAQAccuracy))
+	}
+	for field, source := range map[string]string{"temperature": "bme680", "humidity": "bme680", "co2": "scd4x", "gasResistance": "bme680"} {
+		if r.Sources[field] != source {
+			t.Errorf("%s taken from %q, want %s", field, r.Sources[field], source)
+		}
+	}
+	for name, s := range r.Sensors {
+		if s.State != SensorOK {
+			t.Errorf("sensor %s is %s, want ok", name, s.State)
+		}
+	}
+
+	// Simulated readings follow the same room
+	if want := simEnv.Pressure(time.Now()); r.Pressure < want-1 || r.Pressure > want+1 {
+		t.Errorf("pressure = %.2f hPa, the room has %.2f hPa", r.Pressure, want)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"ThermoServer/tsdb"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// readingStore persists readings to disk if --store-dir is set.
+var readingStore *tsdb.DB
+
+func openStore() {
+	opts := tsdb.Options{
+		RawRetention:    args.StoreRetention,
+		MinuteRetention: args.StoreRetention1m,
+		HourRetention:   args.StoreRetention1h,
+		MaxSize:         int64(args.StoreMaxSize) << 20,
+	}
+
+	db, err := tsdb.Open(args.StoreDir, len(aggregatedFields), opts)
+	if err != nil {
+		log.Fatalf("Couldn't open reading store: %v", err)
+	}
+	readingStore = db
+}
+
+func closeStore() {
+	if readingStore == nil {
+		return
+	}
+	if err := readingStore.Close(); err != nil {
+		log.Printf("Couldn't close reading store: %v\n", err)
+	}
+}
+
+func storeReading(r SensorReading) {
+	if readingStore == nil {
+		return
+	}
+
+	values := make([]float64, len(aggregatedFields))
+	for i, field := range aggregatedFields {
+		values[i] = field.get(&r)
+	}
+
+	if err := readingStore.Append(r.Updated, values); errors.Is(err, tsdb.ErrOutOfOrder) {
+		log.Println("Clock went backwards, not storing reading")
+	} else if err != nil {
+		log.Printf("Couldn't store reading: %v\n", err)
+	}
+}
+
+// FieldAggregate is the JSON form of one field of a rollup.
+type FieldAggregate struct {
+	Mean float64 `json:"mean"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+}
+
+// storeHandler serves /store?tier=…&from=…&to=…
+//
+// tier is raw (the default), 1m or 1h. from and to work like they do for /history.
+func storeHandler(w http.ResponseWriter, r *http.Request) {
+	if readingStore == nil {
+		http.Error(w, "reading store is disabled, see --store-dir", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	from, to, err := parseTimeRange(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var rows []map[string]any
+
+	switch tier := tsdb.Tier(query.Get("tier")); tier {
+	case "", tsdb.Raw:
+		records, err := readingStore.Raw(from, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rows = make([]map[string]any, len(records))
+		for i, rec := range records {
+			row := map[string]any{"updated": formatUpdated(rec.Time)}
+			for j, field := range aggregatedFields {
+				row[field.name] = rec.Values[j]
+			}
+			rows[i] = row
+		}
+	case tsdb.Minute, tsdb.Hour:
+		aggs, err := readingStore.Rollups(tier, from, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rows = make([]map[string]any, len(aggs))
+		for i, agg := range aggs {
+			row := map[string]any{"updated": formatUpdated(agg.Time), "count": agg.Count}
+			for j, field := range aggregatedFields {
+				row[field.name] = FieldAggregate{Mean: agg.Mean[j], Min: agg.Min[j], Max: agg.Max[j]}
+			}
+			rows[i] = row
+		}
+	default:
+		http.Error(w, fmt.Sprintf("invalid tier %q, must be raw, 1m, or 1h", tier), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, rows)
+}
+
+func formatUpdated(t time.Time) string {
+	return NewSensorReading(t).UpdatedStr
+}
@@ -1,6 +1,12 @@
 package main
 
 import (
+	"ThermoServer/bme680"
+	"ThermoServer/sim"
+	"fmt"
+	"periph.io/x/conn/v3/physic"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -9,7 +15,24 @@ type SensorReading struct {
 	Pressure    float64 `json:"pressure"`
 	Humidity    float64 `json:"humidity"`
 	//HumidityBME float64   `json:"humidityBME"`
-	CO2        uint16    `json:"co2"`
+	CO2           uint16    `json:"co2"`
+	CO2Pressure   uint16    `json:"co2Pressure"` // ambient pressure in hPa the CO2 reading is compensated for, 0 if none
+	GasResistance float64   `json:"gasResistance"`
+	GasValid      bool      `json:"gasValid"`
+	HeatStable    bool      `json:"heatStable"`
+	GasProfile    []float64 `json:"gasProfile,omitempty"`
+	IAQ           float64   `json:"iaq"`
+	IAQAccuracy   uint8     `json:"iaqAccuracy"`
+
+	// Sources maps the keys of measured fields to the sensor they were taken from
+	Sources map[string]string `json:"sources,omitempty"`
+	// Stale maps the keys of fields that haven't been measured for --stale-after to when they last were
+	Stale map[string]string `json:"stale,omitempty"`
+	// Sensors holds the state of every sensor
+	Sensors map[string]SensorStatus `json:"sensors,omitempty"`
+
+	Measured map[string]time.Time `json:"-"` // when each measured field was taken
+
 	Updated    time.Time `json:"-"`
 	UpdatedStr string    `json:"updated"`
 }
@@ -17,6 +40,118 @@ type SensorReading struct {
 func NewSensorReading(date time.Time) SensorReading {
 	return SensorReading{
 		Updated:    date,
-		UpdatedStr: date.Format("2006-01-02 15:04:05"), // ISO 8601 without timezone
+		UpdatedStr: date.Format(TimeFormat),
+	}
+}
+
+// gasUsable returns whether the gas resistance can go into the IAQ estimate, which needs the measurement to
+// have completed with the heater at its target temperature.
+func (r SensorReading) gasUsable() bool {
+	return r.GasValid && r.HeatStable
+}
+
+// TimeFormat is ISO 8601 without timezone.
+const TimeFormat = "2006-01-02 15:04:05"
+
+// SensorStatus is the state of a sensor at the time of a reading.
+type SensorStatus struct {
+	State    SensorState `json:"state"`
+	LastRead string      `json:"lastRead,omitempty"` // time of the last successful read
+	Error    string      `json:"error,omitempty"`    // why the latest read failed
+}
+
+// Health is the body of /healthz and /readyz.
+type Health struct {
+	Status     HealthStatus               `json:"status"`
+	Components map[string]ComponentHealth `json:"components"` // the reading loop and every sensor
+}
+
+// ComponentHealth is the health of the reading loop or a sensor.
+type ComponentHealth struct {
+	Status   HealthStatus `json:"status"`
+	State    SensorState  `json:"state,omitempty"`    // the sensor's recovery state
+	LastRead string       `json:"lastRead,omitempty"` // time of the last reading or successful read
+	Detail   string       `json:"detail,omitempty"`   // why the component isn't ok
+}
+
+// SelfTestResult is the outcome of the BME680 self-test.
+type SelfTestResult struct {
+	Passed       bool                  `json:"passed"`
+	Failures     []string              `json:"failures"`
+	GasRatio     float64               `json:"gasRatio"` // gas resistance at the low heater temperature relative to the high one
+	Measurements []SelfTestMeasurement `json:"measurements"`
+}
+
+type SelfTestMeasurement struct {
+	HeaterTemp    uint16  `json:"heaterTemp"`
+	Temperature   float64 `json:"temperature"`
+	Pressure      float64 `json:"pressure"`
+	Humidity      float64 `json:"humidity"`
+	GasResistance float64 `json:"gasResistance"`
+	GasValid      bool    `json:"gasValid"`
+	HeatStable    bool    `json:"heatStable"`
+}
+
+func NewSelfTestResult(report *bme680.SelfTestReport) SelfTestResult {
+	result := SelfTestResult{
+		Passed:   report.Passed(),
+		Failures: append([]string{}, report.Failures...),
+		GasRatio: report.GasRatio,
+	}
+	for i, m := range report.Measurements {
+		result.Measurements = append(result.Measurements, SelfTestMeasurement{
+			HeaterTemp:    report.HeaterTemps[i],
+			Temperature:   m.Temperature.Celsius(),
+			Pressure:      float64(m.Pressure) / float64(HectoPascal),
+			Humidity:      float64(m.Humidity) / float64(physic.PercentRH),
+			GasResistance: float64(m.GasResistance) / float64(physic.Ohm),
+			GasValid:      m.GasValid,
+			HeatStable:    m.HeatStable,
+		})
+	}
+	return result
+}
+
+// SCDSettings are the SCD4x settings that can be changed at runtime. Fields that are left out aren't changed.
+type SCDSettings struct {
+	TemperatureOffset *float64 `json:"temperatureOffset,omitempty"` // °C
+	Altitude          *uint16  `json:"altitude,omitempty"`          // m
+	ASC               *bool    `json:"asc,omitempty"`
+	Persist           bool     `json:"persist,omitempty"` // write the settings to the sensor's EEPROM
+}
+
+// HeaterProfile is a BME688 heater profile given as comma-separated temp:cycles steps.
+type HeaterProfile []bme680.HeaterStep
+
+func (p *HeaterProfile) UnmarshalFlag(value string) error {
+	for _, step := range strings.Split(value, ",") {
+		tempStr, cyclesStr, found := strings.Cut(step, ":")
+		if !found {
+			return fmt.Errorf("heater step %q is not in temp:cycles format", step)
+		}
+
+		temp, err := strconv.ParseUint(tempStr, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid heater temperature %q: %v", tempStr, err)
+		}
+		cycles, err := strconv.ParseUint(cyclesStr, 10, 8)
+		if err != nil {
+			return fmt.Errorf("invalid heater cycle count %q: %v", cyclesStr, err)
+		}
+
+		*p = append(*p, bme680.HeaterStep{Temp: uint16(temp), Cycles: uint8(cycles)})
+	}
+	return nil
+}
+
+// FaultRates are the probabilities of simulated faults given as comma-separated fault=probability pairs.
+type FaultRates sim.FaultRates
+
+func (r *FaultRates) UnmarshalFlag(value string) error {
+	rates, err := sim.ParseFaultRates(value)
+	if err != nil {
+		return err
 	}
+	*r = FaultRates(rates)
+	return nil
 }
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"ThermoServer/bme680"
+	"ThermoServer/scd4x"
+	"ThermoServer/sensor"
+	"errors"
+	"log"
+	"periph.io/x/conn/v3/i2c"
+	"periph.io/x/conn/v3/i2c/i2creg"
+	"sync"
+	"time"
+)
+
+// SensorState is where a sensor is in its recovery cycle.
+type SensorState string
+
+const (
+	SensorOK         SensorState = "ok"         // the latest read succeeded
+	SensorDegraded   SensorState = "degraded"   // the latest reads failed, but not enough of them to give up on the sensor
+	SensorFailed     SensorState = "failed"     // the sensor couldn't be opened again and is retried after a backoff
+	SensorRecovering SensorState = "recovering" // the sensor is being opened again or hasn't been read since
+)
+
+// MinSensorBackoff is the wait before the first attempt to open a sensor again.
+var MinSensorBackoff = 1 * time.Second
+
+// supervisedSensor wraps a driver and opens it again, on a new I²C bus handle, once it stopped sensing or
+// failed --sensor-max-failures reads in a row. Failed attempts are retried with exponential backoff.
+type supervisedSensor struct {
+	name       string
+	model      string
+	address    uint16
+	quantities []sensor.Quantity
+	open       func() (sensor.Driver, i2c.BusCloser, error)
+
+	mu       sync.Mutex
+	driver   sensor.Driver // nil while recovering
+	bus      i2c.BusCloser // the bus the driver was opened on during recovery, nil for the shared one
+	state    SensorState
+	failures int           // consecutive failed reads
+	backoff  time.Duration // wait before the next attempt to open the sensor
+	halted   bool
+}
+
+func newSupervisedSensor(d sensor.Driver, open func() (sensor.Driver, i2c.BusCloser, error)) *supervisedSensor {
+	return &supervisedSensor{
+		name:       d.Name(),
+		model:      d.Model(),
+		address:    d.Address(),
+		quantities: d.Quantities(),
+		open:       open,
+		driver:     d,
+		state:      SensorOK,
+	}
+}
+
+// openSupervised returns how a sensor is opened again: on a new handle of the I²C bus, or simulated.
+func openSupervised(name string) func() (sensor.Driver, i2c.BusCloser, error) {
+	var attempts int64 // only called from one recovery at a time
+	return func() (sensor.Driver, i2c.BusCloser, error) {
+		if args.Simulate {
+			attempts++
+			d, err := openSimSensor(name, attempts)
+			return d, nil, err
+		}
+
+		bus, err := i2creg.Open(args.I2CDevice)
+		if err != nil {
+			return nil, nil, err
+		}
+		d, err := sensor.Open(name, bus)
+		if err != nil {
+			bus.Close()
+			return nil, nil, err
+		}
+		return d, bus, nil
+	}
+}
+
+func (s *supervisedSensor) Name() string                  { return s.name }
+func (s *supervisedSensor) Model() string                 { return s.model }
+func (s *supervisedSensor) Address() uint16               { return s.address }
+func (s *supervisedSensor) Quantities() []sensor.Quantity { return s.quantities }
+
+// Driver returns the driver currently in use, nil while the sensor is recovering.
+func (s *supervisedSensor) Driver() sensor.Driver {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.driver
+}
+
+// State returns the sensor's state.
+func (s *supervisedSensor) State() SensorState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.state
+}
+
+// Read reads the driver and keeps track of its state. While recovering, it returns sensor.ErrNotReady.
+func (s *supervisedSensor) Read() (sensor.Sample, error) {
+	d := s.Driver()
+	if d == nil {
+		return sensor.Sample{}, sensor.ErrNotReady
+	}
+
+	sample, err := d.Read()
+	if errors.Is(err, sensor.ErrNotReady) {
+		return sample, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.driver != d {
+		return sensor.Sample{}, sensor.ErrNotReady // the sensor was halted meanwhile
+	}
+	if err == nil {
+		s.state, s.failures, s.backoff = SensorOK, 0, 0
+		return sample, nil
+	}
+
+	s.failures++
+	s.state = SensorDegraded
+	if errors.Is(err, sensor.ErrStopped) || s.failures >= int(args.MaxFailures) {
+		log.Printf("%s failed %d reads in a row, opening it again\n", s.model, s.failures)
+		s.driver, s.state = nil, SensorRecovering
+		go s.recover(d)
+	}
+	return sensor.Sample{}, err
+}
+
+// recover halts the failed driver and opens the sensor again until it succeeds or the sensor is halted.
+func (s *supervisedSensor) recover(failed sensor.Driver) {
+	if err := failed.Halt(); err != nil {
+		log.Printf("Couldn't halt %s: %v\n", s.model, err)
+	}
+
+	for {
+		s.mu.Lock()
+		s.backoff = nextSensorBackoff(s.backoff)
+		wait, bus := s.backoff, s.bus
+		s.bus = nil
+		s.mu.Unlock()
+
+		if bus != nil {
+			bus.Close()
+		}
+		time.Sleep(wait)
+
+		d, bus, err := s.open()
+
+		s.mu.Lock()
+		if s.halted {
+			s.mu.Unlock()
+			if err == nil {
+				d.Halt()
+			}
+			if bus != nil {
+				bus.Close()
+			}
+			return
+		}
+		if err == nil {
+			s.driver, s.bus, s.failures, s.state = d, bus, 0, SensorRecovering
+			s.mu.Unlock()
+			log.Printf("Opened %s again\n", s.model)
+			return
+		}
+		s.state = SensorFailed
+		retry := nextSensorBackoff(s.backoff)
+		s.mu.Unlock()
+
+		log.Printf("Couldn't open %s again, retrying in %s: %v\n", s.model, retry, err)
+	}
+}
+
+// nextSensorBackoff doubles the backoff up to --sensor-max-backoff.
+func nextSensorBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff < MinSensorBackoff {
+		backoff = MinSensorBackoff
+	}
+	if backoff > args.MaxBackoff {
+		backoff = args.MaxBackoff
+	}
+	return backoff
+}
+
+// CompensatePressure passes the pressure on if the driver is pressure compensated.
+func (s *supervisedSensor) CompensatePressure(hPa float64) float64 {
+	if c, ok := s.Driver().(sensor.PressureCompensated); ok {
+		return c.CompensatePressure(hPa)
+	}
+	return 0
+}
+
+// Schedule passes the time of the next read on if the driver measures on demand.
+func (s *supervisedSensor) Schedule(next time.Time) {
+	if scheduled, ok := s.Driver().(sensor.Scheduled); ok {
+		scheduled.Schedule(next)
+	}
+}
+
+// Halt halts the driver and stops recovering it.
+func (s *supervisedSensor) Halt() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.halted = true
+	if s.driver == nil {
+		return nil
+	}
+	err := s.driver.Halt()
+	if s.bus != nil {
+		s.bus.Close()
+	}
+	return err
+}
+
+// supervised returns the supervised sensor with the given name, nil if there is none.
+func supervised(name string) *supervisedSensor {
+	for _, d := range sensors {
+		if s, ok := d.(*supervisedSensor); ok && s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// supervisedDriver returns the driver in use for the sensor with the given name, nil if there is none.
+func supervisedDriver(name string) sensor.Driver {
+	if s := supervised(name); s != nil {
+		return s.Driver()
+	}
+	return nil
+}
+
+// bmeDevice returns the BME680 in use, nil if there is none.
+func bmeDevice() *bme680.Dev {
+	if d, ok := supervisedDriver("bme680").(*bmeDriver); ok {
+		return d.dev
+	}
+	return nil
+}
+
+// scdDevice returns the SCD4x in use, nil if there is none.
+func scdDevice() *scd4x.Dev {
+	if d, ok := supervisedDriver("scd4x").(*scdDriver); ok {
+		return d.dev
+	}
+	return nil
+}
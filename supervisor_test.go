@@ -0,0 +1,230 @@
+package main
+
+import (
+	"ThermoServer/sensor"
+	"ThermoServer/sim"
+	"errors"
+	"fmt"
+	"periph.io/x/conn/v3/i2c"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errFake = errors.New("fake read error")
+
+// fakeDriver fails its reads while err is set.
+type fakeDriver struct {
+	mu     sync.Mutex
+	err    error
+	halted bool
+}
+
+func (d *fakeDriver) Name() string                  { return "fake" }
+func (d *fakeDriver) Model() string                 { return "Fake" }
+func (d *fakeDriver) Address() uint16               { return 0x42 }
+func (d *fakeDriver) Quantities() []sensor.Quantity { return []sensor.Quantity{sensor.Temperature} }
+
+func (d *fakeDriver) Read() (sensor.Sample, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.err != nil {
+		return sensor.Sample{}, d.err
+	}
+	return sensor.Sample{Time: time.Now(), Values: map[sensor.Quantity]float64{sensor.Temperature: 21}}, nil
+}
+
+func (d *fakeDriver) Halt() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.halted = true
+	return nil
+}
+
+func (d *fakeDriver) fail(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.err = err
+}
+
+func (d *fakeDriver) isHalted() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.halted
+}
+
+// withBackoff shortens the backoff of the test's recoveries.
+func withBackoff(t *testing.T, min, max time.Duration) {
+	oldMin, oldMax, oldFailures := MinSensorBackoff, args.MaxBackoff, args.MaxFailures
+	MinSensorBackoff, args.MaxBackoff, args.MaxFailures = min, max, 3
+	t.Cleanup(func() {
+		MinSensorBackoff, args.MaxBackoff, args.MaxFailures = oldMin, oldMax, oldFailures
+	})
+}
+
+// awaitState waits for the sensor to get into state.
+func awaitState(t *testing.T, s *supervisedSensor, state SensorState) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); s.State() != state; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("state = %s, want %s", s.State(), state)
+		}
+	}
+}
+
+func TestSupervisedSensorRecovery(t *testing.T) {
+	withBackoff(t, 20*time.Millisecond, 80*time.Millisecond)
+
+	// Opening fails a few times before a new driver is returned
+	const failedOpens = 4
+	var mu sync.Mutex
+	var opens []time.Time
+	reopened := &fakeDriver{}
+	open := func() (sensor.Driver, i2c.BusCloser, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		opens = append(opens, time.Now())
+		if len(opens) <= failedOpens {
+			return nil, nil, errFake
+		}
+		return reopened, nil, nil
+	}
+
+	d := &fakeDriver{}
+	s := newSupervisedSensor(d, open)
+	if _, err := s.Read(); err != nil || s.State() != SensorOK {
+		t.Fatalf("Read() = %v in state %s, want ok", err, s.State())
+	}
+
+	d.fail(errFake)
+	for i := 1; i < 3; i++ {
+		if _, err := s.Read(); err != errFake || s.State() != SensorDegraded {
+			t.Fatalf("failed read %d returned %v in state %s, want degraded", i, err, s.State())
+		}
+	}
+	gaveUp := time.Now()
+	if _, err := s.Read(); err != errFake || s.State() != SensorRecovering {
+		t.Fatalf("last failed read returned %v in state %s, want recovering", err, s.State())
+	}
+	if _, err := s.Read(); err != sensor.ErrNotReady {
+		t.Errorf("Read() while recovering = %v, want ErrNotReady", err)
+	}
+
+	awaitState(t, s, SensorFailed)
+	if !d.isHalted() {
+		t.Errorf("failed driver wasn't halted")
+	}
+
+	// Once opened, the sensor is recovering until it's read
+	for s.Driver() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	if s.State() != SensorRecovering {
+		t.Errorf("state = %s after opening the sensor again, want recovering", s.State())
+	}
+	if _, err := s.Read(); err != nil || s.State() != SensorOK {
+		t.Errorf("Read() after recovery = %v in state %s, want ok", err, s.State())
+	}
+
+	// Attempts are spaced by a doubling backoff up to --sensor-max-backoff
+	mu.Lock()
+	defer mu.Unlock()
+	if len(opens) != failedOpens+1 {
+		t.Fatalf("sensor was opened %d times, want %d", len(opens), failedOpens+1)
+	}
+	last := gaveUp
+	for i, want := range []time.Duration{20, 40, 80, 80, 80} {
+		want *= time.Millisecond
+		if wait := opens[i].Sub(last); wait < want || wait > want+50*time.Millisecond {
+			t.Errorf("attempt %d came after %s, want %s", i+1, wait, want)
+		}
+		last = opens[i]
+	}
+}
+
+func TestSupervisedSensorBackoffReset(t *testing.T) {
+	withBackoff(t, 20*time.Millisecond, time.Second)
+
+	opened := make(chan time.Time, 2)
+	next := &fakeDriver{}
+	s := newSupervisedSensor(&fakeDriver{err: sensor.ErrStopped}, func() (sensor.Driver, i2c.BusCloser, error) {
+		opened <- time.Now()
+		return next, nil, nil
+	})
+
+	// A stopped driver is opened again right away, and a successful read resets the backoff
+	for i := 0; i < 2; i++ {
+		gaveUp := time.Now()
+		if _, err := s.Read(); err != sensor.ErrStopped || s.State() != SensorRecovering {
+			t.Fatalf("Read() = %v in state %s, want recovering", err, s.State())
+		}
+		if wait := (<-opened).Sub(gaveUp); wait < 20*time.Millisecond || wait > 70*time.Millisecond {
+			t.Errorf("recovery %d opened the sensor after %s, want 20ms", i+1, wait)
+		}
+		awaitState(t, s, SensorRecovering)
+		for s.Driver() == nil {
+			time.Sleep(time.Millisecond)
+		}
+		if _, err := s.Read(); err != nil {
+			t.Fatalf("Read() = %v", err)
+		}
+
+		next.fail(sensor.ErrStopped)
+		next = &fakeDriver{}
+	}
+}
+
+func TestSupervisedSensorHalt(t *testing.T) {
+	withBackoff(t, 20*time.Millisecond, 20*time.Millisecond)
+
+	reopened := &fakeDriver{}
+	s := newSupervisedSensor(&fakeDriver{err: sensor.ErrStopped}, func() (sensor.Driver, i2c.BusCloser, error) {
+		return reopened, nil, nil
+	})
+	s.Read()
+	if err := s.Halt(); err != nil {
+		t.Fatalf("Halt: %v", err)
+	}
+
+	// The driver opened after halting is halted right away instead of used
+	time.Sleep(100 * time.Millisecond)
+	if s.Driver() != nil || !reopened.isHalted() {
+		t.Errorf("sensor was recovered after it was halted")
+	}
+}
+
+func TestSimulatedReopenReseeds(t *testing.T) {
+	oldSimulate, oldFaults, oldEnv := args.Simulate, args.SimulateFaults, simEnv
+	args.Simulate, args.SimulateFaults = true, FaultRates{sim.ReadError: 0.5}
+	simEnv = sim.NewEnvironment(args.SimulateSeed, time.Now())
+	t.Cleanup(func() {
+		args.Simulate, args.SimulateFaults, simEnv = oldSimulate, oldFaults, oldEnv
+	})
+
+	// Each sensor opened again fails differently than the one before it
+	for _, name := range []string{"bme680", "scd4x"} {
+		open := openSupervised(name)
+		seen := map[string]bool{}
+		for i := 0; i < 3; i++ {
+			d, _, err := open()
+			if err != nil {
+				t.Fatalf("opening %s: %v", name, err)
+			}
+			faults := ""
+			for j := 0; j < 64; j++ {
+				_, err := d.Read()
+				faults += fmt.Sprint(err != nil && !errors.Is(err, sensor.ErrNotReady))
+			}
+			if seen[faults] {
+				t.Errorf("%s opened again replayed the faults of an earlier one", name)
+			}
+			seen[faults] = true
+		}
+	}
+}
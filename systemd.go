@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/coreos/go-systemd/v22/daemon"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// sdNotify sends a state to systemd. Outside of a Type=notify service, it does nothing.
+func sdNotify(state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		log.Printf("Couldn't notify systemd: %v\n", err)
+	}
+}
+
+// systemdNotifier returns a hook that tells systemd ThermoServer is ready once every sensor made it
+// into a reading, and shows the latest reading as the service's status.
+func systemdNotifier() func(SensorReading) {
+	ready := false
+	return func(reading SensorReading) {
+		if !ready && checkReadiness().Status == HealthOK {
+			sdNotify(daemon.SdNotifyReady)
+			ready = true
+		}
+		sdNotify("STATUS=" + readingStatus(reading))
+	}
+}
+
+// readingStatus summarizes the fields a reading has values for.
+func readingStatus(r SensorReading) string {
+	var parts []string
+	for _, f := range []struct {
+		name   string
+		format string
+		value  any
+	}{
+		{"temperature", "%.1f °C", r.Temperature},
+		{"humidity", "%.1f %%RH", r.Humidity},
+		{"pressure", "%.1f hPa", r.Pressure},
+		{"co2", "%d ppm CO2", r.CO2},
+	} {
+		if _, ok := r.Sources[f.name]; ok {
+			parts = append(parts, fmt.Sprintf(f.format, f.value))
+		}
+	}
+	if r.gasUsable() {
+		parts = append(parts, fmt.Sprintf("IAQ %.0f", r.IAQ))
+	}
+
+	if len(parts) == 0 {
+		return "Waiting for readings"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// watchSystemd pings systemd's watchdog as long as /healthz doesn't report anything as down, so
+// systemd restarts ThermoServer once its readings stop. Without WatchdogSec, it returns right away.
+func watchSystemd() {
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		log.Printf("Couldn't set up the systemd watchdog: %v\n", err)
+		return
+	}
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	for range ticker.C {
+		if h := checkHealth(time.Now()); h.Status != HealthDown {
+			sdNotify(daemon.SdNotifyWatchdog)
+		}
+	}
+}
+
+// systemdListener returns the socket systemd passed on socket activation, nil if there is none.
+func systemdListener() net.Listener {
+	listeners, err := activation.Listeners()
+	if err != nil {
+		log.Fatalf("Couldn't use the sockets passed by systemd: %v", err)
+	}
+	if len(listeners) == 0 {
+		return nil
+	}
+	if len(listeners) > 1 || listeners[0] == nil {
+		log.Fatalf("systemd has to pass exactly one stream socket, got %d sockets", len(listeners))
+	}
+	return listeners[0]
+}
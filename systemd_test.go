@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadingStatus(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		reading SensorReading
+		want    string
+	}{
+		{"nothing measured", SensorReading{Temperature: 21}, "Waiting for readings"},
+		{"every field", SensorReading{
+			Temperature: 21.04, Humidity: 45.55, Pressure: 1013.25, CO2: 612, IAQ: 42.4, GasValid: true, HeatStable: true,
+			Sources: map[string]string{"temperature": "bme680", "humidity": "bme680", "pressure": "bme680", "co2": "scd4x"},
+		}, "21.0 °C, 45.5 %RH, 1013.2 hPa, 612 ppm CO2, IAQ 42"},
+		{"only what was measured", SensorReading{
+			Temperature: 19.5, Humidity: 50, CO2: 800,
+			Sources: map[string]string{"co2": "scd4x", "temperature": "scd4x"},
+		}, "19.5 °C, 800 ppm CO2"},
+		{"gas not heat stable", SensorReading{
+			Temperature: 22, IAQ: 100, GasValid: true,
+			Sources: map[string]string{"temperature": "bme680"},
+		}, "22.0 °C"},
+		{"only IAQ", SensorReading{IAQ: 150, GasValid: true, HeatStable: true}, "IAQ 150"},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			if got := readingStatus(c.reading); got != c.want {
+				t.Errorf("readingStatus() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+// withNotifySocket points NOTIFY_SOCKET at a socket of the test's and returns it.
+func withNotifySocket(t *testing.T) *net.UnixConn {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("No unix datagram socket for systemd's notifications: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+// notifications returns the states sent to conn since the last call.
+func notifications(t *testing.T, conn *net.UnixConn) []string {
+	t.Helper()
+
+	var states []string
+	buf := make([]byte, 4096)
+	for {
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return states
+		}
+		states = append(states, string(buf[:n]))
+	}
+}
+
+func TestSystemdNotifier(t *testing.T) {
+	conn := withNotifySocket(t)
+	withSensors(t, newSupervisedSensor(&fakeDriver{}, nil))
+	notify := systemdNotifier()
+
+	reading := func(read bool) SensorReading {
+		r := NewSensorReading(time.Now())
+		r.Temperature = 21
+		r.Sources = map[string]string{"temperature": "fake"}
+		r.Sensors = map[string]SensorStatus{"fake": {State: SensorRecovering}}
+		if read {
+			r.Sensors["fake"] = SensorStatus{State: SensorOK, LastRead: r.UpdatedStr}
+		}
+		current.Set(r)
+		return r
+	}
+
+	for i, c := range []struct {
+		read bool
+		want []string
+	}{
+		{false, []string{"STATUS=21.0 °C"}},
+		{true, []string{"READY=1", "STATUS=21.0 °C"}},
+		{true, []string{"STATUS=21.0 °C"}},  // ready only once
+		{false, []string{"STATUS=21.0 °C"}}, // and never takes it back
+	} {
+		notify(reading(c.read))
+		if got := notifications(t, conn); fmt.Sprintf("%q", got) != fmt.Sprintf("%q", c.want) {
+			t.Errorf("reading %d notified %q, want %q", i, got, c.want)
+		}
+	}
+}
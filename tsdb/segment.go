@@ -0,0 +1,230 @@
+package tsdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Segment files start with a header followed by fixed-size records:
+//
+//	header: "TSEG" | version uint16 | values per record uint16
+//	record: unix nanoseconds int64 | values float64... | CRC-32 of the preceding bytes uint32
+//
+// All integers are little endian. A record torn by a power cut fails its CRC
+// and is cut off the next time the segment is opened for appending. So is a torn
+// header, while a segment whose header was never written is moved aside to a
+// .corrupt file.
+const (
+	segmentMagic   = "TSEG"
+	segmentVersion = 1
+	segmentExt     = ".seg"
+	headerLen      = 8
+	corruptExt     = ".corrupt"
+)
+
+var (
+	errCorrupt  = errors.New("tsdb: corrupt segment")
+	errBadMagic = fmt.Errorf("%w: bad magic", errCorrupt)
+)
+
+func recordLen(width int) int {
+	return 8 + 8*width + 4
+}
+
+// segmentName returns the file name of the segment starting at start.
+func segmentName(start time.Time) string {
+	return strconv.FormatInt(start.Unix(), 10) + segmentExt
+}
+
+// listSegments returns the start times of all segments in dir, oldest first.
+func listSegments(dir string) ([]time.Time, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var starts []time.Time
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		secs, err := strconv.ParseInt(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		starts = append(starts, time.Unix(secs, 0))
+	}
+
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i].Before(starts[j])
+	})
+	return starts, nil
+}
+
+func encodeRecord(r Record) []byte {
+	b := make([]byte, recordLen(len(r.Values)))
+	binary.LittleEndian.PutUint64(b[0:8], uint64(r.Time.UnixNano()))
+	for i, v := range r.Values {
+		binary.LittleEndian.PutUint64(b[8+8*i:], math.Float64bits(v))
+	}
+	binary.LittleEndian.PutUint32(b[len(b)-4:], crc32.ChecksumIEEE(b[:len(b)-4]))
+	return b
+}
+
+// decodeRecord returns false if b doesn't hold a valid record.
+func decodeRecord(b []byte, width int) (Record, bool) {
+	if crc32.ChecksumIEEE(b[:len(b)-4]) != binary.LittleEndian.Uint32(b[len(b)-4:]) {
+		return Record{}, false
+	}
+
+	r := Record{
+		Time:   time.Unix(0, int64(binary.LittleEndian.Uint64(b[0:8]))),
+		Values: make([]float64, width),
+	}
+	for i := range r.Values {
+		r.Values[i] = math.Float64frombits(binary.LittleEndian.Uint64(b[8+8*i:]))
+	}
+	return r, true
+}
+
+func checkHeader(f *os.File, width int) error {
+	var h [headerLen]byte
+	if _, err := io.ReadFull(f, h[:]); err != nil {
+		return fmt.Errorf("%w %s: %v", errCorrupt, f.Name(), err)
+	}
+	if string(h[0:4]) != segmentMagic {
+		return fmt.Errorf("%w in %s", errBadMagic, f.Name())
+	}
+	if v := binary.LittleEndian.Uint16(h[4:6]); v != segmentVersion {
+		return fmt.Errorf("%w %s: unsupported version %d", errCorrupt, f.Name(), v)
+	}
+	if w := binary.LittleEndian.Uint16(h[6:8]); int(w) != width {
+		return fmt.Errorf("%w %s: has %d values per record, expected %d", errCorrupt, f.Name(), w, width)
+	}
+	return nil
+}
+
+// openSegment opens a segment for appending, creating it if needed.
+// A torn header or record at the end of the file is truncated, a file without a header is moved aside.
+// The returned time is that of the segment's last record.
+func openSegment(path string, width int) (*os.File, time.Time, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, time.Time{}, err
+	}
+
+	if info.Size() < headerLen {
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, time.Time{}, err
+		}
+
+		var h [headerLen]byte
+		copy(h[0:4], segmentMagic)
+		binary.LittleEndian.PutUint16(h[4:6], segmentVersion)
+		binary.LittleEndian.PutUint16(h[6:8], uint16(width))
+		if _, err := f.Write(h[:]); err != nil {
+			f.Close()
+			return nil, time.Time{}, err
+		}
+		return f, time.Time{}, f.Sync()
+	}
+
+	if err := checkHeader(f, width); errors.Is(err, errBadMagic) {
+		// The file was extended, but the header never made it to disk
+		f.Close()
+		if err := os.Rename(path, path+corruptExt); err != nil {
+			return nil, time.Time{}, err
+		}
+		return openSegment(path, width)
+	} else if err != nil {
+		f.Close()
+		return nil, time.Time{}, err
+	}
+
+	var last time.Time
+	valid := int64(headerLen)
+	err = scanRecords(f, width, func(r Record) {
+		last = r.Time
+		valid += int64(recordLen(width))
+	})
+	if err != nil {
+		f.Close()
+		return nil, time.Time{}, err
+	}
+
+	if valid != info.Size() {
+		if err := f.Truncate(valid); err != nil {
+			f.Close()
+			return nil, time.Time{}, err
+		}
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, time.Time{}, err
+	}
+
+	return f, last, nil
+}
+
+// scanRecords calls fn for every valid record from the current offset on. It stops at the first invalid one.
+func scanRecords(f *os.File, width int, fn func(Record)) error {
+	rd := bufio.NewReader(f)
+	b := make([]byte, recordLen(width))
+	for {
+		if _, err := io.ReadFull(rd, b); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		r, ok := decodeRecord(b, width)
+		if !ok {
+			return nil
+		}
+		fn(r)
+	}
+}
+
+// readSegment returns all records within [from, to] of the segment at path.
+func readSegment(path string, width int, from, to time.Time) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := checkHeader(f, width); err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	err = scanRecords(f, width, func(r Record) {
+		if !r.Time.Before(from) && !r.Time.After(to) {
+			records = append(records, r)
+		}
+	})
+	return records, err
+}
+
+func segmentPath(dir string, start time.Time) string {
+	return filepath.Join(dir, segmentName(start))
+}
@@ -0,0 +1,442 @@
+package tsdb
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Tier identifies one of the series kept by a DB.
+type Tier string
+
+const (
+	Raw    Tier = "raw"
+	Minute Tier = "1m"
+	Hour   Tier = "1h"
+)
+
+// Record is a single timestamped row of values.
+//
+// Raw records hold one value per field. Rollup records hold the number of
+// raw records that went into them, followed by the mean, minimum, and
+// maximum of every field.
+type Record struct {
+	Time   time.Time
+	Values []float64
+}
+
+// Aggregate is a decoded rollup record.
+type Aggregate struct {
+	Time  time.Time
+	Count int
+	Mean  []float64
+	Min   []float64
+	Max   []float64
+}
+
+// Options configures retention. Zero values mean no limit.
+type Options struct {
+	// RawRetention, MinuteRetention and HourRetention are how long each tier is kept.
+	RawRetention    time.Duration
+	MinuteRetention time.Duration
+	HourRetention   time.Duration
+	// MaxSize is the maximum size of all segment files in bytes. When it's exceeded,
+	// the oldest raw segments are deleted first, then minute and finally hour rollups.
+	MaxSize int64
+}
+
+// ErrOutOfOrder is returned by Append for records older than the last one appended.
+var ErrOutOfOrder = errors.New("tsdb: record is older than the last one")
+
+// retentionInterval is how often retention policies are enforced.
+const retentionInterval = 10 * time.Minute
+
+// clock returns the time retention is enforced at. Tests replace it to enforce retention on records of the past.
+var clock = time.Now
+
+// tier is one series of records, split into segment files covering span each.
+type tier struct {
+	name      Tier
+	dir       string
+	width     int
+	span      time.Duration
+	retention time.Duration
+
+	active      *os.File
+	activeStart time.Time
+	last        time.Time
+}
+
+// rollup accumulates raw records into the current bucket of a rollup tier.
+type rollup struct {
+	tier  *tier
+	step  time.Duration
+	start time.Time
+	count int
+	sum   []float64
+	min   []float64
+	max   []float64
+}
+
+// DB is an embedded time-series store for a fixed set of fields.
+type DB struct {
+	mu      sync.Mutex
+	fields  int
+	maxSize int64
+
+	raw     *tier
+	tiers   []*tier // ordered by eviction priority
+	rollups []*rollup
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Open opens or creates a store in dir for records with the given number of fields.
+// The rollups of any raw records that were appended but not rolled up before the last shutdown are caught up on.
+//
+// Close must be called when done to flush the segment files and stop enforcing retention.
+func Open(dir string, fields int, opts Options) (*DB, error) {
+	db := &DB{
+		fields:  fields,
+		maxSize: opts.MaxSize,
+		stop:    make(chan struct{}),
+	}
+
+	db.raw = &tier{name: Raw, width: fields, span: 24 * time.Hour, retention: opts.RawRetention}
+	minutes := &tier{name: Minute, width: 1 + 3*fields, span: 7 * 24 * time.Hour, retention: opts.MinuteRetention}
+	hours := &tier{name: Hour, width: 1 + 3*fields, span: 90 * 24 * time.Hour, retention: opts.HourRetention}
+	db.tiers = []*tier{db.raw, minutes, hours}
+
+	for _, t := range db.tiers {
+		t.dir = filepath.Join(dir, string(t.name))
+		if err := os.MkdirAll(t.dir, 0755); err != nil {
+			return nil, err
+		}
+		if err := t.openLast(); err != nil {
+			db.closeTiers()
+			return nil, err
+		}
+	}
+
+	db.rollups = []*rollup{
+		newRollup(minutes, time.Minute, fields),
+		newRollup(hours, time.Hour, fields),
+	}
+	if err := db.catchUp(); err != nil {
+		db.closeTiers()
+		return nil, err
+	}
+
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+		db.enforceContinuous()
+	}()
+
+	return db, nil
+}
+
+// Append stores a raw record and rolls it up.
+func (db *DB) Append(t time.Time, values []float64) error {
+	if len(values) != db.fields {
+		return fmt.Errorf("tsdb: got %d values, expected %d", len(values), db.fields)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if t.Before(db.raw.last) {
+		return ErrOutOfOrder
+	}
+
+	r := Record{Time: t, Values: values}
+	if err := db.raw.append(r); err != nil {
+		return err
+	}
+	for _, ru := range db.rollups {
+		if err := ru.add(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Raw returns all raw records within [from, to].
+func (db *DB) Raw(from, to time.Time) ([]Record, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.raw.query(from, to)
+}
+
+// Rollups returns all completed rollups of the Minute or Hour tier that start within [from, to].
+func (db *DB) Rollups(name Tier, from, to time.Time) ([]Aggregate, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var ru *rollup
+	for _, r := range db.rollups {
+		if r.tier.name == name {
+			ru = r
+		}
+	}
+	if ru == nil {
+		return nil, fmt.Errorf("tsdb: no rollup tier %q", name)
+	}
+
+	records, err := ru.tier.query(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	aggs := make([]Aggregate, len(records))
+	for i, r := range records {
+		aggs[i] = Aggregate{
+			Time:  r.Time,
+			Count: int(r.Values[0]),
+			Mean:  r.Values[1 : 1+db.fields],
+			Min:   r.Values[1+db.fields : 1+2*db.fields],
+			Max:   r.Values[1+2*db.fields:],
+		}
+	}
+	return aggs, nil
+}
+
+// Close stops enforcing retention and closes all segment files.
+// Rollup buckets still in progress are recovered from the raw records on the next Open.
+func (db *DB) Close() error {
+	close(db.stop)
+	db.wg.Wait()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.closeTiers()
+}
+
+func (db *DB) closeTiers() error {
+	var firstErr error
+	for _, t := range db.tiers {
+		if t.active == nil {
+			continue
+		}
+		if err := t.active.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		t.active = nil
+	}
+	return firstErr
+}
+
+// catchUp replays the raw records that haven't made it into a rollup yet.
+// It must be called with db.mu lock held or before the DB is shared.
+func (db *DB) catchUp() error {
+	for _, ru := range db.rollups {
+		from := time.Time{}
+		if !ru.tier.last.IsZero() {
+			from = ru.tier.last.Add(ru.step)
+		}
+
+		records, err := db.raw.query(from, db.raw.last)
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			if err := ru.add(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (db *DB) enforceContinuous() {
+	t := time.NewTicker(retentionInterval)
+	defer t.Stop()
+
+	for {
+		db.mu.Lock()
+		db.enforceRetention(clock())
+		db.mu.Unlock()
+
+		select {
+		case <-db.stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// enforceRetention deletes segments that are past their tier's retention, then the oldest segments until
+// the store fits into MaxSize. The active segment of a tier is never deleted.
+// It must be called with db.mu lock held.
+func (db *DB) enforceRetention(now time.Time) {
+	for _, t := range db.tiers {
+		if t.retention <= 0 {
+			continue
+		}
+		starts, err := listSegments(t.dir)
+		if err != nil {
+			continue
+		}
+		for _, start := range starts {
+			if start.Equal(t.activeStart) || start.Add(t.span).After(now.Add(-t.retention)) {
+				continue
+			}
+			os.Remove(segmentPath(t.dir, start))
+		}
+	}
+
+	if db.maxSize <= 0 {
+		return
+	}
+
+	for db.size() > db.maxSize {
+		deleted := false
+		for _, t := range db.tiers {
+			starts, err := listSegments(t.dir)
+			if err != nil || len(starts) == 0 || starts[0].Equal(t.activeStart) {
+				continue
+			}
+			os.Remove(segmentPath(t.dir, starts[0]))
+			deleted = true
+			break
+		}
+		if !deleted {
+			return
+		}
+	}
+}
+
+// size returns the total size of all segment files in bytes.
+func (db *DB) size() int64 {
+	var total int64
+	for _, t := range db.tiers {
+		starts, err := listSegments(t.dir)
+		if err != nil {
+			continue
+		}
+		for _, start := range starts {
+			if info, err := os.Stat(segmentPath(t.dir, start)); err == nil {
+				total += info.Size()
+			}
+		}
+	}
+	return total
+}
+
+// openLast opens the tier's newest segment for appending, if there is one.
+func (t *tier) openLast() error {
+	starts, err := listSegments(t.dir)
+	if err != nil || len(starts) == 0 {
+		return err
+	}
+
+	start := starts[len(starts)-1]
+	f, last, err := openSegment(segmentPath(t.dir, start), t.width)
+	if err != nil {
+		return err
+	}
+
+	t.active, t.activeStart, t.last = f, start, last
+	return nil
+}
+
+// append writes a record to the segment covering its time, starting a new segment if needed.
+func (t *tier) append(r Record) error {
+	start := r.Time.Truncate(t.span)
+	if t.active == nil || !start.Equal(t.activeStart) {
+		if t.active != nil {
+			if err := t.active.Close(); err != nil {
+				return err
+			}
+			t.active = nil
+		}
+
+		f, _, err := openSegment(segmentPath(t.dir, start), t.width)
+		if err != nil {
+			return err
+		}
+		t.active, t.activeStart = f, start
+	}
+
+	if _, err := t.active.Write(encodeRecord(r)); err != nil {
+		return err
+	}
+	t.last = r.Time
+	return t.active.Sync()
+}
+
+// query returns all records within [from, to] across the tier's segments.
+func (t *tier) query(from, to time.Time) ([]Record, error) {
+	starts, err := listSegments(t.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []Record{}
+	for _, start := range starts {
+		if start.After(to) || !start.Add(t.span).After(from) {
+			continue
+		}
+		rs, err := readSegment(segmentPath(t.dir, start), t.width, from, to)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rs...)
+	}
+	return records, nil
+}
+
+func newRollup(t *tier, step time.Duration, fields int) *rollup {
+	return &rollup{
+		tier: t,
+		step: step,
+		sum:  make([]float64, fields),
+		min:  make([]float64, fields),
+		max:  make([]float64, fields),
+	}
+}
+
+// add accumulates a raw record, writing out the current bucket first if the record belongs to a later one.
+func (ru *rollup) add(r Record) error {
+	start := r.Time.Truncate(ru.step)
+	if ru.count > 0 && !start.Equal(ru.start) {
+		if err := ru.flush(); err != nil {
+			return err
+		}
+	}
+
+	if ru.count == 0 {
+		ru.start = start
+		for i, v := range r.Values {
+			ru.sum[i], ru.min[i], ru.max[i] = 0, v, v
+		}
+	}
+
+	ru.count++
+	for i, v := range r.Values {
+		ru.sum[i] += v
+		ru.min[i] = math.Min(ru.min[i], v)
+		ru.max[i] = math.Max(ru.max[i], v)
+	}
+	return nil
+}
+
+func (ru *rollup) flush() error {
+	values := make([]float64, 0, ru.tier.width)
+	values = append(values, float64(ru.count))
+	for _, sum := range ru.sum {
+		values = append(values, sum/float64(ru.count))
+	}
+	values = append(values, ru.min...)
+	values = append(values, ru.max...)
+
+	ru.count = 0
+	return ru.tier.append(Record{Time: ru.start, Values: values})
+}
@@ -0,0 +1,423 @@
+package tsdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// appendRecords appends n records a minute apart from start, with values 1, 2, ….
+func appendRecords(t *testing.T, db *DB, start time.Time, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		if err := db.Append(start.Add(time.Duration(i)*time.Minute), []float64{float64(i + 1), -float64(i + 1)}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+}
+
+// checkRaw fails the test unless the store holds exactly the given raw values, in order.
+func checkRaw(t *testing.T, db *DB, want ...float64) {
+	t.Helper()
+
+	records, err := db.Raw(time.Time{}, testStart.Add(365*24*time.Hour))
+	if err != nil {
+		t.Fatalf("Raw: %v", err)
+	}
+	var got []float64
+	for _, r := range records {
+		got = append(got, r.Values[0])
+	}
+	if len(got) != len(want) {
+		t.Fatalf("raw values = %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("raw values = %v, want %v", got, want)
+		}
+	}
+}
+
+// tornStore returns a store directory with 3 raw records on the first day, and damage done by tear to the
+// segment of the next day, as if the power was cut while writing to it.
+func tornStore(t *testing.T, tear func(path string) error) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	db, err := Open(dir, 2, Options{})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	appendRecords(t, db, testStart, 3)
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if err := tear(segmentPath(filepath.Join(dir, string(Raw)), testStart.Add(24*time.Hour).Truncate(24*time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestCrashRecovery(t *testing.T) {
+	header := []byte(segmentMagic + "\x01\x00\x02\x00")
+	record := encodeRecord(Record{Time: testStart.Add(24 * time.Hour), Values: []float64{42, 42}})
+
+	// What's left of the next day's segment
+	damage := map[string][]byte{
+		"empty segment":   {},
+		"header of zeros": make([]byte, headerLen),
+		"record of zeros": append(append([]byte{}, header...), make([]byte, len(record))...),
+		"torn record":     append(append([]byte{}, header...), record[:len(record)-3]...),
+	}
+	for n := 1; n < headerLen; n++ {
+		damage[fmt.Sprintf("header torn after %d bytes", n)] = header[:n]
+	}
+
+	for name, contents := range damage {
+		contents := contents
+		t.Run(name, func(t *testing.T) {
+			dir := tornStore(t, func(path string) error {
+				return os.WriteFile(path, contents, 0644)
+			})
+
+			db, err := Open(dir, 2, Options{})
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			checkRaw(t, db, 1, 2, 3)
+
+			appendRecords(t, db, testStart.Add(24*time.Hour), 2)
+			if err := db.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			if db, err = Open(dir, 2, Options{}); err != nil {
+				t.Fatalf("Open after recovery: %v", err)
+			}
+			defer db.Close()
+			checkRaw(t, db, 1, 2, 3, 1, 2)
+		})
+	}
+}
+
+func TestCorruptSegmentMovedAside(t *testing.T) {
+	dir := tornStore(t, func(path string) error {
+		return os.WriteFile(path, make([]byte, headerLen+5), 0644)
+	})
+	torn := segmentPath(filepath.Join(dir, string(Raw)), testStart.Add(24*time.Hour).Truncate(24*time.Hour))
+
+	db, err := Open(dir, 2, Options{})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+
+	if info, err := os.Stat(torn + corruptExt); err != nil || info.Size() != headerLen+5 {
+		t.Errorf("segment without a header wasn't kept aside: %v", err)
+	}
+	if info, err := os.Stat(torn); err != nil || info.Size() != headerLen {
+		t.Errorf("segment without a header wasn't started over: %v", err)
+	}
+}
+
+func TestWidthMismatch(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, 2, Options{})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	appendRecords(t, db, testStart, 1)
+	db.Close()
+
+	// A store of other fields isn't damaged, so it's not touched
+	if _, err := Open(dir, 3, Options{}); !errors.Is(err, errCorrupt) {
+		t.Errorf("Open with another number of fields = %v, want a corrupt segment", err)
+	}
+}
+
+// openAt opens the store in dir with retention enforced at now.
+func openAt(t *testing.T, dir string, opts Options, now time.Time) *DB {
+	t.Helper()
+
+	oldClock := clock
+	clock = func() time.Time { return now }
+	t.Cleanup(func() { clock = oldClock })
+
+	db, err := Open(dir, 2, opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// The retention loop may not have got to it yet
+	db.mu.Lock()
+	db.enforceRetention(now)
+	db.mu.Unlock()
+	return db
+}
+
+// appendSeries appends the records from up to to, record i at start + i*interval with the values i and -i.
+func appendSeries(t *testing.T, db *DB, start time.Time, interval time.Duration, from, to int) {
+	t.Helper()
+
+	for i := from; i < to; i++ {
+		if err := db.Append(start.Add(time.Duration(i)*interval), []float64{float64(i), -float64(i)}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+}
+
+// checkAggregate fails the test unless a is the rollup at start of count records of appendSeries, the first
+// of which is record first.
+func checkAggregate(t *testing.T, a Aggregate, start time.Time, count, first int) {
+	t.Helper()
+
+	lo, hi := float64(first), float64(first+count-1)
+	if !a.Time.Equal(start) || a.Count != count {
+		t.Fatalf("rollup at %s of %d records, want %s of %d", a.Time.UTC(), a.Count, start, count)
+	}
+	mean, min, max := []float64{(lo + hi) / 2, -(lo + hi) / 2}, []float64{lo, -hi}, []float64{hi, -lo}
+	if fmt.Sprint(a.Mean, a.Min, a.Max) != fmt.Sprint(mean, min, max) {
+		t.Errorf("rollup at %s: mean %v, min %v, max %v, want %v, %v, %v", start, a.Mean, a.Min, a.Max, mean, min, max)
+	}
+}
+
+// recordTimes returns the times of all records of a tier, in Unix nanoseconds.
+func recordTimes(t *testing.T, db *DB, name Tier) map[int64]bool {
+	t.Helper()
+
+	from, to := time.Time{}, testStart.Add(10*365*24*time.Hour)
+	times := map[int64]bool{}
+	if name == Raw {
+		records, err := db.Raw(from, to)
+		if err != nil {
+			t.Fatalf("Raw: %v", err)
+		}
+		for _, r := range records {
+			times[r.Time.UnixNano()] = true
+		}
+		return times
+	}
+
+	aggs, err := db.Rollups(name, from, to)
+	if err != nil {
+		t.Fatalf("Rollups: %v", err)
+	}
+	for _, a := range aggs {
+		times[a.Time.UnixNano()] = true
+	}
+	return times
+}
+
+func TestRollups(t *testing.T) {
+	// Two hours of a record every 15 seconds, then the first record of the third hour to complete the second
+	const perMinute, perHour = 4, 240
+	const interval, n = 15 * time.Second, 2*perHour + 1
+
+	for name, run := range map[string]func(t *testing.T, dir string){
+		"uninterrupted": func(t *testing.T, dir string) {
+			db := openAt(t, dir, Options{}, testStart)
+			defer db.Close()
+			appendSeries(t, db, testStart, interval, 0, n)
+		},
+		"restarted within a bucket": func(t *testing.T, dir string) {
+			db := openAt(t, dir, Options{}, testStart)
+			appendSeries(t, db, testStart, interval, 0, 250)
+			db.Close()
+
+			db = openAt(t, dir, Options{}, testStart)
+			defer db.Close()
+			appendSeries(t, db, testStart, interval, 250, n)
+		},
+		"rollups lost": func(t *testing.T, dir string) {
+			db := openAt(t, dir, Options{}, testStart)
+			appendSeries(t, db, testStart, interval, 0, n-1)
+			db.Close()
+
+			for _, tier := range []Tier{Minute, Hour} {
+				if err := os.RemoveAll(filepath.Join(dir, string(tier))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			db = openAt(t, dir, Options{}, testStart)
+			defer db.Close()
+			appendSeries(t, db, testStart, interval, n-1, n)
+		},
+	} {
+		run := run
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			run(t, dir)
+
+			db := openAt(t, dir, Options{}, testStart)
+			defer db.Close()
+
+			// Only complete buckets are rolled up
+			minutes, err := db.Rollups(Minute, time.Time{}, testStart.Add(24*time.Hour))
+			if err != nil {
+				t.Fatalf("Rollups: %v", err)
+			}
+			if len(minutes) != 2*60 {
+				t.Fatalf("%d minute rollups, want %d", len(minutes), 2*60)
+			}
+			for i, a := range minutes {
+				checkAggregate(t, a, testStart.Add(time.Duration(i)*time.Minute), perMinute, i*perMinute)
+			}
+
+			hours, err := db.Rollups(Hour, time.Time{}, testStart.Add(24*time.Hour))
+			if err != nil {
+				t.Fatalf("Rollups: %v", err)
+			}
+			if len(hours) != 2 {
+				t.Fatalf("%d hour rollups, want 2", len(hours))
+			}
+			for i, a := range hours {
+				checkAggregate(t, a, testStart.Add(time.Duration(i)*time.Hour), perHour, i*perHour)
+			}
+
+			// The range includes both ends
+			if minutes, err := db.Rollups(Minute, testStart.Add(10*time.Minute), testStart.Add(20*time.Minute)); err != nil || len(minutes) != 11 {
+				t.Errorf("Rollups of 10 minutes = %d rollups, %v, want 11", len(minutes), err)
+			}
+			if _, err := db.Rollups(Raw, time.Time{}, testStart); err == nil {
+				t.Errorf("Rollups of the raw tier succeeded")
+			}
+		})
+	}
+}
+
+func TestRetention(t *testing.T) {
+	// A record every other day for 400 days
+	const interval, n = 48 * time.Hour, 200
+	dir := t.TempDir()
+	db := openAt(t, dir, Options{}, testStart)
+	appendSeries(t, db, testStart, interval, 0, n)
+	db.Close()
+
+	last := testStart.Add((n - 1) * interval)
+	now := last.Add(time.Hour)
+	opts := Options{RawRetention: 3 * 24 * time.Hour, MinuteRetention: 30 * 24 * time.Hour, HourRetention: 120 * 24 * time.Hour}
+	db = openAt(t, dir, opts, now)
+
+	for _, tier := range []struct {
+		name      Tier
+		retention time.Duration
+		span      time.Duration
+	}{
+		{Raw, opts.RawRetention, 24 * time.Hour},
+		{Minute, opts.MinuteRetention, 7 * 24 * time.Hour},
+		{Hour, opts.HourRetention, 90 * 24 * time.Hour},
+	} {
+		times := recordTimes(t, db, tier.name)
+		for i := 0; i < n; i++ {
+			at := testStart.Add(time.Duration(i) * interval)
+			if tier.name != Raw && i == n-1 {
+				break // the last bucket isn't complete
+			}
+
+			// Records within the retention are kept, and segments are deleted once all of their records are past it
+			switch {
+			case !at.Before(now.Add(-tier.retention)) && !times[at.UnixNano()]:
+				t.Errorf("%s: record at %s deleted, %s after it was appended", tier.name, at, now.Sub(at))
+			case at.Before(now.Add(-tier.retention-tier.span)) && times[at.UnixNano()]:
+				t.Errorf("%s: record at %s kept, %s after it was appended", tier.name, at, now.Sub(at))
+			}
+		}
+	}
+	db.Close()
+
+	// The segment being appended to is kept, however old it is
+	db = openAt(t, dir, opts, now.Add(10*365*24*time.Hour))
+	defer db.Close()
+	for _, tier := range []Tier{Raw, Minute, Hour} {
+		if len(recordTimes(t, db, tier)) == 0 {
+			t.Errorf("%s: active segment deleted", tier)
+		}
+	}
+	if times := recordTimes(t, db, Raw); len(times) != 1 || !times[last.UnixNano()] {
+		t.Errorf("%d raw records kept, want the last one", len(times))
+	}
+}
+
+// segmentSizes returns the sizes of a tier's segments, oldest first.
+func segmentSizes(t *testing.T, dir string, name Tier) []int64 {
+	t.Helper()
+
+	starts, err := listSegments(filepath.Join(dir, string(name)))
+	if err != nil {
+		t.Fatalf("listSegments: %v", err)
+	}
+	sizes := make([]int64, len(starts))
+	for i, start := range starts {
+		info, err := os.Stat(segmentPath(filepath.Join(dir, string(name)), start))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[i] = info.Size()
+	}
+	return sizes
+}
+
+// totalSize returns the sum of segment sizes.
+func totalSize(sizes []int64) int64 {
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	return total
+}
+
+func TestMaxSize(t *testing.T) {
+	// A record a day for 10 days, so there are 10 raw segments and at least 2 minute segments
+	dir := t.TempDir()
+	db := openAt(t, dir, Options{}, testStart)
+	appendSeries(t, db, testStart, 24*time.Hour, 0, 10)
+	db.Close()
+	now := testStart.Add(10 * 24 * time.Hour)
+
+	raw, minutes, hours := segmentSizes(t, dir, Raw), segmentSizes(t, dir, Minute), segmentSizes(t, dir, Hour)
+	if len(raw) != 10 || len(minutes) < 2 {
+		t.Fatalf("%d raw and %d minute segments, want 10 and at least 2", len(raw), len(minutes))
+	}
+
+	// The oldest raw segments go first
+	db = openAt(t, dir, Options{MaxSize: totalSize(raw[3:]) + totalSize(minutes) + totalSize(hours)}, now)
+	db.Close()
+	if got := segmentSizes(t, dir, Raw); len(got) != 7 {
+		t.Errorf("%d raw segments left, want 7", len(got))
+	}
+	db = openAt(t, dir, Options{}, now)
+	if times := recordTimes(t, db, Raw); len(times) != 7 || !times[testStart.Add(3*24*time.Hour).UnixNano()] {
+		t.Errorf("raw records %v left, want the last 7", times)
+	}
+	db.Close()
+
+	// Then minute rollups, once only the active raw segment is left
+	db = openAt(t, dir, Options{MaxSize: raw[9] + totalSize(minutes[1:]) + totalSize(hours)}, now)
+	db.Close()
+	if got := segmentSizes(t, dir, Raw); len(got) != 1 {
+		t.Errorf("%d raw segments left, want 1", len(got))
+	}
+	if got := segmentSizes(t, dir, Minute); len(got) != len(minutes)-1 {
+		t.Errorf("%d minute segments left, want %d", len(got), len(minutes)-1)
+	}
+	if got := segmentSizes(t, dir, Hour); len(got) != len(hours) {
+		t.Errorf("%d hour segments left, want %d", len(got), len(hours))
+	}
+
+	// Finally hour rollups, but the segments being appended to are never deleted
+	db = openAt(t, dir, Options{MaxSize: 1}, now)
+	defer db.Close()
+	for _, tier := range []Tier{Raw, Minute, Hour} {
+		if got := segmentSizes(t, dir, tier); len(got) != 1 {
+			t.Errorf("%s: %d segments left, want the active one", tier, len(got))
+		}
+	}
+	appendSeries(t, db, testStart, 24*time.Hour, 10, 11)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"ThermoServer/bme680"
+	"ThermoServer/sim"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsPongTimeout  = 60 * time.Second
+	wsPingInterval = wsPongTimeout * 9 / 10
+)
+
+var upgrader = websocket.Upgrader{
+	// Readings are public anyway and commands need a token, so any origin may connect
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// WSRequest is a message from a WebSocket client.
+//
+//	{"type": "subscribe", "id": "1", "fields": ["temperature", "co2"], "interval": "1m"}
+//	{"type": "unsubscribe", "id": "2"}
+//	{"type": "auth", "id": "3", "token": "…"}
+//	{"type": "command", "id": "4", "command": "scd4x.forcedRecalibration", "params": {"ppm": 420}}
+type WSRequest struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Fields  []string        `json:"fields,omitempty"`
+	Token   string          `json:"token,omitempty"`
+	Command string          `json:"command,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+
+	// Interval is the minimum time between two readings, as a Go duration.
+	Interval string `json:"interval,omitempty"`
+}
+
+// WSResponse is a message to a WebSocket client, either a reading or an acknowledgement of a request.
+type WSResponse struct {
+	Type   string         `json:"type"`
+	ID     string         `json:"id,omitempty"`
+	OK     *bool          `json:"ok,omitempty"`
+	Error  string         `json:"error,omitempty"`
+	Result any            `json:"result,omitempty"`
+	Data   map[string]any `json:"data,omitempty"`
+}
+
+func ack(req WSRequest, result any, err error) WSResponse {
+	ok := err == nil
+	resp := WSResponse{Type: "ack", ID: req.ID, OK: &ok, Result: result}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+// wsClient is the state of a single WebSocket connection.
+type wsClient struct {
+	conn       *websocket.Conn
+	authorized bool // may send commands, only touched by the reading goroutine
+	responses  chan WSResponse
+	settings   chan wsSettings
+	closed     chan struct{} // closed once the writing goroutine is gone
+
+	// Only touched by the writing goroutine, changes arrive through the settings channel
+	subscribed bool
+	fields     map[string]bool // nil means all fields
+	interval   time.Duration
+	lastSent   time.Time
+}
+
+// wsSettings is a subscription change passed from the reading to the writing goroutine.
+type wsSettings struct {
+	subscribed bool
+	fields     map[string]bool
+	interval   time.Duration
+}
+
+// wsHandler serves /ws, a bidirectional WebSocket API.
+//
+// Clients subscribe to readings, optionally limited to some fields and a minimum interval.
+// Clients that authenticated with the --ws-token, either when connecting
+// (Authorization: Bearer header or token query parameter) or with an auth message, may also send commands.
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // the upgrader already replied with an error
+	}
+	defer conn.Close()
+
+	c := &wsClient{
+		conn:      conn,
+		responses: make(chan WSResponse, subscriberBuffer),
+		settings:  make(chan wsSettings, 1),
+		closed:    make(chan struct{}),
+	}
+	defer close(c.closed)
+
+	token := r.URL.Query().Get("token")
+	if bearer := r.Header.Get("Authorization"); strings.HasPrefix(bearer, "Bearer ") {
+		token = strings.TrimPrefix(bearer, "Bearer ")
+	}
+	c.authorized = checkWSToken(token)
+
+	readings := broadcaster.Subscribe()
+	defer broadcaster.Unsubscribe(readings)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.readLoop()
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		var err error
+		select {
+		case <-done:
+			return
+		case s := <-c.settings:
+			c.apply(s)
+		case resp := <-c.responses:
+			// A subscription change is queued before its ack, so it must be in effect once the ack is sent
+			select {
+			case s := <-c.settings:
+				c.apply(s)
+			default:
+			}
+			err = c.write(resp)
+		case reading, ok := <-readings:
+			if !ok {
+				log.Printf("Dropped slow WebSocket client %s\n", r.RemoteAddr)
+				return
+			}
+			if !c.subscribed || reading.Updated.Sub(c.lastSent) < c.interval {
+				continue
+			}
+			c.lastSent = reading.Updated
+			err = c.write(WSResponse{Type: "reading", Data: c.filter(reading)})
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func checkWSToken(token string) bool {
+	return args.WSToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(args.WSToken)) == 1
+}
+
+// apply puts a subscription change into effect. It must only be called by the writing goroutine.
+func (c *wsClient) apply(s wsSettings) {
+	c.subscribed, c.fields, c.interval = s.subscribed, s.fields, s.interval
+}
+
+// send queues a response for the writing goroutine.
+func (c *wsClient) send(resp WSResponse) {
+	select {
+	case c.responses <- resp:
+	case <-c.closed:
+	}
+}
+
+// update passes a subscription change to the writing goroutine.
+func (c *wsClient) update(s wsSettings) {
+	select {
+	case c.settings <- s:
+	case <-c.closed:
+	}
+}
+
+func (c *wsClient) write(resp WSResponse) error {
+	_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteJSON(resp)
+}
+
+// filter returns the subscribed fields of a reading. The update time is always included.
+func (c *wsClient) filter(reading SensorReading) map[string]any {
+	var all map[string]any
+	b, _ := json.Marshal(reading)
+	_ = json.Unmarshal(b, &all)
+
+	if c.fields == nil {
+		return all
+	}
+
+	data := map[string]any{"updated": all["updated"]}
+	for key := range c.fields {
+		if v, ok := all[key]; ok {
+			data[key] = v
+		}
+	}
+	return data
+}
+
+// readLoop handles incoming requests until the connection is closed.
+func (c *wsClient) readLoop() {
+	_ = c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		// Invalid requests are answered, but don't cost the client its connection
+		var req WSRequest
+		if err := json.Unmarshal(message, &req); err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				// The other fields are still decoded, so the request can be acknowledged
+				c.send(ack(req, nil, fmt.Errorf("invalid request: %v", err)))
+			} else {
+				c.send(WSResponse{Type: "error", Error: err.Error()})
+			}
+			continue
+		}
+
+		switch req.Type {
+		case "subscribe":
+			s, err := parseSubscription(req)
+			if err == nil {
+				c.update(s)
+			}
+			c.send(ack(req, nil, err))
+		case "unsubscribe":
+			c.update(wsSettings{})
+			c.send(ack(req, nil, nil))
+		case "auth":
+			var err error
+			if c.authorized = checkWSToken(req.Token); !c.authorized {
+				err = errors.New("invalid token")
+			}
+			c.send(ack(req, nil, err))
+		case "command":
+			if !c.authorized {
+				c.send(ack(req, nil, errors.New("not authorized")))
+				continue
+			}
+			result, err := runCommand(req.Command, req.Params)
+			c.send(ack(req, result, err))
+		default:
+			c.send(ack(req, nil, fmt.Errorf("unknown request type %q", req.Type)))
+		}
+	}
+}
+
+func parseSubscription(req WSRequest) (wsSettings, error) {
+	s := wsSettings{subscribed: true}
+
+	if len(req.Fields) > 0 {
+		s.fields = make(map[string]bool, len(req.Fields))
+		for _, f := range req.Fields {
+			s.fields[f] = true
+		}
+	}
+
+	if req.Interval != "" {
+		interval, err := time.ParseDuration(req.Interval)
+		if err != nil {
+			return s, fmt.Errorf("invalid interval: %v", err)
+		}
+		s.interval = interval
+	}
+
+	return s, nil
+}
+
+// runCommand executes a command sent by an authorized client and returns its result.
+func runCommand(name string, params json.RawMessage) (any, error) {
+	if len(params) == 0 {
+		params = json.RawMessage("{}")
+	}
+
+	switch name {
+	case "scd4x.forcedRecalibration":
+		var p struct {
+			PPM uint16 `json:"ppm"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, fmt.Errorf("invalid params: %v", err)
+		}
+		dev := scdDevice()
+		if dev == nil {
+			return nil, errors.New("no SCD4x sensor is in use")
+		}
+		if p.PPM == 0 {
+			return nil, errors.New("ppm is required")
+		}
+
+		log.Printf("Performing SCD4x forced recalibration to %d ppm\n", p.PPM)
+		correction, err := dev.PerformForcedRecalibration(p.PPM)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]int{"correction": correction}, nil
+
+	case "bme680.setOversampling":
+		var p struct {
+			Temperature string `json:"temperature"`
+			Pressure    string `json:"pressure"`
+			Humidity    string `json:"humidity"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, fmt.Errorf("invalid params: %v", err)
+		}
+
+		dev := bmeDevice()
+		if dev == nil {
+			return nil, errors.New("no BME680 sensor is in use")
+		}
+
+		opts := dev.Opts()
+		for _, o := range []struct {
+			value string
+			dst   *bme680.Oversampling
+		}{
+			{p.Temperature, &opts.Temperature},
+			{p.Pressure, &opts.Pressure},
+			{p.Humidity, &opts.Humidity},
+		} {
+			if o.value == "" {
+				continue
+			}
+			oversampling, err := parseOversampling(o.value)
+			if err != nil {
+				return nil, err
+			}
+			*o.dst = oversampling
+		}
+
+		if err := dev.SetOpts(opts); err != nil {
+			return nil, err
+		}
+		log.Printf("Changed BME680 oversampling to T %s, P %s, H %s\n", opts.Temperature, opts.Pressure, opts.Humidity)
+		return map[string]string{
+			"temperature": opts.Temperature.String(),
+			"pressure":    opts.Pressure.String(),
+			"humidity":    opts.Humidity.String(),
+		}, nil
+
+	case "sim.injectFault":
+		var p struct {
+			Sensor string `json:"sensor"`
+			Fault  string `json:"fault"`
+			Count  int    `json:"count"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, fmt.Errorf("invalid params: %v", err)
+		}
+
+		fault, err := sim.ParseFault(p.Fault)
+		if err != nil {
+			return nil, err
+		}
+		if p.Count <= 0 {
+			p.Count = 1
+		}
+		return nil, injectFault(p.Sensor, fault, p.Count)
+
+	default:
+		return nil, fmt.Errorf("unknown command %q", name)
+	}
+}
+
+// parseOversampling parses an oversampling value as printed by Oversampling.String(), e.g. "4x" or "Off".
+func parseOversampling(value string) (bme680.Oversampling, error) {
+	for o := bme680.Off; o <= bme680.O16x; o++ {
+		if strings.EqualFold(value, o.String()) {
+			return o, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid oversampling %q, must be Off, 1x, 2x, 4x, 8x or 16x", value)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"ThermoServer/sensor"
+	"ThermoServer/sim"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialWS connects to a new WebSocket server with its own broadcaster, passing query and header.
+func dialWS(t *testing.T, query string, header http.Header) *websocket.Conn {
+	t.Helper()
+
+	oldBroadcaster := broadcaster
+	broadcaster = NewBroadcaster()
+	t.Cleanup(func() { broadcaster = oldBroadcaster })
+
+	srv := httptest.NewServer(http.HandlerFunc(wsHandler))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+query, header)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readWS reads the next message off conn.
+func readWS(t *testing.T, conn *websocket.Conn) WSResponse {
+	t.Helper()
+
+	var resp WSResponse
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&resp); err != nil {
+		t.Fatalf("no message: %v", err)
+	}
+	return resp
+}
+
+// requestWS sends a request and returns the response to it.
+func requestWS(t *testing.T, conn *websocket.Conn, request string) WSResponse {
+	t.Helper()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(request)); err != nil {
+		t.Fatalf("%s: %v", request, err)
+	}
+	return readWS(t, conn)
+}
+
+func TestWSInvalidRequests(t *testing.T) {
+	conn := dialWS(t, "", nil)
+
+	for _, c := range []struct {
+		request string
+		want    WSResponse
+	}{
+		{`{"type": "subscribe", "id": "1", "fields": "temperature"}`, WSResponse{Type: "ack", ID: "1", Error: "invalid request"}},
+		{`{"type": "subscribe", "id": "2", "interval": 60}`, WSResponse{Type: "ack", ID: "2", Error: "invalid request"}},
+		{`{"type": "subscribe", "id": 3}`, WSResponse{Type: "ack", Error: "invalid request"}},
+		{`{"type": "subscribe"`, WSResponse{Type: "error", Error: "unexpected end of JSON input"}},
+		{`["subscribe"]`, WSResponse{Type: "ack", Error: "invalid request"}},
+		{`{"type": "unknown", "id": "4"}`, WSResponse{Type: "ack", ID: "4", Error: "unknown request type"}},
+		// Still connected after all of these
+		{`{"type": "subscribe", "id": "5", "fields": ["temperature"]}`, WSResponse{Type: "ack", ID: "5"}},
+	} {
+		resp := requestWS(t, conn, c.request)
+		if resp.Type != c.want.Type || resp.ID != c.want.ID || !strings.HasPrefix(resp.Error, c.want.Error) || (resp.Error == "") != (c.want.Error == "") {
+			t.Errorf("%s: got %+v, want %+v", c.request, resp, c.want)
+		}
+		if resp.Type == "ack" && (resp.OK == nil || *resp.OK != (c.want.Error == "")) {
+			t.Errorf("%s: ok = %v, want %t", c.request, resp.OK, c.want.Error == "")
+		}
+	}
+}
+
+func TestWSSubscription(t *testing.T) {
+	conn := dialWS(t, "", nil)
+	if resp := requestWS(t, conn, `{"type": "subscribe", "id": "1", "fields": ["temperature", "co2"], "interval": "1m"}`); resp.OK == nil || !*resp.OK {
+		t.Fatalf("subscribe: %+v", resp)
+	}
+
+	// At most one reading a minute, only with the subscribed fields
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+	offsets := []time.Duration{0, 30 * time.Second, 61 * time.Second, 90 * time.Second, 122 * time.Second}
+	for i, offset := range offsets {
+		r := NewSensorReading(start.Add(offset))
+		r.Temperature, r.CO2, r.Humidity = float64(i), 400, 50
+		broadcaster.Publish(r)
+	}
+	for _, i := range []int{0, 2, 4} {
+		resp := readWS(t, conn)
+		var keys []string
+		for key := range resp.Data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if resp.Type != "reading" || strings.Join(keys, ",") != "co2,temperature,updated" {
+			t.Fatalf("got %s with %v, want a reading with co2, temperature and updated", resp.Type, keys)
+		}
+		if resp.Data["temperature"] != float64(i) || resp.Data["updated"] != start.Add(offsets[i]).Format(TimeFormat) {
+			t.Errorf("got the reading of %v, want the one of %s", resp.Data["updated"], start.Add(offsets[i]).Format(TimeFormat))
+		}
+	}
+
+	// Subscribing again replaces the fields and interval
+	if resp := requestWS(t, conn, `{"type": "subscribe", "id": "2"}`); resp.OK == nil || !*resp.OK {
+		t.Fatalf("subscribe: %+v", resp)
+	}
+	r := NewSensorReading(start.Add(130 * time.Second))
+	r.Humidity = 50
+	broadcaster.Publish(r)
+	if resp := readWS(t, conn); resp.Data["humidity"] != 50.0 || resp.Data["pressure"] == nil {
+		t.Errorf("got %+v, want a reading with all fields", resp.Data)
+	}
+}
+
+func TestWSAuth(t *testing.T) {
+	oldToken, oldSensors := args.WSToken, sensors
+	args.WSToken = "secret"
+	sensors = []sensor.Driver{sim.NewSCD4x(sim.NewEnvironment(1, time.Now()), 1, nil)}
+	t.Cleanup(func() {
+		args.WSToken, sensors = oldToken, oldSensors
+	})
+
+	bearer := func(token string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + token}}
+	}
+	command := `{"type": "command", "id": "2", "command": "sim.injectFault", "params": {"sensor": "scd4x", "fault": "error"}}`
+
+	for name, c := range map[string]struct {
+		query      string
+		header     http.Header
+		auth       string // token sent in an auth message, if any
+		authorized bool
+	}{
+		"no token":                        {},
+		"header":                          {header: bearer("secret"), authorized: true},
+		"wrong header":                    {header: bearer("wrong")},
+		"header without scheme":           {header: http.Header{"Authorization": {"secret"}}},
+		"query":                           {query: "?token=secret", authorized: true},
+		"wrong query":                     {query: "?token=wrong"},
+		"auth message":                    {auth: "secret", authorized: true},
+		"wrong auth message":              {auth: "wrong"},
+		"header, then wrong auth message": {header: bearer("secret"), auth: "wrong"},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			conn := dialWS(t, c.query, c.header)
+
+			if c.auth != "" {
+				resp := requestWS(t, conn, `{"type": "auth", "id": "1", "token": "`+c.auth+`"}`)
+				if resp.OK == nil || *resp.OK != c.authorized || (!c.authorized && resp.Error != "invalid token") {
+					t.Errorf("auth: %+v, want ok %t", resp, c.authorized)
+				}
+			}
+
+			resp := requestWS(t, conn, command)
+			switch {
+			case resp.OK == nil:
+				t.Fatalf("command: %+v", resp)
+			case c.authorized && !*resp.OK:
+				t.Errorf("command refused: %s", resp.Error)
+			case !c.authorized && (*resp.OK || resp.Error != "not authorized"):
+				t.Errorf("command: %+v, want it refused as not authorized", resp)
+			}
+		})
+	}
+
+	// Without --ws-token, nobody may send commands
+	args.WSToken = ""
+	conn := dialWS(t, "", bearer(""))
+	if resp := requestWS(t, conn, `{"type": "auth", "id": "1", "token": ""}`); resp.OK == nil || *resp.OK {
+		t.Errorf("auth without --ws-token: %+v, want it refused", resp)
+	}
+	if resp := requestWS(t, conn, command); resp.OK == nil || *resp.OK {
+		t.Errorf("command without --ws-token: %+v, want it refused", resp)
+	}
+}